@@ -6,6 +6,29 @@ import (
 	"github.com/cenkalti/backoff/v4"
 )
 
+// copyBackOff returns a back off with the same configuration as the [Sinker]'s stream retry
+// back off but its own state, using the factory configured through [WithRetryBackOffFactory]
+// if any.
+func (s *Sinker) copyBackOff() (backoff.BackOff, error) {
+	if s.backOffFactory != nil {
+		return s.backOffFactory(), nil
+	}
+
+	switch v := s.backOff.(type) {
+	case *backoff.ZeroBackOff, *backoff.StopBackOff:
+		return v, nil
+	case *backoff.ConstantBackOff:
+		copied := *v
+		return &copied, nil
+	case *backoff.ExponentialBackOff:
+		copied := *v
+		copied.Reset()
+		return &copied, nil
+	default:
+		return nil, fmt.Errorf("retry back off of type %T cannot be copied, configure it through WithRetryBackOffFactory", v)
+	}
+}
+
 type BackOffStringer struct{ backoff.BackOff }
 
 func (s BackOffStringer) String() string {
@@ -0,0 +1,215 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// BatchFlushFunc receives the accumulated blocks, in order, alongside the cursor of the
+// last one. Persisting `lastCursor` with the blocks is what makes a restart resume right
+// after the last flushed block.
+type BatchFlushFunc func(ctx context.Context, blocks []*pbsubstreamsrpc.BlockScopedData, lastCursor *Cursor) error
+
+// BatchRollbackFunc is called when an undo signal reaches blocks that were already flushed,
+// every flushed data after `undoSignal.LastValidBlock` must be reverted and `cursor` persisted.
+type BatchRollbackFunc func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error
+
+type BatchingOption func(h *BatchingHandler)
+
+// WithBatchMaxBlocks flushes the batch once it contains `count` blocks.
+func WithBatchMaxBlocks(count int) BatchingOption {
+	return func(h *BatchingHandler) {
+		h.maxBlocks = count
+	}
+}
+
+// WithBatchMaxBytes flushes the batch once the accumulated blocks size, in bytes, reaches `size`.
+func WithBatchMaxBytes(size int) BatchingOption {
+	return func(h *BatchingHandler) {
+		h.maxBytes = size
+	}
+}
+
+// WithBatchMaxAge flushes the batch when a block is received and the oldest pending block has
+// been waiting for at least `age`. It's a threshold checked on block arrival, not a timer: while
+// no block is received, a partial batch stays pending. There is no background flush because the
+// [Sinker] only persists the committed cursor after a handler call.
+func WithBatchMaxAge(age time.Duration) BatchingOption {
+	return func(h *BatchingHandler) {
+		h.maxAge = age
+	}
+}
+
+// WithBatchRollback configures the callback invoked when an undo signal reaches blocks that were
+// already flushed. Without it, such an undo signal is a fatal error.
+func WithBatchRollback(rollback BatchRollbackFunc) BatchingOption {
+	return func(h *BatchingHandler) {
+		h.rollback = rollback
+	}
+}
+
+var _ SinkerHandler = (*BatchingHandler)(nil)
+var _ SinkerCompletionHandler = (*BatchingHandler)(nil)
+var _ SinkerCommittedCursorHandler = (*BatchingHandler)(nil)
+
+// BatchingHandler is a [SinkerHandler] that accumulates [pbsubstreamsrpc.BlockScopedData] and
+// hands them over to a [BatchFlushFunc] in batches. A batch is flushed when any of the configured
+// thresholds (see [WithBatchMaxBlocks], [WithBatchMaxBytes] and [WithBatchMaxAge]) is reached
+// when a block is received. When no threshold is configured, every block is flushed right away.
+//
+// Once the [Sinker]'s [LivenessChecker] reports a block as live, every block is flushed as soon
+// as it's received to keep latency low.
+//
+// Undo signals trim blocks not yet flushed, if the undo goes beyond the last flushed block, the
+// [BatchRollbackFunc] configured through [WithBatchRollback] is called.
+//
+// The [BatchingHandler] implements [SinkerCommittedCursorHandler] so that a [Sinker] configured
+// with a [CursorStore] only saves the cursor of the last flushed block. It also implements
+// [SinkerCompletionHandler] to flush the last partial batch when the block range is completed.
+//
+// Like the [Sinker], it's expected to be used from a single goroutine.
+type BatchingHandler struct {
+	flush    BatchFlushFunc
+	rollback BatchRollbackFunc
+
+	maxBlocks int
+	maxBytes  int
+	maxAge    time.Duration
+	nowFunc   func() time.Time
+
+	pending         []*pbsubstreamsrpc.BlockScopedData
+	pendingBytes    int
+	pendingCursor   *Cursor
+	pendingSince    time.Time
+	lastFlushed     bstream.BlockRef
+	committedCursor *Cursor
+}
+
+func NewBatchingHandler(flush BatchFlushFunc, opts ...BatchingOption) *BatchingHandler {
+	h := &BatchingHandler{
+		flush:   flush,
+		nowFunc: time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+func (h *BatchingHandler) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+	// A reconnection can re-deliver blocks we already have pending, drop our copy in favor of the new one
+	h.trimPendingFrom(data.Clock.Number)
+
+	if len(h.pending) == 0 {
+		h.pendingSince = h.nowFunc()
+	}
+
+	h.pending = append(h.pending, data)
+	h.pendingBytes += proto.Size(data)
+	h.pendingCursor = cursor
+
+	if h.shouldFlush(isLive) {
+		return h.Flush(ctx)
+	}
+
+	return nil
+}
+
+func (h *BatchingHandler) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	lastValidBlock := asBlockRef(undoSignal.LastValidBlock)
+
+	h.trimPendingFrom(lastValidBlock.Num() + 1)
+	if len(h.pending) > 0 {
+		h.pendingCursor = cursor
+	}
+
+	if h.lastFlushed == nil || h.lastFlushed.Num() <= lastValidBlock.Num() {
+		return nil
+	}
+
+	if h.rollback == nil {
+		return fmt.Errorf("undo down to last valid block %s reaches already flushed block %s but no rollback callback is configured", lastValidBlock, h.lastFlushed)
+	}
+
+	if err := h.rollback(ctx, undoSignal, cursor); err != nil {
+		return fmt.Errorf("rollback flushed blocks down to last valid block %s: %w", lastValidBlock, err)
+	}
+
+	h.lastFlushed = lastValidBlock
+	h.committedCursor = cursor
+	return nil
+}
+
+// HandleBlockRangeCompletion flushes the blocks still pending when the [Sinker] completes its range.
+func (h *BatchingHandler) HandleBlockRangeCompletion(ctx context.Context, cursor *Cursor) error {
+	return h.Flush(ctx)
+}
+
+// Flush forces a flush of the pending blocks, it's a no-op if there is none.
+func (h *BatchingHandler) Flush(ctx context.Context) error {
+	if len(h.pending) == 0 {
+		return nil
+	}
+
+	// On error, pending blocks are kept so that they are flushed with the next batch
+	if err := h.flush(ctx, h.pending, h.pendingCursor); err != nil {
+		return fmt.Errorf("flush %d blocks up to %s: %w", len(h.pending), blockToRef(h.pending[len(h.pending)-1]), err)
+	}
+
+	h.lastFlushed = blockToRef(h.pending[len(h.pending)-1])
+	h.committedCursor = h.pendingCursor
+
+	// The flushed slice is now owned by the flush callback, don't re-use its backing array
+	h.pending = nil
+	h.pendingBytes = 0
+	h.pendingCursor = nil
+
+	return nil
+}
+
+// CommittedCursor returns the cursor of the last flushed block, nil if nothing was flushed yet.
+func (h *BatchingHandler) CommittedCursor() *Cursor {
+	return h.committedCursor
+}
+
+// PendingCount returns the number of blocks accumulated and not yet flushed.
+func (h *BatchingHandler) PendingCount() int {
+	return len(h.pending)
+}
+
+func (h *BatchingHandler) shouldFlush(isLive *bool) bool {
+	if isLive != nil && *isLive {
+		return true
+	}
+
+	if h.maxBlocks <= 0 && h.maxBytes <= 0 && h.maxAge <= 0 {
+		return true
+	}
+
+	return (h.maxBlocks > 0 && len(h.pending) >= h.maxBlocks) ||
+		(h.maxBytes > 0 && h.pendingBytes >= h.maxBytes) ||
+		(h.maxAge > 0 && h.nowFunc().Sub(h.pendingSince) >= h.maxAge)
+}
+
+// trimPendingFrom removes every pending block whose number is equal or above `blockNum`.
+func (h *BatchingHandler) trimPendingFrom(blockNum uint64) {
+	keep := len(h.pending)
+	for keep > 0 && h.pending[keep-1].Clock.Number >= blockNum {
+		keep--
+		h.pendingBytes -= proto.Size(h.pending[keep])
+		h.pending[keep] = nil
+	}
+
+	h.pending = h.pending[:keep]
+	if keep == 0 {
+		h.pendingBytes = 0
+		h.pendingCursor = nil
+	}
+}
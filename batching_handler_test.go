@@ -0,0 +1,112 @@
+package sink
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type batchRecorder struct {
+	flushes   []string
+	rollbacks []string
+}
+
+func (r *batchRecorder) flush(ctx context.Context, blocks []*pbsubstreamsrpc.BlockScopedData, lastCursor *Cursor) error {
+	ids := make([]string, len(blocks))
+	for i, block := range blocks {
+		ids[i] = blockToRef(block).String()
+	}
+
+	r.flushes = append(r.flushes, strings.Join(ids, ","))
+	return nil
+}
+
+func (r *batchRecorder) rollback(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	r.rollbacks = append(r.rollbacks, asBlockRef(undoSignal.LastValidBlock).String())
+	return nil
+}
+
+func TestBatchingHandler_MaxBlocks(t *testing.T) {
+	ctx := context.Background()
+	recorder := &batchRecorder{}
+	handler := NewBatchingHandler(recorder.flush, WithBatchMaxBlocks(2))
+
+	require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData("1a", 0), nil, testCursor("1a")))
+	assert.Nil(t, handler.CommittedCursor())
+
+	require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData("2a", 0), nil, testCursor("2a")))
+	require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData("3a", 0), nil, testCursor("3a")))
+
+	assert.Equal(t, []string{"#1 (a),#2 (a)"}, recorder.flushes)
+	assert.Equal(t, testCursor("2a").String(), handler.CommittedCursor().String())
+	assert.Equal(t, 1, handler.PendingCount())
+
+	require.NoError(t, handler.HandleBlockRangeCompletion(ctx, testCursor("3a")))
+	assert.Equal(t, []string{"#1 (a),#2 (a)", "#3 (a)"}, recorder.flushes)
+	assert.Equal(t, testCursor("3a").String(), handler.CommittedCursor().String())
+}
+
+func TestBatchingHandler_MaxAgeAndLive(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+
+	recorder := &batchRecorder{}
+	handler := NewBatchingHandler(recorder.flush, WithBatchMaxBlocks(100), WithBatchMaxAge(10*time.Second))
+	handler.nowFunc = func() time.Time { return now }
+
+	require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData("1a", 0), &blockNotLive, testCursor("1a")))
+	now = now.Add(5 * time.Second)
+	require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData("2a", 0), &blockNotLive, testCursor("2a")))
+	assert.Empty(t, recorder.flushes)
+
+	now = now.Add(5 * time.Second)
+	require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData("3a", 0), &blockNotLive, testCursor("3a")))
+	assert.Equal(t, []string{"#1 (a),#2 (a),#3 (a)"}, recorder.flushes)
+
+	require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData("4a", 0), &liveBlock, testCursor("4a")))
+	assert.Equal(t, []string{"#1 (a),#2 (a),#3 (a)", "#4 (a)"}, recorder.flushes)
+}
+
+func TestBatchingHandler_Undo(t *testing.T) {
+	ctx := context.Background()
+	recorder := &batchRecorder{}
+	handler := NewBatchingHandler(recorder.flush, WithBatchMaxBlocks(3), WithBatchRollback(recorder.rollback))
+
+	for _, id := range []string{"1a", "2a", "3a", "4a", "5a"} {
+		require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData(id, 0), nil, testCursor(id)))
+	}
+	assert.Equal(t, 2, handler.PendingCount())
+
+	// Undo within pending blocks only trims them
+	require.NoError(t, handler.HandleBlockUndoSignal(ctx, msgBlockUndoSignal("4a").blockUndoSignal, testCursor("4a")))
+	assert.Equal(t, 1, handler.PendingCount())
+	assert.Empty(t, recorder.rollbacks)
+
+	// Undo below last flushed block trims everything and rolls back flushed data
+	require.NoError(t, handler.HandleBlockUndoSignal(ctx, msgBlockUndoSignal("2a").blockUndoSignal, testCursor("2a")))
+	assert.Equal(t, 0, handler.PendingCount())
+	assert.Equal(t, []string{"#2 (a)"}, recorder.rollbacks)
+	assert.Equal(t, testCursor("2a").String(), handler.CommittedCursor().String())
+
+	for _, id := range []string{"3b", "4b", "5b"} {
+		require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData(id, 0), nil, testCursor(id)))
+	}
+	assert.Equal(t, []string{"#1 (a),#2 (a),#3 (a)", "#3 (b),#4 (b),#5 (b)"}, recorder.flushes)
+}
+
+func TestBatchingHandler_UndoFlushedWithoutRollback(t *testing.T) {
+	ctx := context.Background()
+	recorder := &batchRecorder{}
+	handler := NewBatchingHandler(recorder.flush)
+
+	require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData("1a", 0), nil, testCursor("1a")))
+	require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData("2a", 0), nil, testCursor("2a")))
+
+	err := handler.HandleBlockUndoSignal(ctx, msgBlockUndoSignal("1a").blockUndoSignal, testCursor("1a"))
+	require.EqualError(t, err, "undo down to last valid block #1 (a) reaches already flushed block #2 (a) but no rollback callback is configured")
+}
@@ -0,0 +1,140 @@
+package sink
+
+import (
+	"time"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+)
+
+// OrphanedBlock is a block previously handled by the [SinkerHandler] and reverted by an undo
+// signal, see [SinkerOrphanedBlocksHandler].
+type OrphanedBlock struct {
+	Number    uint64
+	ID        string
+	Timestamp time.Time
+
+	// Data is the [pbsubstreamsrpc.BlockScopedData] originally handled for this block, it's
+	// only set when the [Sinker] is configured with [WithOrphanedBlockData].
+	Data *pbsubstreamsrpc.BlockScopedData
+}
+
+func (b *OrphanedBlock) Ref() bstream.BlockRef {
+	return bstream.NewBlockRef(b.ID, b.Number)
+}
+
+// maxBlockHistorySize bounds the history in case the final block height is not advancing, the
+// oldest blocks are dropped once reached and undo signals reverting them are reported as truncated.
+const maxBlockHistorySize = 10_000
+
+// blockHistory keeps the blocks emitted to the handler that can still be reverted by an undo
+// signal, that is blocks above the final block height reported by the last block received.
+type blockHistory struct {
+	keepData bool
+	blocks   []*OrphanedBlock
+
+	// untrackedUpTo is the highest block number handled but not kept in the history, either
+	// because it was handled before the [Sinker] started or because the history was full.
+	untrackedUpTo uint64
+}
+
+func newBlockHistory(keepData bool) *blockHistory {
+	return &blockHistory{keepData: keepData}
+}
+
+// markUntrackedUpTo records that blocks up to, and including, `blockNum` were handled without
+// being recorded, undo signals reverting them are reported as truncated.
+func (h *blockHistory) markUntrackedUpTo(blockNum uint64) {
+	h.untrackedUpTo = max(h.untrackedUpTo, blockNum)
+}
+
+// Record adds `data` to the history once it has been handled, dropping blocks that became
+// final and blocks at or above `data`'s number which a reconnection delivers again. It returns
+// true when the history starts dropping blocks that are not final because it's full.
+func (h *blockHistory) Record(data *pbsubstreamsrpc.BlockScopedData) (startsTruncating bool) {
+	h.trimFrom(data.Clock.Number)
+
+	finalCount := 0
+	for finalCount < len(h.blocks) && h.blocks[finalCount].Number <= data.FinalBlockHeight {
+		finalCount++
+	}
+
+	if overflow := len(h.blocks) - finalCount + 1 - maxBlockHistorySize; overflow > 0 {
+		startsTruncating = h.untrackedUpTo <= data.FinalBlockHeight
+
+		finalCount += overflow
+		h.markUntrackedUpTo(h.blocks[finalCount-1].Number)
+	}
+
+	if finalCount > 0 {
+		for i := 0; i < finalCount; i++ {
+			h.blocks[i] = nil
+		}
+		h.blocks = h.blocks[finalCount:]
+	}
+
+	if data.Clock.Number <= data.FinalBlockHeight {
+		return startsTruncating
+	}
+
+	block := &OrphanedBlock{
+		Number: data.Clock.Number,
+		ID:     data.Clock.Id,
+	}
+
+	if data.Clock.Timestamp != nil {
+		block.Timestamp = data.Clock.Timestamp.AsTime()
+	}
+
+	if h.keepData {
+		block.Data = data
+	}
+
+	h.blocks = append(h.blocks, block)
+	return startsTruncating
+}
+
+// Undo removes and returns, newest first, every block after `lastValidBlock`. The list is
+// `truncated` when the undo signal also reverts blocks that are not part of the history.
+func (h *blockHistory) Undo(lastValidBlock bstream.BlockRef) (orphaned []*OrphanedBlock, truncated bool) {
+	keep := h.indexFrom(lastValidBlock.Num() + 1)
+
+	orphaned = make([]*OrphanedBlock, 0, len(h.blocks)-keep)
+	for i := len(h.blocks) - 1; i >= keep; i-- {
+		orphaned = append(orphaned, h.blocks[i])
+	}
+
+	h.trimFrom(lastValidBlock.Num() + 1)
+	return orphaned, h.untrackedUpTo > lastValidBlock.Num()
+}
+
+// restore puts back `orphaned`, as returned by [blockHistory.Undo], in the history.
+func (h *blockHistory) restore(orphaned []*OrphanedBlock) {
+	for i := len(orphaned) - 1; i >= 0; i-- {
+		h.blocks = append(h.blocks, orphaned[i])
+	}
+}
+
+// Len returns the number of blocks kept in the history.
+func (h *blockHistory) Len() int {
+	return len(h.blocks)
+}
+
+func (h *blockHistory) indexFrom(blockNum uint64) int {
+	keep := len(h.blocks)
+	for keep > 0 && h.blocks[keep-1].Number >= blockNum {
+		keep--
+	}
+
+	return keep
+}
+
+// trimFrom removes every block whose number is equal or above `blockNum`.
+func (h *blockHistory) trimFrom(blockNum uint64) {
+	keep := h.indexFrom(blockNum)
+	for i := keep; i < len(h.blocks); i++ {
+		h.blocks[i] = nil
+	}
+
+	h.blocks = h.blocks[:keep]
+}
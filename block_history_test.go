@@ -0,0 +1,123 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockHistory(t *testing.T) {
+	tests := []struct {
+		name             string
+		keepData         bool
+		blocks           []string
+		finalHeight      uint64
+		undoTo           string
+		expectedOrphaned []string
+		expectedLen      int
+	}{
+		{"undo reverts newest blocks", false, []string{"1a", "2a", "3a", "4a"}, 0, "2a", []string{"#4 (a)", "#3 (a)"}, 2},
+		{"undo to last block reverts nothing", false, []string{"1a", "2a"}, 0, "2a", []string{}, 2},
+		{"final blocks are dropped", false, []string{"1a", "2a", "3a", "4a"}, 2, "1a", []string{"#4 (a)", "#3 (a)"}, 0},
+		{"re-delivered blocks replace previous ones", false, []string{"1a", "2a", "3a", "2b", "3b"}, 0, "1a", []string{"#3 (b)", "#2 (b)"}, 1},
+		{"data is kept", true, []string{"1a", "2a"}, 0, "1a", []string{"#2 (a)"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history := newBlockHistory(tt.keepData)
+			for _, id := range tt.blocks {
+				history.Record(blockScopedData(id, tt.finalHeight))
+			}
+
+			orphaned, truncated := history.Undo(asBlockRef(msgBlockUndoSignal(tt.undoTo).blockUndoSignal.LastValidBlock))
+			assert.False(t, truncated)
+
+			refs := make([]string, len(orphaned))
+			for i, block := range orphaned {
+				refs[i] = block.Ref().String()
+				assert.Equal(t, tt.keepData, block.Data != nil)
+			}
+
+			assert.Equal(t, tt.expectedOrphaned, refs)
+			assert.Equal(t, tt.expectedLen, history.Len())
+		})
+	}
+}
+
+func TestBlockHistory_Truncated(t *testing.T) {
+	tests := []struct {
+		name              string
+		untrackedUpTo     uint64
+		blockCount        int
+		undoTo            string
+		expectedStarts    int
+		expectedOrphaned  int
+		expectedTruncated bool
+	}{
+		{"handled before restart", 2, 4, "1a", 0, 4, true},
+		{"handled after restart", 2, 4, "4a", 0, 2, false},
+		{"history full", 0, maxBlockHistorySize + 2, "1a", 1, maxBlockHistorySize, true},
+		{"history full but undo within it", 0, maxBlockHistorySize + 2, "10a", 1, maxBlockHistorySize - 8, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history := newBlockHistory(false)
+			history.markUntrackedUpTo(tt.untrackedUpTo)
+
+			starts := 0
+			for number := tt.untrackedUpTo + 1; number < tt.untrackedUpTo+1+uint64(tt.blockCount); number++ {
+				if history.Record(&pbsubstreamsrpc.BlockScopedData{Clock: &pbsubstreams.Clock{Number: number, Id: fmt.Sprintf("%da", number)}}) {
+					starts++
+				}
+			}
+			assert.Equal(t, tt.expectedStarts, starts, "truncation should be reported once")
+
+			orphaned, truncated := history.Undo(asBlockRef(msgBlockUndoSignal(tt.undoTo).blockUndoSignal.LastValidBlock))
+			assert.Len(t, orphaned, tt.expectedOrphaned)
+			assert.Equal(t, tt.expectedTruncated, truncated)
+		})
+	}
+}
+
+type orphanedBlocksRecorder struct {
+	SinkerHandler
+	err      error
+	orphaned [][]*OrphanedBlock
+}
+
+func (r *orphanedBlocksRecorder) HandleOrphanedBlocks(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, orphaned []*OrphanedBlock, truncated bool, cursor *Cursor) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	r.orphaned = append(r.orphaned, orphaned)
+	return nil
+}
+
+func TestSinker_HandleOrphanedBlocks(t *testing.T) {
+	ctx := context.Background()
+	s := &Sinker{logger: zlog, emittedBlocks: newBlockHistory(false)}
+	recorder := &orphanedBlocksRecorder{err: errors.New("boom")}
+
+	for _, id := range []string{"1a", "2a", "3a"} {
+		s.emittedBlocks.Record(blockScopedData(id, 0))
+	}
+
+	undoSignal := msgBlockUndoSignal("1a").blockUndoSignal
+	require.EqualError(t, s.handleBlockUndoSignal(ctx, recorder, undoSignal, testCursor("1a")), "boom")
+	assert.Equal(t, 3, s.emittedBlocks.Len())
+
+	recorder.err = nil
+	require.NoError(t, s.handleBlockUndoSignal(ctx, recorder, undoSignal, testCursor("1a")))
+	require.Len(t, recorder.orphaned, 1)
+	assert.Equal(t, []uint64{3, 2}, []uint64{recorder.orphaned[0][0].Number, recorder.orphaned[0][1].Number})
+	assert.Equal(t, 1, s.emittedBlocks.Len())
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/streamingfast/bstream"
 	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
 	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 // blockDataBuffer is expected to be used synchronously from a single
@@ -15,69 +16,172 @@ import (
 // about our internal "fake" finality which happens once enough block
 // has "passed" which is the size of the undo block size
 type blockDataBuffer struct {
-	// data is kept striclty ordered and its ordering must be respected
-	// throughout the implementation.
-	//
-	// The array is always fully allocated, but the `dataEmptyAt` determines
-	// where we have actual unallocated space.
-	data []*pbsubstreamsrpc.BlockScopedData
+	// data is a ring of fixed capacity holding the buffered blocks, the oldest one being
+	// at index `head` and the next ones following it, wrapping around the end of the array.
+	// Blocks are kept striclty ordered and its ordering must be respected throughout the
+	// implementation.
+	data  []*pbsubstreamsrpc.BlockScopedData
+	head  int
+	count int
 
-	// We manage manually the offset at which we have space to add new block.
-	dataEmptyAt int
+	// sizes holds the size, in bytes, of the block at the same index in `data`, it's only
+	// allocated when the buffer has a byte cap (see `maxBytes`).
+	sizes    []int
+	bytes    int
+	maxBytes int
+
+	// maxBytesEvictions is the number of blocks emitted, before being final, because of the byte cap.
+	maxBytesEvictions uint64
+
+	// emitted is the slice returned by `HandleBlockScopedData`, re-used from one call to the
+	// next to avoid an allocation per block.
+	emitted []*pbsubstreamsrpc.BlockScopedData
 
 	lastEmittedBlock bstream.BlockRef
+
+	// maxCapacity is non-zero when the buffer is adaptive, in which case its capacity grows,
+	// up to this value, when deep reorganizations are observed.
+	maxCapacity int
+
+	// headBlockNum and finalBlockHeight are the block number and the final block height of
+	// the most recent block received, used to measure reorganizations depth.
+	headBlockNum     uint64
+	finalBlockHeight uint64
+	maxObservedDepth uint64
+
+	// journal records the changes made since the buffer was last persisted, it's only set
+	// when the buffer is persisted, see [WithPersistentBlockDataBuffer].
+	journal *blockDataBufferJournal
+}
+
+// blockDataBufferJournal records the changes made to a [blockDataBuffer] so that they can be
+// appended to its persisted state instead of writing the whole buffer each time.
+type blockDataBufferJournal struct {
+	// emitted are the blocks emitted by the buffer, oldest first.
+	emitted []*pbsubstreamsrpc.BlockScopedData
+
+	// appended are the blocks the buffer received, oldest first, either buffered or emitted right
+	// away because they were final.
+	appended []*pbsubstreamsrpc.BlockScopedData
+
+	// reset is set when the changes cannot be expressed as emitted and appended blocks, after
+	// an undo for example, the whole buffer must then be persisted.
+	reset bool
+}
+
+func (j *blockDataBufferJournal) clear() {
+	j.emitted = nil
+	j.appended = nil
+	j.reset = false
 }
 
 func newBlockDataBuffer(size int) *blockDataBuffer {
 	return &blockDataBuffer{
 		data:             make([]*pbsubstreamsrpc.BlockScopedData, size),
-		dataEmptyAt:      0,
+		emitted:          make([]*pbsubstreamsrpc.BlockScopedData, 0, size+1),
 		lastEmittedBlock: nil,
 	}
 }
 
-func (b *blockDataBuffer) HandleBlockScopedData(blockData *pbsubstreamsrpc.BlockScopedData) (finalBlocks []*pbsubstreamsrpc.BlockScopedData, err error) {
-	// We have one element already in, validate that received block is strictly ordered
-	if b.dataEmptyAt != 0 {
-		highestBlock := b.data[b.dataEmptyAt-1]
-		if blockData.Clock.Number <= highestBlock.Clock.Number {
-			return nil, fmt.Errorf("received new block scoped data (Block %s) whose height is lower or equal than our most recent block (Block %s)", blockToRef(blockData), blockToRef(highestBlock))
-		}
-	}
+// newAdaptiveBlockDataBuffer creates a buffer of `initialSize` blocks that grows up to
+// `maxSize` blocks when reorganizations deeper than half its capacity are observed.
+func newAdaptiveBlockDataBuffer(initialSize int, maxSize int) *blockDataBuffer {
+	b := newBlockDataBuffer(initialSize)
+	b.maxCapacity = maxSize
 
-	lastFinalBlockAt := b.findOldestFinalBlockIndex(blockData.FinalBlockHeight)
+	return b
+}
 
-	dataContainsFinalBlocks := lastFinalBlockAt != -1
-	isFullCapacity := b.dataEmptyAt == len(b.data)
+// setMaxBytes caps the total size, in bytes, of the buffered blocks, 0 meaning no cap.
+func (b *blockDataBuffer) setMaxBytes(maxBytes int) {
+	b.maxBytes = maxBytes
+	b.sizes = nil
+	b.bytes = 0
 
-	if isFullCapacity || dataContainsFinalBlocks {
-		// We are at full capacity and no block is final now, assume oldest block is now final
-		if lastFinalBlockAt == -1 {
-			lastFinalBlockAt = 0
+	if maxBytes > 0 {
+		b.sizes = make([]int, len(b.data))
+		for i := 0; i < b.count; i++ {
+			index := b.index(i)
+			b.sizes[index] = proto.Size(b.data[index])
+			b.bytes += b.sizes[index]
 		}
+	}
+}
+
+// emptyCopy returns a new empty buffer configured like this one, with its current capacity.
+func (b *blockDataBuffer) emptyCopy() *blockDataBuffer {
+	out := newBlockDataBuffer(len(b.data))
+	if b.maxCapacity > 0 {
+		out = newAdaptiveBlockDataBuffer(len(b.data), b.maxCapacity)
+	}
 
-		// We perform a copy of the array slice because we are about to shift it, modifying it in-place, we add plus 1 to allow received blockData itself to be added if needed
-		finalBlockCount := lastFinalBlockAt + 1
-		finalBlocks = make([]*pbsubstreamsrpc.BlockScopedData, 0, finalBlockCount+1)
-		finalBlocks = append(finalBlocks, b.data[0:finalBlockCount]...)
+	out.setMaxBytes(b.maxBytes)
+	return out
+}
 
-		// Shifts non-final blocks at the beginning of the array
-		for i := lastFinalBlockAt + 1; i < b.dataEmptyAt; i++ {
-			b.data[i-finalBlockCount] = b.data[i]
+// HandleBlockScopedData adds `blockData` to the buffer and returns the blocks that are now
+// considered final, oldest first. The returned slice is re-used by the buffer, it's only
+// valid until the next call.
+func (b *blockDataBuffer) HandleBlockScopedData(blockData *pbsubstreamsrpc.BlockScopedData) (finalBlocks []*pbsubstreamsrpc.BlockScopedData, err error) {
+	// We have one element already in, validate that received block is strictly ordered
+	if b.count != 0 {
+		highestBlock := b.at(b.count - 1)
+		if blockData.Clock.Number <= highestBlock.Clock.Number {
+			return nil, fmt.Errorf("received new block scoped data (Block %s) whose height is lower or equal than our most recent block (Block %s)", blockToRef(blockData), blockToRef(highestBlock))
 		}
+	}
+
+	b.headBlockNum = blockData.Clock.Number
+	b.finalBlockHeight = blockData.FinalBlockHeight
 
-		b.dataEmptyAt = b.dataEmptyAt - finalBlockCount
-		b.lastEmittedBlock = blockToRef(finalBlocks[len(finalBlocks)-1])
+	finalBlocks = b.emitted[:0]
+	for b.count > 0 && b.at(0).Clock.Number <= blockData.FinalBlockHeight {
+		finalBlocks = append(finalBlocks, b.popOldest())
 	}
 
 	// If the block received is itself final, we add it to the final blocks array, otherwise, we process as normal
 	isReceivedBlockFinal := blockData.Clock.Number <= blockData.FinalBlockHeight
 
 	if isReceivedBlockFinal {
+		if len(finalBlocks) > 0 {
+			b.lastEmittedBlock = blockToRef(finalBlocks[len(finalBlocks)-1])
+		}
+
+		if b.journal != nil {
+			b.journal.appended = append(b.journal.appended, blockData)
+			b.journal.emitted = append(b.journal.emitted, blockData)
+		}
+
 		finalBlocks = append(finalBlocks, blockData)
 	} else {
-		b.data[b.dataEmptyAt] = blockData
-		b.dataEmptyAt += 1
+		size := 0
+		if b.maxBytes > 0 {
+			size = proto.Size(blockData)
+		}
+
+		// We are at full capacity and no block is final now, assume oldest blocks are now final
+		for b.count == len(b.data) {
+			finalBlocks = append(finalBlocks, b.popOldest())
+		}
+
+		// Same thing when the byte cap would be exceeded, those are tracked since the capacity in
+		// blocks the user configured to absorb forks is not reached
+		for b.maxBytes > 0 && b.count > 0 && b.bytes+size > b.maxBytes {
+			finalBlocks = append(finalBlocks, b.popOldest())
+			b.maxBytesEvictions++
+			UndoBufferMaxBytesEvictionCount.Inc()
+		}
+
+		if len(finalBlocks) > 0 {
+			b.lastEmittedBlock = blockToRef(finalBlocks[len(finalBlocks)-1])
+		}
+
+		b.push(blockData, size)
+	}
+
+	b.emitted = finalBlocks[:0]
+	if len(finalBlocks) == 0 {
+		return nil, nil
 	}
 
 	return finalBlocks, nil
@@ -85,48 +189,172 @@ func (b *blockDataBuffer) HandleBlockScopedData(blockData *pbsubstreamsrpc.Block
 
 func (b *blockDataBuffer) HandleBlockUndoSignal(undoSignal *pbsubstreamsrpc.BlockUndoSignal) error {
 	lastValidBlock := asBlockRef(undoSignal.LastValidBlock)
+	b.observeReorg(lastValidBlock.Num())
 
 	if b.lastEmittedBlock != nil && b.lastEmittedBlock.Num() >= lastValidBlock.Num() {
 		// We might have actually sent exactly the last valid block, in which case no error should occur since the chain
 		// ordering is respected
 		if !bstream.EqualsBlockRefs(b.lastEmittedBlock, lastValidBlock) {
-			return fmt.Errorf("cannot undo down to last valid Block %s because we already sent you Block %s which is after last valid block", lastValidBlock, b.lastEmittedBlock)
+			return &UndoOverflowError{LastValidBlock: lastValidBlock, LastEmittedBlock: b.lastEmittedBlock}
 		}
 	}
 
-	// There is nothing to do, we are already emptied due to a previous undo signal
-	if b.dataEmptyAt == 0 {
-		return nil
+	// If last valid block is not found, every block is removed which "clears" all our block
+	for b.count > 0 && b.at(b.count-1).Clock.Number > lastValidBlock.Num() {
+		b.popNewest()
 	}
 
-	// If last valid block is not found, `dataEmptyAt` will become 0 (-1 + 1) which "clears" all our block
-	b.dataEmptyAt = b.findNewestValidBlockIndex(lastValidBlock.Num()) + 1
 	return nil
 }
 
-func (b *blockDataBuffer) findNewestValidBlockIndex(lastValidBlockHeight uint64) int {
-	newestValidBlockAt := -1
-	for i := b.dataEmptyAt - 1; i >= 0; i-- {
-		if b.data[i].Clock.Number <= lastValidBlockHeight {
-			newestValidBlockAt = i
-			break
-		}
+// forceUndo discards every buffered block and considers `lastValidBlock` as the last emitted
+// one, it's used once an undo going beyond the buffer has been dealt with downstream.
+func (b *blockDataBuffer) forceUndo(lastValidBlock bstream.BlockRef) {
+	for b.count > 0 {
+		b.popNewest()
 	}
 
-	return newestValidBlockAt
+	b.lastEmittedBlock = lastValidBlock
+	if b.journal != nil {
+		b.journal.clear()
+		b.journal.reset = true
+	}
 }
 
-func (b *blockDataBuffer) findOldestFinalBlockIndex(finalHeight uint64) int {
-	oldestFinalBlockAt := -1
-	for i := 0; i < b.dataEmptyAt; i++ {
-		if finalHeight < b.data[i].Clock.Number {
-			break
+// popInRange removes and returns, oldest first, the buffered blocks part of `blockRange` while
+// more than `keep` blocks are buffered, they are considered emitted.
+func (b *blockDataBuffer) popInRange(blockRange *bstream.Range, keep int) (blocks []*pbsubstreamsrpc.BlockScopedData) {
+	for b.count > keep && blockRange.Contains(b.at(0).Clock.Number) {
+		blocks = append(blocks, b.popOldest())
+	}
+
+	if len(blocks) > 0 {
+		b.lastEmittedBlock = blockToRef(blocks[len(blocks)-1])
+	}
+
+	return blocks
+}
+
+// observeReorg records the depth of a reorganization going back to `lastValidBlockNum` and,
+// for an adaptive buffer, grows the capacity to twice the depth when it's deeper than half
+// the current capacity. Growth is capped by the max capacity and by the distance between the
+// head and the final block height since final blocks are never reverted.
+func (b *blockDataBuffer) observeReorg(lastValidBlockNum uint64) {
+	if b.headBlockNum <= lastValidBlockNum {
+		return
+	}
+
+	depth := b.headBlockNum - lastValidBlockNum
+	b.headBlockNum = lastValidBlockNum
+
+	if depth > b.maxObservedDepth {
+		b.maxObservedDepth = depth
+		UndoMaxObservedDepth.SetUint64(depth)
+	}
+
+	if b.maxCapacity == 0 || depth*2 <= uint64(len(b.data)) {
+		return
+	}
+
+	target := min(depth*2, uint64(b.maxCapacity))
+	if b.finalBlockHeight > 0 && b.finalBlockHeight <= lastValidBlockNum+depth {
+		target = min(target, lastValidBlockNum+depth-b.finalBlockHeight)
+	}
+
+	if target > uint64(len(b.data)) {
+		b.resize(int(target))
+	}
+}
+
+// resize changes the capacity of the buffer, `capacity` must be at least the number of blocks buffered.
+func (b *blockDataBuffer) resize(capacity int) {
+	data := make([]*pbsubstreamsrpc.BlockScopedData, capacity)
+	var sizes []int
+	if b.sizes != nil {
+		sizes = make([]int, capacity)
+	}
+
+	for i := 0; i < b.count; i++ {
+		data[i] = b.data[b.index(i)]
+		if sizes != nil {
+			sizes[i] = b.sizes[b.index(i)]
 		}
+	}
 
-		oldestFinalBlockAt = i
+	b.data = data
+	b.sizes = sizes
+	b.head = 0
+	b.emitted = make([]*pbsubstreamsrpc.BlockScopedData, 0, capacity+1)
+}
+
+// push appends `blockData`, of `size` bytes, as the newest block, the buffer must not be full.
+func (b *blockDataBuffer) push(blockData *pbsubstreamsrpc.BlockScopedData, size int) {
+	index := b.index(b.count)
+	b.data[index] = blockData
+	if b.sizes != nil {
+		b.sizes[index] = size
+		b.bytes += size
 	}
 
-	return oldestFinalBlockAt
+	b.count++
+
+	if b.journal != nil {
+		b.journal.appended = append(b.journal.appended, blockData)
+	}
+}
+
+// popOldest removes and returns the oldest block, the buffer must not be empty.
+func (b *blockDataBuffer) popOldest() *pbsubstreamsrpc.BlockScopedData {
+	blockData := b.data[b.head]
+	b.release(b.head)
+
+	b.head = (b.head + 1) % len(b.data)
+	b.count--
+
+	if b.journal != nil {
+		b.journal.emitted = append(b.journal.emitted, blockData)
+	}
+
+	return blockData
+}
+
+// popNewest removes the newest block, the buffer must not be empty.
+func (b *blockDataBuffer) popNewest() {
+	b.release(b.index(b.count - 1))
+	b.count--
+
+	if b.journal != nil {
+		b.journal.clear()
+		b.journal.reset = true
+	}
+}
+
+func (b *blockDataBuffer) release(index int) {
+	b.data[index] = nil
+	if b.sizes != nil {
+		b.bytes -= b.sizes[index]
+		b.sizes[index] = 0
+	}
+}
+
+// at returns the i-th oldest block buffered, `i` must be lower than [blockDataBuffer.Len].
+func (b *blockDataBuffer) at(i int) *pbsubstreamsrpc.BlockScopedData {
+	return b.data[b.index(i)]
+}
+
+func (b *blockDataBuffer) index(i int) int {
+	return (b.head + i) % len(b.data)
+}
+
+// Len returns the number of blocks buffered.
+func (b *blockDataBuffer) Len() int {
+	return b.count
+}
+
+// Bytes returns the total size, in bytes, of the blocks buffered. It's only tracked when the
+// buffer has a byte cap, 0 is returned otherwise.
+func (b *blockDataBuffer) Bytes() int {
+	return b.bytes
 }
 
 func (b *blockDataBuffer) Capacity() int {
@@ -138,7 +366,16 @@ func (b *blockDataBuffer) String() string {
 		return "None"
 	}
 
-	return fmt.Sprintf("Buffering (%d blocks)", len(b.data))
+	capacity := fmt.Sprintf("%d blocks", len(b.data))
+	if b.maxCapacity > 0 {
+		capacity += fmt.Sprintf(", adaptive up to %d blocks", b.maxCapacity)
+	}
+
+	if b.maxBytes > 0 {
+		capacity += fmt.Sprintf(", up to %d bytes", b.maxBytes)
+	}
+
+	return fmt.Sprintf("Buffering (%s)", capacity)
 }
 
 func blockToRef(blockScopedData *pbsubstreamsrpc.BlockScopedData) bstream.BlockRef {
@@ -0,0 +1,418 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// blockDataBufferState is the on-disk representation of a [blockDataBuffer] along with the
+// stream position it corresponds to, see [WithPersistentBlockDataBuffer]. It's the first line
+// of the state file, each following line being a [blockDataBufferStateChange] applied on top
+// of it.
+type blockDataBufferState struct {
+	// ModuleHash is the hash of the output module streamed, the state is only restored when
+	// streaming the same module.
+	ModuleHash string `json:"module_hash"`
+
+	// StreamCursor is the cursor of the last message received from the stream, the stream
+	// resumes from it when the state is restored.
+	StreamCursor string `json:"stream_cursor"`
+
+	// EmittedCursor is the cursor of the last message handled by the handler, the state is
+	// restored as-is if the [Sinker] starts from this cursor.
+	EmittedCursor string `json:"emitted_cursor"`
+
+	// SavedCursor is the last cursor saved in the [CursorStore], which lags behind `EmittedCursor`
+	// when the handler implements [SinkerCommittedCursorHandler]. If the [Sinker] starts from this
+	// cursor, the blocks emitted after it are emitted again before the buffered ones.
+	SavedCursor string `json:"saved_cursor,omitempty"`
+
+	LastEmittedBlockNum uint64 `json:"last_emitted_block_num,omitempty"`
+	LastEmittedBlockID  string `json:"last_emitted_block_id,omitempty"`
+
+	// Blocks are the [pbsubstreamsrpc.BlockScopedData], serialized in protobuf, oldest first. The
+	// first `Emitted` ones were already emitted, the handler might not have committed them yet,
+	// the others are the buffered blocks.
+	Blocks  [][]byte `json:"blocks"`
+	Emitted int      `json:"emitted,omitempty"`
+}
+
+// blockDataBufferStateChange is a change appended to the state file after each message.
+type blockDataBufferStateChange struct {
+	StreamCursor        string `json:"stream_cursor"`
+	EmittedCursor       string `json:"emitted_cursor"`
+	SavedCursor         string `json:"saved_cursor,omitempty"`
+	LastEmittedBlockNum uint64 `json:"last_emitted_block_num,omitempty"`
+	LastEmittedBlockID  string `json:"last_emitted_block_id,omitempty"`
+
+	// Appended are the blocks received by the buffer, serialized in protobuf, oldest first.
+	Appended [][]byte `json:"appended,omitempty"`
+
+	// Emitted is the number of blocks emitted by the buffer, they are the oldest blocks not
+	// emitted yet.
+	Emitted int `json:"emitted,omitempty"`
+}
+
+func (s *blockDataBufferState) apply(change *blockDataBufferStateChange) {
+	s.StreamCursor = change.StreamCursor
+	s.EmittedCursor = change.EmittedCursor
+	s.SavedCursor = change.SavedCursor
+	s.LastEmittedBlockNum = change.LastEmittedBlockNum
+	s.LastEmittedBlockID = change.LastEmittedBlockID
+	s.Blocks = append(s.Blocks, change.Appended...)
+	s.Emitted += change.Emitted
+}
+
+func loadBlockDataBufferState(path string) (*blockDataBufferState, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("read file: %w", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+
+	var state *blockDataBufferState
+	for line := 1; scanner.Scan(); line++ {
+		if state == nil {
+			state = &blockDataBufferState{}
+			if err := json.Unmarshal(scanner.Bytes(), state); err != nil {
+				return nil, fmt.Errorf("unmarshal file %q: %w", path, err)
+			}
+
+			continue
+		}
+
+		change := &blockDataBufferStateChange{}
+		if err := json.Unmarshal(scanner.Bytes(), change); err != nil {
+			if bytes.HasSuffix(content, []byte("\n")) {
+				return nil, fmt.Errorf("unmarshal file %q line %d: %w", path, line, err)
+			}
+
+			// The last change was not fully written, the state before it is consistent
+			break
+		}
+
+		state.apply(change)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read file %q: %w", path, err)
+	}
+
+	return state, nil
+}
+
+// blockDataBufferStore persists a [blockDataBuffer] in a file holding a full state followed by
+// the changes made to the buffer since then, one per line. The changes are compacted into a new
+// state once there are as many as the buffer's capacity, by then the blocks of the previous state
+// are usually not buffered anymore.
+type blockDataBufferStore struct {
+	path       string
+	moduleHash string
+
+	file    *os.File
+	changes int
+
+	// emitted are the blocks emitted after the last cursor saved, as of the last compaction,
+	// they are persisted so that they can be emitted again when restarting from that cursor.
+	emitted []*pbsubstreamsrpc.BlockScopedData
+}
+
+func newBlockDataBufferStore(path string, moduleHash string) *blockDataBufferStore {
+	return &blockDataBufferStore{path: path, moduleHash: moduleHash}
+}
+
+// save persists the changes recorded by the buffer's journal, `savedCursor` being the last
+// cursor saved which the blocks emitted before it are not needed anymore.
+func (s *blockDataBufferStore) save(buffer *blockDataBuffer, streamCursor, emittedCursor, savedCursor *Cursor) error {
+	journal := buffer.journal
+	defer journal.clear()
+
+	s.emitted = append(s.emitted, journal.emitted...)
+
+	if s.file == nil || journal.reset || s.changes >= buffer.Capacity() {
+		return s.compact(buffer, streamCursor, emittedCursor, savedCursor)
+	}
+
+	change := &blockDataBufferStateChange{
+		StreamCursor:  streamCursor.String(),
+		EmittedCursor: emittedCursor.String(),
+		SavedCursor:   savedCursor.String(),
+		Emitted:       len(journal.emitted),
+	}
+	if buffer.lastEmittedBlock != nil {
+		change.LastEmittedBlockNum = buffer.lastEmittedBlock.Num()
+		change.LastEmittedBlockID = buffer.lastEmittedBlock.ID()
+	}
+
+	appended, err := marshalBlocks(journal.appended)
+	if err != nil {
+		return err
+	}
+	change.Appended = appended
+
+	line, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("marshal change: %w", err)
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write file %q: %w", s.path, err)
+	}
+
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("sync file %q: %w", s.path, err)
+	}
+
+	s.changes++
+	return nil
+}
+
+// compact replaces the file's content by the full state of the buffer.
+func (s *blockDataBufferStore) compact(buffer *blockDataBuffer, streamCursor, emittedCursor, savedCursor *Cursor) error {
+	s.trimEmitted(buffer.lastEmittedBlock, savedCursor)
+
+	state := &blockDataBufferState{
+		ModuleHash:    s.moduleHash,
+		StreamCursor:  streamCursor.String(),
+		EmittedCursor: emittedCursor.String(),
+		SavedCursor:   savedCursor.String(),
+		Emitted:       len(s.emitted),
+	}
+	if buffer.lastEmittedBlock != nil {
+		state.LastEmittedBlockNum = buffer.lastEmittedBlock.Num()
+		state.LastEmittedBlockID = buffer.lastEmittedBlock.ID()
+	}
+
+	blocks := make([]*pbsubstreamsrpc.BlockScopedData, 0, len(s.emitted)+buffer.Len())
+	blocks = append(blocks, s.emitted...)
+	for i := 0; i < buffer.Len(); i++ {
+		blocks = append(blocks, buffer.at(i))
+	}
+
+	var err error
+	if state.Blocks, err = marshalBlocks(blocks); err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	if err := s.Close(); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomically(s.path, append(line, '\n'), 0644); err != nil {
+		return fmt.Errorf("write file %q: %w", s.path, err)
+	}
+
+	if s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+		return fmt.Errorf("open file %q: %w", s.path, err)
+	}
+
+	s.changes = 0
+	return nil
+}
+
+// trimEmitted forgets the emitted blocks up to `savedCursor` since the handler committed them and
+// those after `lastEmittedBlock` which were reverted by an undo.
+func (s *blockDataBufferStore) trimEmitted(lastEmittedBlock bstream.BlockRef, savedCursor *Cursor) {
+	if lastEmittedBlock == nil {
+		s.emitted = nil
+		return
+	}
+
+	kept := s.emitted[:0]
+	for _, block := range s.emitted {
+		if !savedCursor.IsBlank() && block.Clock.Number <= savedCursor.Block().Num() {
+			continue
+		}
+
+		if block.Clock.Number > lastEmittedBlock.Num() {
+			continue
+		}
+
+		kept = append(kept, block)
+	}
+
+	clear(s.emitted[len(kept):])
+	s.emitted = kept
+}
+
+func (s *blockDataBufferStore) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	file := s.file
+	s.file = nil
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close file %q: %w", s.path, err)
+	}
+
+	return nil
+}
+
+func marshalBlocks(blocks []*pbsubstreamsrpc.BlockScopedData) ([][]byte, error) {
+	out := make([][]byte, len(blocks))
+	for i, block := range blocks {
+		content, err := proto.Marshal(block)
+		if err != nil {
+			return nil, fmt.Errorf("marshal block %s: %w", blockToRef(block), err)
+		}
+
+		out[i] = content
+	}
+
+	return out, nil
+}
+
+func unmarshalBlocks(contents [][]byte) ([]*pbsubstreamsrpc.BlockScopedData, error) {
+	out := make([]*pbsubstreamsrpc.BlockScopedData, len(contents))
+	for i, content := range contents {
+		out[i] = &pbsubstreamsrpc.BlockScopedData{}
+		if err := proto.Unmarshal(content, out[i]); err != nil {
+			return nil, fmt.Errorf("unmarshal block #%d: %w", i, err)
+		}
+	}
+
+	return out, nil
+}
+
+// restore replaces the content of the buffer by `blocks`, `lastEmittedBlock` being the last
+// block emitted before them.
+func (b *blockDataBuffer) restore(blocks []*pbsubstreamsrpc.BlockScopedData, lastEmittedBlock bstream.BlockRef) error {
+	if len(blocks) > len(b.data) {
+		if len(blocks) > b.maxCapacity {
+			return fmt.Errorf("persisted buffer holds %d blocks which is more than buffer capacity of %d blocks", len(blocks), len(b.data))
+		}
+
+		// An adaptive buffer might have grown before being persisted
+		b.resize(len(blocks))
+	}
+
+	b.forceUndo(nil)
+	for _, block := range blocks {
+		size := 0
+		if b.maxBytes > 0 {
+			size = proto.Size(block)
+		}
+
+		b.push(block, size)
+	}
+
+	b.lastEmittedBlock = lastEmittedBlock
+	return nil
+}
+
+// restoreBlockDataBuffer restores the buffer persisted at `s.bufferStatePath` and returns the
+// cursor the stream must resume from along with the blocks to emit before, which were emitted
+// after `cursor` but might not have been committed by the handler. When there is no persisted
+// buffer or it doesn't match `cursor`, `cursor` is returned as-is.
+//
+// It must be called before the buffer is persisted through [Sinker.persistBlockDataBuffer].
+func (s *Sinker) restoreBlockDataBuffer(cursor *Cursor) (*Cursor, []*pbsubstreamsrpc.BlockScopedData, error) {
+	s.emittedCursor = cursor
+	s.bufferStore = newBlockDataBufferStore(s.bufferStatePath, s.outputModuleHash)
+	defer func() { s.buffer.journal = &blockDataBufferJournal{reset: true} }()
+
+	state, err := loadBlockDataBufferState(s.bufferStatePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load persisted block data buffer: %w", err)
+	}
+
+	if state == nil {
+		return cursor, nil, nil
+	}
+
+	discard := func(reason string, fields ...zap.Field) (*Cursor, []*pbsubstreamsrpc.BlockScopedData, error) {
+		s.logger.Warn("discarding persisted block data buffer since "+reason+", it will be rebuilt from the stream", append(fields, zap.String("path", s.bufferStatePath))...)
+		return cursor, nil, nil
+	}
+
+	if state.ModuleHash != s.outputModuleHash {
+		return discard("it was saved for a different module", zap.String("module_hash", state.ModuleHash))
+	}
+
+	blocks, err := unmarshalBlocks(state.Blocks)
+	if err != nil || state.Emitted > len(blocks) {
+		return discard("it's invalid", zap.Error(err))
+	}
+
+	emitted, buffered := blocks[:state.Emitted], blocks[state.Emitted:]
+
+	var replay []*pbsubstreamsrpc.BlockScopedData
+	switch cursor.String() {
+	case state.EmittedCursor:
+	case state.SavedCursor:
+		// The handler didn't commit the blocks emitted after the saved cursor, they are emitted again
+		for _, block := range emitted {
+			if cursor.IsBlank() || block.Clock.Number > cursor.Block().Num() {
+				replay = append(replay, block)
+			}
+		}
+
+	default:
+		return discard("it was saved for a different cursor", zap.Stringer("cursor_block", cursor.Block()))
+	}
+
+	streamCursor, err := NewCursor(state.StreamCursor)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid persisted block data buffer stream cursor: %w", err)
+	}
+
+	var lastEmittedBlock bstream.BlockRef
+	if state.LastEmittedBlockID != "" {
+		lastEmittedBlock = bstream.NewBlockRef(state.LastEmittedBlockID, state.LastEmittedBlockNum)
+	}
+
+	if err := s.buffer.restore(buffered, lastEmittedBlock); err != nil {
+		return discard("it doesn't fit in the buffer", zap.Error(err))
+	}
+
+	s.bufferStore.emitted = replay
+
+	s.logger.Info("restored persisted block data buffer",
+		zap.String("path", s.bufferStatePath),
+		zap.Int("block_count", len(buffered)),
+		zap.Int("replayed_block_count", len(replay)),
+		zap.Stringer("resuming_at", streamCursor.Block()),
+	)
+
+	return streamCursor, replay, nil
+}
+
+// persistBlockDataBuffer saves the buffer along with the stream position, if persistence
+// is enabled. It must be called once the blocks emitted by the buffer have been handled.
+func (s *Sinker) persistBlockDataBuffer(streamCursor *Cursor) error {
+	if s.bufferStore == nil || s.buffer == nil {
+		return nil
+	}
+
+	savedCursor := s.emittedCursor
+	if s.cursorStore != nil {
+		savedCursor = s.lastSavedCursor
+	}
+
+	if err := s.bufferStore.save(s.buffer, streamCursor, s.emittedCursor, savedCursor); err != nil {
+		return fmt.Errorf("persist block data buffer: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package sink
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinker_PersistentBlockDataBuffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.json")
+
+	s := &Sinker{logger: zlog, buffer: newBlockDataBuffer(3), bufferStatePath: path, outputModuleHash: "abc"}
+	cursor, replay, err := s.restoreBlockDataBuffer(testCursor("1a"))
+	require.NoError(t, err)
+	assert.Equal(t, testCursor("1a").String(), cursor.String(), "no persisted buffer yet")
+	assert.Empty(t, replay)
+
+	streamBlocks(t, s, "2a", "3a", "4a", "5a")
+	assert.Equal(t, 4, persistedLines(t, path), "changes should be appended to the state")
+
+	tests := []struct {
+		name                string
+		startCursor         *Cursor
+		moduleHash          string
+		expectedCursor      *Cursor
+		expectedBuffered    []string
+		expectedLastEmitted string
+	}{
+		{"matching cursor", testCursor("2a"), "abc", testCursor("5a"), []string{"#3 (a)", "#4 (a)", "#5 (a)"}, "#2 (a)"},
+		{"different cursor", testCursor("1a"), "abc", testCursor("1a"), nil, ""},
+		{"different module", testCursor("2a"), "def", testCursor("2a"), nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored := &Sinker{logger: zlog, buffer: newBlockDataBuffer(3), bufferStatePath: path, outputModuleHash: tt.moduleHash}
+
+			cursor, replay, err := restored.restoreBlockDataBuffer(tt.startCursor)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedCursor.String(), cursor.String())
+			assert.Empty(t, replay)
+			assert.Equal(t, tt.expectedBuffered, bufferedBlocks(restored.buffer))
+
+			if tt.expectedLastEmitted == "" {
+				assert.Nil(t, restored.buffer.lastEmittedBlock)
+			} else {
+				assert.Equal(t, tt.expectedLastEmitted, restored.buffer.lastEmittedBlock.String())
+			}
+		})
+	}
+}
+
+func TestSinker_PersistentBlockDataBuffer_Compaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.json")
+
+	s := &Sinker{logger: zlog, buffer: newBlockDataBuffer(2), bufferStatePath: path}
+	_, _, err := s.restoreBlockDataBuffer(nil)
+	require.NoError(t, err)
+
+	streamBlocks(t, s, "1a", "2a", "3a")
+	assert.Equal(t, 3, persistedLines(t, path))
+
+	streamBlocks(t, s, "4a")
+	assert.Equal(t, 1, persistedLines(t, path), "changes should be compacted once as many as the capacity")
+
+	require.NoError(t, s.buffer.HandleBlockUndoSignal(msgBlockUndoSignal("3a").blockUndoSignal))
+	require.NoError(t, s.persistBlockDataBuffer(testCursor("3a")))
+	assert.Equal(t, 1, persistedLines(t, path), "an undo should write the whole state")
+
+	restored := &Sinker{logger: zlog, buffer: newBlockDataBuffer(2), bufferStatePath: path}
+	cursor, _, err := restored.restoreBlockDataBuffer(testCursor("2a"))
+	require.NoError(t, err)
+	assert.Equal(t, testCursor("3a").String(), cursor.String())
+	assert.Equal(t, []string{"#3 (a)"}, bufferedBlocks(restored.buffer))
+}
+
+func TestSinker_PersistentBlockDataBuffer_CommittedCursor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.json")
+
+	s := &Sinker{logger: zlog, buffer: newBlockDataBuffer(2), bufferStatePath: path, cursorStore: NewInMemoryCursorStore()}
+	_, _, err := s.restoreBlockDataBuffer(nil)
+	require.NoError(t, err)
+
+	// The handler only committed #2 while #3 and #4 were emitted too
+	s.lastSavedCursor = testCursor("2a")
+	streamBlocks(t, s, "2a", "3a", "4a", "5a", "6a")
+
+	restored := &Sinker{logger: zlog, buffer: newBlockDataBuffer(2), bufferStatePath: path}
+	cursor, replay, err := restored.restoreBlockDataBuffer(testCursor("2a"))
+	require.NoError(t, err)
+	assert.Equal(t, testCursor("6a").String(), cursor.String())
+	assert.Equal(t, []string{"#5 (a)", "#6 (a)"}, bufferedBlocks(restored.buffer))
+
+	var replayed []string
+	for _, block := range replay {
+		replayed = append(replayed, blockToRef(block).String())
+	}
+	assert.Equal(t, []string{"#3 (a)", "#4 (a)"}, replayed)
+}
+
+func TestSinker_PersistentBlockDataBuffer_TooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.json")
+
+	s := &Sinker{logger: zlog, buffer: newBlockDataBuffer(3), bufferStatePath: path}
+	_, _, err := s.restoreBlockDataBuffer(testCursor("1a"))
+	require.NoError(t, err)
+	streamBlocks(t, s, "2a", "3a", "4a")
+
+	restored := &Sinker{logger: zlog, buffer: newBlockDataBuffer(2), bufferStatePath: path}
+	cursor, _, err := restored.restoreBlockDataBuffer(testCursor("1a"))
+	require.NoError(t, err)
+
+	assert.Equal(t, testCursor("1a").String(), cursor.String(), "buffer larger than capacity should be discarded")
+	assert.Equal(t, 0, restored.buffer.Len())
+}
+
+func TestLoadBlockDataBufferState_PartialChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.json")
+
+	s := &Sinker{logger: zlog, buffer: newBlockDataBuffer(3), bufferStatePath: path}
+	_, _, err := s.restoreBlockDataBuffer(nil)
+	require.NoError(t, err)
+	streamBlocks(t, s, "1a", "2a")
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, append(content, []byte(`{"stream_cursor":"`)...), 0644))
+
+	state, err := loadBlockDataBufferState(path)
+	require.NoError(t, err)
+	assert.Equal(t, testCursor("2a").String(), state.StreamCursor)
+	assert.Len(t, state.Blocks, 2)
+}
+
+// streamBlocks feeds the buffer of `s` like the [Sinker] does, persisting it after each block
+func streamBlocks(t *testing.T, s *Sinker, ids ...string) {
+	t.Helper()
+
+	for _, id := range ids {
+		emitted, err := s.buffer.HandleBlockScopedData(cursoredBlockScopedData(id))
+		require.NoError(t, err)
+
+		for _, block := range emitted {
+			s.emittedCursor = MustNewCursor(block.Cursor)
+		}
+
+		require.NoError(t, s.persistBlockDataBuffer(testCursor(id)))
+	}
+}
+
+func persistedLines(t *testing.T, path string) int {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	return bytes.Count(content, []byte("\n"))
+}
+
+func bufferedBlocks(buffer *blockDataBuffer) (out []string) {
+	for i := 0; i < buffer.Len(); i++ {
+		out = append(out, blockToRef(buffer.at(i)).String())
+	}
+
+	return
+}
@@ -1,6 +1,7 @@
 package sink
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"regexp"
@@ -9,9 +10,12 @@ import (
 	"testing"
 
 	"github.com/bobg/go-generics/v2/slices"
+	"github.com/streamingfast/bstream"
 	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
 	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 )
 
 func TestBlockBuffer(t *testing.T) {
@@ -360,3 +364,278 @@ func Test_BlockDataBuffer_Capacity(t *testing.T) {
 	require.Equal(t, 1, newBlockDataBuffer(1).Capacity())
 	require.Equal(t, 12, newBlockDataBuffer(12).Capacity())
 }
+
+func Test_BlockDataBuffer_Adaptive(t *testing.T) {
+	tests := []struct {
+		name             string
+		initial          int
+		max              int
+		blocks           []string
+		finalHeight      uint64
+		undoTo           string
+		expectedCapacity int
+		expectedDepth    uint64
+	}{
+		{"shallow reorg keeps capacity", 4, 20, []string{"1a", "2a", "3a", "4a"}, 0, "2a", 4, 2},
+		{"deep reorg grows capacity", 4, 20, []string{"1a", "2a", "3a", "4a", "5a", "6a"}, 0, "3a", 6, 3},
+		{"growth capped by max", 4, 5, []string{"1a", "2a", "3a", "4a", "5a", "6a"}, 0, "3a", 5, 3},
+		{"growth capped by final block height", 4, 20, []string{"1a", "2a", "3a", "4a", "5a", "6a", "7a", "8a"}, 3, "5a", 5, 3},
+		{"non adaptive never grows", 4, 0, []string{"1a", "2a", "3a", "4a", "5a", "6a"}, 0, "3a", 4, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := newAdaptiveBlockDataBuffer(tt.initial, tt.max)
+			for _, id := range tt.blocks {
+				_, err := buffer.HandleBlockScopedData(blockScopedData(id, tt.finalHeight))
+				require.NoError(t, err)
+			}
+
+			require.NoError(t, buffer.HandleBlockUndoSignal(msgBlockUndoSignal(tt.undoTo).blockUndoSignal))
+			require.Equal(t, tt.expectedCapacity, buffer.Capacity())
+			require.Equal(t, tt.expectedDepth, buffer.maxObservedDepth)
+		})
+	}
+}
+
+func Test_Sinker_UndoOverflow(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         UndoOverflowPolicy
+		hookErr        error
+		expectedErr    string
+		expectedUndos  []string
+		expectedBuffer int
+	}{
+		{"forward", UndoOverflowPolicyForward, nil, "", []string{"#1 (a)"}, 0},
+		{"hook", UndoOverflowPolicyHook, nil, "", []string{"hook #1 (a)"}, 0},
+		{"hook error keeps buffer", UndoOverflowPolicyHook, errors.New("boom"), "undo overflow hook: boom", nil, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			var undos []string
+			handler := NewSinkerHandlers(
+				func(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+					return nil
+				},
+				func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+					undos = append(undos, asBlockRef(undoSignal.LastValidBlock).String())
+					return nil
+				},
+			)
+
+			s := &Sinker{logger: zlog, buffer: newBlockDataBuffer(2), undoOverflow: tt.policy}
+			s.undoOverflowHook = func(ctx context.Context, overflow *UndoOverflowError, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+				if tt.hookErr != nil {
+					return tt.hookErr
+				}
+
+				undos = append(undos, "hook "+overflow.LastValidBlock.String())
+				return nil
+			}
+
+			for _, id := range []string{"1a", "2a", "3a", "4a"} {
+				_, err := s.buffer.HandleBlockScopedData(blockScopedData(id, 0))
+				require.NoError(t, err)
+			}
+
+			undoSignal := msgBlockUndoSignal("1a").blockUndoSignal
+			err := s.buffer.HandleBlockUndoSignal(undoSignal)
+
+			var overflowErr *UndoOverflowError
+			require.ErrorAs(t, err, &overflowErr)
+			require.Equal(t, "#2 (a)", overflowErr.LastEmittedBlock.String())
+
+			err = s.handleUndoOverflow(ctx, handler, overflowErr, undoSignal, testCursor("1a"))
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, testCursor("1a"), s.emittedCursor)
+			}
+
+			require.Equal(t, tt.expectedUndos, undos)
+			require.Equal(t, tt.expectedBuffer, s.buffer.Len())
+		})
+	}
+}
+
+func Test_BlockDataBuffer_Wraparound(t *testing.T) {
+	buffer := newBlockDataBuffer(3)
+
+	var emitted []string
+	handle := func(ids ...string) {
+		for _, id := range ids {
+			finalBlocks, err := buffer.HandleBlockScopedData(blockScopedData(id, 0))
+			require.NoError(t, err)
+
+			for _, block := range finalBlocks {
+				emitted = append(emitted, blockToRef(block).String())
+			}
+		}
+	}
+
+	handle("1a", "2a", "3a", "4a", "5a", "6a", "7a")
+	require.NoError(t, buffer.HandleBlockUndoSignal(msgBlockUndoSignal("5a").blockUndoSignal))
+	require.Equal(t, 1, buffer.Len())
+
+	handle("6b", "7b", "8b", "9b")
+	require.Equal(t, []string{"#1 (a)", "#2 (a)", "#3 (a)", "#4 (a)", "#5 (a)", "#6 (b)"}, emitted)
+	require.Equal(t, "#7 (b)", blockToRef(buffer.at(0)).String())
+	require.Equal(t, "#9 (b)", blockToRef(buffer.at(buffer.Len()-1)).String())
+}
+
+func Test_BlockDataBuffer_MaxBytes(t *testing.T) {
+	blockSize := proto.Size(sizedBlockScopedData("1a", 0, 100))
+
+	buffer := newBlockDataBuffer(10)
+	buffer.setMaxBytes(2*blockSize + blockSize/2)
+
+	for _, id := range []string{"1a", "2a"} {
+		finalBlocks, err := buffer.HandleBlockScopedData(sizedBlockScopedData(id, 0, 100))
+		require.NoError(t, err)
+		require.Empty(t, finalBlocks)
+	}
+
+	finalBlocks, err := buffer.HandleBlockScopedData(sizedBlockScopedData("3a", 0, 100))
+	require.NoError(t, err)
+	require.Len(t, finalBlocks, 1)
+	require.Equal(t, "#1 (a)", blockToRef(finalBlocks[0]).String())
+	require.Equal(t, 2, buffer.Len())
+	require.Equal(t, 2*blockSize, buffer.Bytes())
+	require.Equal(t, uint64(1), buffer.maxBytesEvictions)
+
+	require.NoError(t, buffer.HandleBlockUndoSignal(msgBlockUndoSignal("2a").blockUndoSignal))
+	require.Equal(t, blockSize, buffer.Bytes())
+}
+
+func Test_BlockDataBuffer_PopInRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		blockRange *bstream.Range
+		keep       int
+		expected   []string
+	}{
+		{"exclusive end", bstream.NewRangeExcludingEnd(1, 4), 0, []string{"#1 (a)", "#2 (a)", "#3 (a)"}},
+		{"inclusive end", bstream.NewInclusiveRange(1, 4), 0, []string{"#1 (a)", "#2 (a)", "#3 (a)", "#4 (a)"}},
+		{"keep last blocks", bstream.NewInclusiveRange(1, 4), 3, []string{"#1 (a)", "#2 (a)"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := newBlockDataBuffer(5)
+			for _, id := range []string{"1a", "2a", "3a", "4a", "5a"} {
+				_, err := buffer.HandleBlockScopedData(blockScopedData(id, 0))
+				require.NoError(t, err)
+			}
+
+			var popped []string
+			for _, block := range buffer.popInRange(tt.blockRange, tt.keep) {
+				popped = append(popped, blockToRef(block).String())
+			}
+
+			require.Equal(t, tt.expected, popped)
+			require.Equal(t, tt.expected[len(tt.expected)-1], buffer.lastEmittedBlock.String())
+		})
+	}
+}
+
+func sizedBlockScopedData(id string, finalBlockHeight uint64, payloadSize int) *pbsubstreamsrpc.BlockScopedData {
+	data := blockScopedData(id, finalBlockHeight)
+	data.Output = &pbsubstreamsrpc.MapModuleOutput{
+		Name:      "map_test",
+		MapOutput: &anypb.Any{Value: make([]byte, payloadSize)},
+	}
+
+	return data
+}
+
+func BenchmarkBlockDataBuffer(b *testing.B) {
+	type bufferImpl interface {
+		HandleBlockScopedData(blockData *pbsubstreamsrpc.BlockScopedData) ([]*pbsubstreamsrpc.BlockScopedData, error)
+	}
+
+	impls := []struct {
+		name    string
+		factory func(size int) bufferImpl
+	}{
+		{"ring", func(size int) bufferImpl { return newBlockDataBuffer(size) }},
+		{"shifting", func(size int) bufferImpl { return newShiftingBlockDataBuffer(size) }},
+	}
+
+	for _, size := range []int{12, 128, 1024} {
+		for _, impl := range impls {
+			b.Run(fmt.Sprintf("%s/size_%d", impl.name, size), func(b *testing.B) {
+				blocks := make([]*pbsubstreamsrpc.BlockScopedData, b.N)
+				for i := range blocks {
+					number := uint64(i + 1)
+					blocks[i] = &pbsubstreamsrpc.BlockScopedData{
+						Clock: &pbsubstreams.Clock{Number: number, Id: strconv.FormatUint(number, 16)},
+					}
+
+					// Half of the buffer is made final by the final block height, the other half by capacity
+					if number > uint64(size/2) {
+						blocks[i].FinalBlockHeight = number - uint64(size/2)
+					}
+				}
+
+				buffer := impl.factory(size)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for _, block := range blocks {
+					if _, err := buffer.HandleBlockScopedData(block); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// shiftingBlockDataBuffer is the previous [blockDataBuffer] implementation, shifting its
+// array on each flush, kept as a reference for [BenchmarkBlockDataBuffer].
+type shiftingBlockDataBuffer struct {
+	data        []*pbsubstreamsrpc.BlockScopedData
+	dataEmptyAt int
+}
+
+func newShiftingBlockDataBuffer(size int) *shiftingBlockDataBuffer {
+	return &shiftingBlockDataBuffer{data: make([]*pbsubstreamsrpc.BlockScopedData, size)}
+}
+
+func (b *shiftingBlockDataBuffer) HandleBlockScopedData(blockData *pbsubstreamsrpc.BlockScopedData) (finalBlocks []*pbsubstreamsrpc.BlockScopedData, err error) {
+	lastFinalBlockAt := -1
+	for i := 0; i < b.dataEmptyAt && b.data[i].Clock.Number <= blockData.FinalBlockHeight; i++ {
+		lastFinalBlockAt = i
+	}
+
+	if b.dataEmptyAt == len(b.data) || lastFinalBlockAt != -1 {
+		if lastFinalBlockAt == -1 {
+			lastFinalBlockAt = 0
+		}
+
+		finalBlockCount := lastFinalBlockAt + 1
+		finalBlocks = make([]*pbsubstreamsrpc.BlockScopedData, 0, finalBlockCount+1)
+		finalBlocks = append(finalBlocks, b.data[0:finalBlockCount]...)
+
+		for i := lastFinalBlockAt + 1; i < b.dataEmptyAt; i++ {
+			b.data[i-finalBlockCount] = b.data[i]
+		}
+
+		b.dataEmptyAt = b.dataEmptyAt - finalBlockCount
+	}
+
+	if blockData.Clock.Number <= blockData.FinalBlockHeight {
+		finalBlocks = append(finalBlocks, blockData)
+	} else {
+		b.data[b.dataEmptyAt] = blockData
+		b.dataEmptyAt += 1
+	}
+
+	return finalBlocks, nil
+}
@@ -0,0 +1,261 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CursorStore defines how the [Sinker] persists the cursor of the last block that was
+// successfully handled so that a restart of the process resumes where it left off.
+//
+// When a [CursorStore] is configured through [WithCursorStore], [Sinker.Run] loads the
+// starting cursor from it and saves the cursor after each successful call to
+// [SinkerHandler.HandleBlockScopedData] and [SinkerHandler.HandleBlockUndoSignal].
+//
+// The cursor is persisted as a [CursorRecord] which binds it to the module that produced it,
+// the [Sinker] uses it at startup to detect that the module changed between two runs, see
+// [WithCursorMismatchPolicy].
+type CursorStore interface {
+	// Load returns the last saved record, nil is returned if nothing was saved yet.
+	Load(ctx context.Context) (*CursorRecord, error)
+
+	// Save persists the received record, replacing any previously saved record.
+	Save(ctx context.Context, record *CursorRecord) error
+
+	// Delete removes any saved record, a following [Load] returns nil. Deleting
+	// when nothing was saved is not an error.
+	Delete(ctx context.Context) error
+}
+
+// CursorRecord is what a [CursorStore] persists, the cursor itself alongside the identity
+// of the module and network that produced it.
+//
+// Identity fields are left empty when unknown, for example when a [FileCursorStore] reads
+// a file written prior the introduction of [CursorRecord].
+type CursorRecord struct {
+	Cursor           *Cursor
+	OutputModuleHash string
+	PackageName      string
+	PackageVersion   string
+	Network          string
+}
+
+// mismatches returns the identity fields that differs between the two records, fields
+// that are empty on either side are considered unknown and never reported. The package
+// version is purposely not compared, a new version producing the same module hash is
+// expected to produce the same data.
+func (r *CursorRecord) mismatches(other *CursorRecord) (out []string) {
+	compare := func(name, stored, actual string) {
+		if stored != "" && actual != "" && stored != actual {
+			out = append(out, fmt.Sprintf("%s %q != %q", name, stored, actual))
+		}
+	}
+
+	compare("output module hash", r.OutputModuleHash, other.OutputModuleHash)
+	compare("package name", r.PackageName, other.PackageName)
+	compare("network", r.Network, other.Network)
+
+	return
+}
+
+var _ CursorStore = (*FileCursorStore)(nil)
+
+// FileCursorStore is a [CursorStore] that persists the [CursorRecord] as JSON in a single
+// file on disk. A file containing only the raw cursor string is also accepted when loading,
+// in which case the record identity fields are left empty.
+//
+// Writes are atomic: the record is first written and fsync'ed to a temporary file in the
+// same directory, which is then renamed over the actual file. A crash at any point leaves
+// either the previous record or the new one, never a torn write.
+type FileCursorStore struct {
+	path string
+}
+
+func NewFileCursorStore(path string) *FileCursorStore {
+	return &FileCursorStore{path: path}
+}
+
+type fileCursorRecord struct {
+	Cursor           string `json:"cursor"`
+	OutputModuleHash string `json:"output_module_hash,omitempty"`
+	PackageName      string `json:"package_name,omitempty"`
+	PackageVersion   string `json:"package_version,omitempty"`
+	Network          string `json:"network,omitempty"`
+}
+
+func (s *FileCursorStore) Load(ctx context.Context) (*CursorRecord, error) {
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("read cursor file %q: %w", s.path, err)
+	}
+
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return nil, nil
+	}
+
+	onDisk := fileCursorRecord{Cursor: string(content)}
+	if content[0] == '{' {
+		onDisk = fileCursorRecord{}
+		if err := json.Unmarshal(content, &onDisk); err != nil {
+			return nil, fmt.Errorf("cursor file %q: invalid JSON: %w", s.path, err)
+		}
+	}
+
+	cursor, err := NewCursor(onDisk.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("cursor file %q: %w", s.path, err)
+	}
+
+	return &CursorRecord{
+		Cursor:           cursor,
+		OutputModuleHash: onDisk.OutputModuleHash,
+		PackageName:      onDisk.PackageName,
+		PackageVersion:   onDisk.PackageVersion,
+		Network:          onDisk.Network,
+	}, nil
+}
+
+func (s *FileCursorStore) Save(ctx context.Context, record *CursorRecord) error {
+	content, err := json.Marshal(fileCursorRecord{
+		Cursor:           record.Cursor.String(),
+		OutputModuleHash: record.OutputModuleHash,
+		PackageName:      record.PackageName,
+		PackageVersion:   record.PackageVersion,
+		Network:          record.Network,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal cursor record: %w", err)
+	}
+
+	if err := writeFileAtomically(s.path, content, 0644); err != nil {
+		return fmt.Errorf("write cursor file %q: %w", s.path, err)
+	}
+
+	return nil
+}
+
+func (s *FileCursorStore) Delete(ctx context.Context) error {
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("delete cursor file %q: %w", s.path, err)
+	}
+
+	return nil
+}
+
+func (s *FileCursorStore) String() string {
+	return fmt.Sprintf("File (%s)", s.path)
+}
+
+var _ CursorStore = (*InMemoryCursorStore)(nil)
+
+// InMemoryCursorStore is a [CursorStore] that keeps the record in memory only, it's mostly
+// useful for testing or for sinks that are fine restarting from scratch each time the
+// process restarts.
+type InMemoryCursorStore struct {
+	lock   sync.RWMutex
+	record *CursorRecord
+}
+
+func NewInMemoryCursorStore() *InMemoryCursorStore {
+	return &InMemoryCursorStore{}
+}
+
+func (s *InMemoryCursorStore) Load(ctx context.Context) (*CursorRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.record == nil {
+		return nil, nil
+	}
+
+	record := *s.record
+	return &record, nil
+}
+
+func (s *InMemoryCursorStore) Save(ctx context.Context, record *CursorRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	copied := *record
+	s.record = &copied
+	return nil
+}
+
+func (s *InMemoryCursorStore) Delete(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.record = nil
+	return nil
+}
+
+func (s *InMemoryCursorStore) String() string {
+	return "In-Memory"
+}
+
+// writeFileAtomically writes content to a temporary file living in the same directory
+// as `path`, fsync it and then rename it to `path`. The parent directory is fsync'ed
+// afterward so that the rename itself is durable.
+func writeFileAtomically(path string, content []byte, perm os.FileMode) (err error) {
+	directory := filepath.Dir(path)
+
+	file, err := os.CreateTemp(directory, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+
+	temporaryPath := file.Name()
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(temporaryPath)
+		}
+	}()
+
+	if _, err = file.Write(content); err != nil {
+		return fmt.Errorf("write temporary file: %w", err)
+	}
+
+	if err = file.Chmod(perm); err != nil {
+		return fmt.Errorf("chmod temporary file: %w", err)
+	}
+
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("sync temporary file: %w", err)
+	}
+
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("close temporary file: %w", err)
+	}
+
+	if err = os.Rename(temporaryPath, path); err != nil {
+		return fmt.Errorf("rename temporary file: %w", err)
+	}
+
+	return syncDirectory(directory)
+}
+
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return fmt.Errorf("open directory: %w", err)
+	}
+	defer dir.Close()
+
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("sync directory: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package sink
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileCursorStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileCursorStore(filepath.Join(t.TempDir(), "cursor.txt"))
+
+	record, err := store.Load(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, record, "expected no record when file does not exist")
+
+	require.NoError(t, store.Save(ctx, &CursorRecord{Cursor: testCursor("10a")}))
+	require.NoError(t, store.Save(ctx, &CursorRecord{
+		Cursor:           testCursor("11a"),
+		OutputModuleHash: "abcdef",
+		PackageName:      "acme",
+		PackageVersion:   "v1.0.0",
+		Network:          "mainnet",
+	}))
+
+	record, err = store.Load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, testCursor("11a").String(), record.Cursor.String())
+	assert.Equal(t, "abcdef", record.OutputModuleHash)
+	assert.Equal(t, "acme", record.PackageName)
+	assert.Equal(t, "v1.0.0", record.PackageVersion)
+	assert.Equal(t, "mainnet", record.Network)
+
+	entries, err := os.ReadDir(filepath.Dir(store.path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files should have been renamed")
+
+	require.NoError(t, store.Delete(ctx))
+	require.NoError(t, store.Delete(ctx), "deleting an absent cursor should not fail")
+
+	record, err = store.Load(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestFileCursorStore_RawCursorContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursor.txt")
+	require.NoError(t, os.WriteFile(path, []byte(testCursor("10a").String()+"\n"), 0644))
+
+	record, err := NewFileCursorStore(path).Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, testCursor("10a").String(), record.Cursor.String())
+	assert.Equal(t, "", record.OutputModuleHash)
+}
+
+func TestFileCursorStore_InvalidContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cursor.txt")
+	require.NoError(t, os.WriteFile(path, []byte("not a cursor"), 0644))
+
+	_, err := NewFileCursorStore(path).Load(context.Background())
+	require.Error(t, err)
+}
+
+func TestInMemoryCursorStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryCursorStore()
+
+	record, err := store.Load(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+
+	require.NoError(t, store.Save(ctx, &CursorRecord{Cursor: testCursor("10a"), OutputModuleHash: "abcdef"}))
+
+	record, err = store.Load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, testCursor("10a").String(), record.Cursor.String())
+	assert.Equal(t, "abcdef", record.OutputModuleHash)
+
+	require.NoError(t, store.Delete(ctx))
+
+	record, err = store.Load(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestSinker_LoadCursor(t *testing.T) {
+	stored := &CursorRecord{Cursor: testCursor("10a"), OutputModuleHash: "aaaa", PackageName: "acme", Network: "mainnet"}
+
+	tests := []struct {
+		name           string
+		stored         *CursorRecord
+		moduleHash     string
+		policy         CursorMismatchPolicy
+		expectedCursor *Cursor
+		expectedErr    error
+		expectDeleted  bool
+	}{
+		{"empty store uses fallback", nil, "aaaa", CursorMismatchPolicyFail, testCursor("5a"), nil, false},
+		{"matching module", stored, "aaaa", CursorMismatchPolicyFail, testCursor("10a"), nil, false},
+		{"unknown stored hash", &CursorRecord{Cursor: testCursor("10a")}, "aaaa", CursorMismatchPolicyFail, testCursor("10a"), nil, false},
+		{"mismatch fail", stored, "bbbb", CursorMismatchPolicyFail, nil, ErrCursorMismatch, false},
+		{"mismatch warn", stored, "bbbb", CursorMismatchPolicyWarn, testCursor("10a"), nil, false},
+		{"mismatch restart", stored, "bbbb", CursorMismatchPolicyRestart, NewBlankCursor(), nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewInMemoryCursorStore()
+			if tt.stored != nil {
+				require.NoError(t, store.Save(ctx, tt.stored))
+			}
+
+			s := &Sinker{
+				pkg:              &pbsubstreams.Package{Network: "mainnet", PackageMeta: []*pbsubstreams.PackageMetadata{{Name: "acme", Version: "v1.0.0"}}},
+				outputModuleHash: tt.moduleHash,
+				logger:           zlog,
+				cursorStore:      store,
+				cursorMismatch:   tt.policy,
+			}
+
+			cursor, err := s.loadCursor(ctx, testCursor("5a"))
+			if tt.expectedErr != nil {
+				require.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedCursor.String(), cursor.String())
+
+			record, err := store.Load(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectDeleted, record == nil && tt.stored != nil)
+		})
+	}
+}
+
+// testCursor returns a valid cursor pointing to the block `id` (`<number><letter>` format
+// like the other test helpers) with the LIB and head block being the block itself.
+func testCursor(id string) *Cursor {
+	number, id := extractNumberAndIDFromBlockID(id)
+	block := bstream.NewBlockRef(id, number)
+
+	return &Cursor{&bstream.Cursor{
+		Step:      bstream.StepNew,
+		Block:     block,
+		LIB:       block,
+		HeadBlock: block,
+	}}
+}
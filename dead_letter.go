@@ -0,0 +1,420 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// DeadLetter is a block the handler failed to process and that the [Sinker] skipped, see [WithDeadLetter].
+type DeadLetter struct {
+	Data     *pbsubstreamsrpc.BlockScopedData
+	Cursor   *Cursor
+	Err      string
+	Attempts int
+	FailedAt time.Time
+}
+
+func (l *DeadLetter) Block() bstream.BlockRef {
+	return blockToRef(l.Data)
+}
+
+// DeadLetterStore persists the blocks skipped by the [Sinker] so that they can be re-driven
+// through the handler later on, see [WithDeadLetter] and [RedriveDeadLetters].
+type DeadLetterStore interface {
+	// Append persists `letter` after the previously appended ones.
+	Append(ctx context.Context, letter *DeadLetter) error
+
+	// List returns every persisted letter, in the order they were appended.
+	List(ctx context.Context) ([]*DeadLetter, error)
+
+	// Replace replaces every persisted letter by `letters`, an empty list clears the store.
+	Replace(ctx context.Context, letters []*DeadLetter) error
+}
+
+// DeadLetterPolicy determines when a block the handler fails to process is dead-lettered.
+type DeadLetterPolicy struct {
+	// MaxAttempts is the number of times the handler is called for the block before it's
+	// dead-lettered, 1 if zero. Each attempt includes the in-place retries configured
+	// through [WithHandlerRetry].
+	MaxAttempts int
+
+	// BackOff determines the wait time between attempts, attempts are made immediately if nil.
+	BackOff backoff.BackOff
+
+	// ShouldDeadLetter returns true if the block can be dead-lettered after failing with `err`,
+	// otherwise the error terminates the [Sinker] as usual. Every error is dead-lettered if nil.
+	ShouldDeadLetter func(err error) bool
+}
+
+// handleBlockScopedData performs the handler call for `data`, dead-lettering the block if
+// it keeps failing and a [DeadLetterStore] is configured, in which case `deadLettered` is true.
+func (s *Sinker) handleBlockScopedData(ctx context.Context, handler SinkerHandler, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) (deadLettered bool, err error) {
+	call := newBlockScopedDataCall(data, isLive, cursor)
+	handle := func(ctx context.Context) error {
+		return handler.HandleBlockScopedData(ctx, data, isLive, cursor)
+	}
+
+	if s.deadLetterStore == nil {
+		return false, s.callHandler(ctx, call, handle)
+	}
+
+	policy := s.deadLetterPolicy
+	maxAttempts := max(policy.MaxAttempts, 1)
+	if policy.BackOff != nil {
+		policy.BackOff.Reset()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.callHandler(ctx, call, handle)
+		if err == nil || ctx.Err() != nil || (policy.ShouldDeadLetter != nil && !policy.ShouldDeadLetter(err)) {
+			return false, err
+		}
+
+		if attempt >= maxAttempts {
+			return true, s.deadLetter(ctx, data, cursor, err, attempt)
+		}
+
+		sleepFor := time.Duration(0)
+		if policy.BackOff != nil {
+			if sleepFor = policy.BackOff.NextBackOff(); sleepFor == backoff.Stop {
+				return true, s.deadLetter(ctx, data, cursor, err, attempt)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(sleepFor):
+		}
+	}
+}
+
+func (s *Sinker) deadLetter(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, cursor *Cursor, handlerErr error, attempts int) error {
+	letter := &DeadLetter{
+		Data:     data,
+		Cursor:   cursor,
+		Err:      handlerErr.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	}
+
+	if err := s.deadLetterStore.Append(ctx, letter); err != nil {
+		return fmt.Errorf("dead-letter block %s: %w (handler error: %w)", letter.Block(), err, handlerErr)
+	}
+
+	if s.deadLetterHighestBlock != nil {
+		highest := max(*s.deadLetterHighestBlock, letter.Block().Num())
+		s.deadLetterHighestBlock = &highest
+	}
+
+	s.logger.Warn("handler failed to process block, block has been dead-lettered and skipped",
+		zap.Stringer("block", letter.Block()),
+		zap.Int("attempts", attempts),
+		zap.Error(handlerErr),
+	)
+	DeadLetterCount.Inc()
+
+	return nil
+}
+
+// dropRevertedDeadLetters removes from the [DeadLetterStore] the blocks reverted by an undo signal
+// to `lastValidBlock`, they are not part of the chain anymore and must never be re-driven. The store
+// is listed on the first undo signal only, afterwards it's listed again only if it holds letters
+// above `lastValidBlock`.
+func (s *Sinker) dropRevertedDeadLetters(ctx context.Context, lastValidBlock bstream.BlockRef) error {
+	if s.deadLetterStore == nil {
+		return nil
+	}
+
+	if s.deadLetterHighestBlock != nil && *s.deadLetterHighestBlock <= lastValidBlock.Num() {
+		return nil
+	}
+
+	letters, err := s.deadLetterStore.List(ctx)
+	if err != nil {
+		return fmt.Errorf("list dead letters: %w", err)
+	}
+
+	highest := uint64(0)
+	kept := make([]*DeadLetter, 0, len(letters))
+	for _, letter := range letters {
+		if letter.Block().Num() > lastValidBlock.Num() {
+			continue
+		}
+
+		kept = append(kept, letter)
+		highest = max(highest, letter.Block().Num())
+	}
+
+	if len(kept) != len(letters) {
+		if err := s.deadLetterStore.Replace(ctx, kept); err != nil {
+			return fmt.Errorf("drop dead letters reverted by undo signal: %w", err)
+		}
+
+		s.logger.Warn("dropped dead-lettered blocks reverted by undo signal",
+			zap.Int("dropped", len(letters)-len(kept)),
+			zap.Stringer("last_valid_block", lastValidBlock),
+		)
+	}
+
+	s.deadLetterHighestBlock = &highest
+	return nil
+}
+
+// RedriveDeadLetters calls `handler` for each block of `store`, in order, removing the blocks
+// successfully handled from the store. It stops at the first block the handler fails to process,
+// which is kept in the store with its new error, alongside the blocks not yet re-driven.
+//
+// The handler receives each block with the cursor it had when it was dead-lettered. The store
+// must not be used by a running [Sinker] at the same time.
+func RedriveDeadLetters(ctx context.Context, store DeadLetterStore, handler SinkerHandler) (redriven int, err error) {
+	letters, err := store.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("list dead letters: %w", err)
+	}
+
+	for i, letter := range letters {
+		if handlerErr := handler.HandleBlockScopedData(ctx, letter.Data, nil, letter.Cursor); handlerErr != nil {
+			letter.Err = handlerErr.Error()
+			letter.Attempts++
+			letter.FailedAt = time.Now()
+
+			if err := store.Replace(ctx, letters[i:]); err != nil {
+				return i, fmt.Errorf("replace dead letters: %w", err)
+			}
+
+			return i, fmt.Errorf("redrive block %s: %w", letter.Block(), handlerErr)
+		}
+	}
+
+	if err := store.Replace(ctx, nil); err != nil {
+		return len(letters), fmt.Errorf("clear dead letters: %w", err)
+	}
+
+	return len(letters), nil
+}
+
+var _ DeadLetterStore = (*FileDeadLetterStore)(nil)
+
+// FileDeadLetterStore is a [DeadLetterStore] that persists the letters as JSON lines in a single
+// file on disk, the block data being serialized in protobuf. Each append is fsync'ed and
+// [FileDeadLetterStore.Replace] is atomic.
+type FileDeadLetterStore struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewFileDeadLetterStore(path string) *FileDeadLetterStore {
+	return &FileDeadLetterStore{path: path}
+}
+
+type fileDeadLetter struct {
+	BlockNum uint64    `json:"block_num"`
+	BlockID  string    `json:"block_id"`
+	Cursor   string    `json:"cursor"`
+	Err      string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+	Data     []byte    `json:"data"`
+}
+
+func (s *FileDeadLetterStore) Append(ctx context.Context, letter *DeadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	line, err := marshalDeadLetter(letter)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open dead letter file %q: %w", s.path, err)
+	}
+
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return fmt.Errorf("write dead letter file %q: %w", s.path, err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync dead letter file %q: %w", s.path, err)
+	}
+
+	return file.Close()
+}
+
+func (s *FileDeadLetterStore) List(ctx context.Context) ([]*DeadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("open dead letter file %q: %w", s.path, err)
+	}
+	defer file.Close()
+
+	var letters []*DeadLetter
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		letter, err := unmarshalDeadLetter(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("dead letter file %q line %d: %w", s.path, line, err)
+		}
+
+		letters = append(letters, letter)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read dead letter file %q: %w", s.path, err)
+	}
+
+	return letters, nil
+}
+
+func (s *FileDeadLetterStore) Replace(ctx context.Context, letters []*DeadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var content []byte
+	for _, letter := range letters {
+		line, err := marshalDeadLetter(letter)
+		if err != nil {
+			return err
+		}
+
+		content = append(content, line...)
+	}
+
+	if err := writeFileAtomically(s.path, content, 0644); err != nil {
+		return fmt.Errorf("write dead letter file %q: %w", s.path, err)
+	}
+
+	return nil
+}
+
+func (s *FileDeadLetterStore) String() string {
+	return fmt.Sprintf("File (%s)", s.path)
+}
+
+var _ DeadLetterStore = (*InMemoryDeadLetterStore)(nil)
+
+// InMemoryDeadLetterStore is a [DeadLetterStore] that keeps the letters in memory only, it's
+// mostly useful for testing.
+type InMemoryDeadLetterStore struct {
+	lock    sync.RWMutex
+	letters []*DeadLetter
+}
+
+func NewInMemoryDeadLetterStore() *InMemoryDeadLetterStore {
+	return &InMemoryDeadLetterStore{}
+}
+
+func (s *InMemoryDeadLetterStore) Append(ctx context.Context, letter *DeadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	copied := *letter
+	s.letters = append(s.letters, &copied)
+	return nil
+}
+
+func (s *InMemoryDeadLetterStore) List(ctx context.Context) ([]*DeadLetter, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	letters := make([]*DeadLetter, len(s.letters))
+	for i, letter := range s.letters {
+		copied := *letter
+		letters[i] = &copied
+	}
+
+	return letters, nil
+}
+
+func (s *InMemoryDeadLetterStore) Replace(ctx context.Context, letters []*DeadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.letters = make([]*DeadLetter, len(letters))
+	for i, letter := range letters {
+		copied := *letter
+		s.letters[i] = &copied
+	}
+
+	return nil
+}
+
+func (s *InMemoryDeadLetterStore) String() string {
+	return "In-Memory"
+}
+
+func marshalDeadLetter(letter *DeadLetter) ([]byte, error) {
+	data, err := proto.Marshal(letter.Data)
+	if err != nil {
+		return nil, fmt.Errorf("marshal block %s: %w", letter.Block(), err)
+	}
+
+	line, err := json.Marshal(fileDeadLetter{
+		BlockNum: letter.Data.Clock.Number,
+		BlockID:  letter.Data.Clock.Id,
+		Cursor:   letter.Cursor.String(),
+		Err:      letter.Err,
+		Attempts: letter.Attempts,
+		FailedAt: letter.FailedAt,
+		Data:     data,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal dead letter of block %s: %w", letter.Block(), err)
+	}
+
+	return append(line, '\n'), nil
+}
+
+func unmarshalDeadLetter(line []byte) (*DeadLetter, error) {
+	onDisk := fileDeadLetter{}
+	if err := json.Unmarshal(line, &onDisk); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	data := &pbsubstreamsrpc.BlockScopedData{}
+	if err := proto.Unmarshal(onDisk.Data, data); err != nil {
+		return nil, fmt.Errorf("unmarshal block #%d (%s): %w", onDisk.BlockNum, onDisk.BlockID, err)
+	}
+
+	cursor, err := NewCursor(onDisk.Cursor)
+	if err != nil {
+		return nil, fmt.Errorf("block #%d (%s): %w", onDisk.BlockNum, onDisk.BlockID, err)
+	}
+
+	return &DeadLetter{
+		Data:     data,
+		Cursor:   cursor,
+		Err:      onDisk.Err,
+		Attempts: onDisk.Attempts,
+		FailedAt: onDisk.FailedAt,
+	}, nil
+}
@@ -0,0 +1,196 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDeadLetterStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileDeadLetterStore(filepath.Join(t.TempDir(), "dead_letters.jsonl"))
+
+	letters, err := store.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+
+	failedAt := time.Unix(1700000000, 0).UTC()
+	for _, id := range []string{"1a", "2a", "3a"} {
+		require.NoError(t, store.Append(ctx, &DeadLetter{Data: blockScopedData(id, 0), Cursor: testCursor(id), Err: "failed " + id, Attempts: 2, FailedAt: failedAt}))
+	}
+
+	letters, err = store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, letters, 3)
+	assert.Equal(t, "#2 (a)", letters[1].Block().String())
+	assert.Equal(t, testCursor("2a").String(), letters[1].Cursor.String())
+	assert.Equal(t, "failed 2a", letters[1].Err)
+	assert.Equal(t, 2, letters[1].Attempts)
+	assert.True(t, failedAt.Equal(letters[1].FailedAt))
+
+	require.NoError(t, store.Replace(ctx, letters[2:]))
+	letters, err = store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	assert.Equal(t, "#3 (a)", letters[0].Block().String())
+
+	require.NoError(t, store.Replace(ctx, nil))
+	letters, err = store.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+}
+
+func TestSinker_DeadLetter(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         int
+		shouldDeadLetter func(err error) bool
+		expectedAttempts int
+		expectedLetters  int
+		expectedErr      string
+	}{
+		{"succeeds first time", 0, nil, 1, 0, ""},
+		{"succeeds after failures", 2, nil, 3, 0, ""},
+		{"attempts exhausted", 5, nil, 3, 1, ""},
+		{"not dead-lettered", 5, func(err error) bool { return false }, 1, 0, "invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewInMemoryDeadLetterStore()
+			s := &Sinker{logger: zlog}
+			WithDeadLetter(store, DeadLetterPolicy{MaxAttempts: 3, ShouldDeadLetter: tt.shouldDeadLetter})(s)
+
+			attempts := 0
+			handler := NewSinkerHandlers(
+				func(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+					attempts++
+					if attempts <= tt.failures {
+						return errors.New("invalid")
+					}
+
+					return nil
+				},
+				func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+					return nil
+				},
+			)
+
+			deadLettered, err := s.handleBlockScopedData(context.Background(), handler, blockScopedData("1a", 0), nil, testCursor("1a"))
+			assert.Equal(t, tt.expectedAttempts, attempts)
+			assert.Equal(t, tt.expectedLetters > 0, deadLettered)
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expectedErr)
+			}
+
+			letters, err := store.List(context.Background())
+			require.NoError(t, err)
+			require.Len(t, letters, tt.expectedLetters)
+			if tt.expectedLetters > 0 {
+				assert.Equal(t, "#1 (a)", letters[0].Block().String())
+				assert.Equal(t, "invalid", letters[0].Err)
+				assert.Equal(t, 3, letters[0].Attempts)
+			}
+		})
+	}
+}
+
+func TestSinker_DeadLetterUndo(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryDeadLetterStore()
+	s := &Sinker{logger: zlog, emittedBlocks: newBlockHistory(false)}
+	WithDeadLetter(store, DeadLetterPolicy{})(s)
+
+	recorder := &orphanedBlocksRecorder{SinkerHandler: NewSinkerHandlers(
+		func(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+			if data.Clock.Number == 2 {
+				return errors.New("invalid")
+			}
+
+			return nil
+		},
+		func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+			return nil
+		},
+	)}
+
+	blocks := []*pbsubstreamsrpc.BlockScopedData{cursoredBlockScopedData("1a"), cursoredBlockScopedData("2a"), cursoredBlockScopedData("3a")}
+	require.NoError(t, s.emitBlocks(ctx, recorder, blocks, blockToRef(blocks[2])))
+
+	letters, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	assert.Equal(t, 2, s.emittedBlocks.Len(), "dead-lettered block should not be recorded as handled")
+
+	// Nothing is dropped when the dead-lettered block is still valid
+	require.NoError(t, s.dropRevertedDeadLetters(ctx, asBlockRef(msgBlockUndoSignal("2a").blockUndoSignal.LastValidBlock)))
+	letters, err = store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+
+	undoSignal := msgBlockUndoSignal("1a").blockUndoSignal
+	require.NoError(t, s.dropRevertedDeadLetters(ctx, asBlockRef(undoSignal.LastValidBlock)))
+	require.NoError(t, s.handleBlockUndoSignal(ctx, recorder, undoSignal, testCursor("1a")))
+
+	letters, err = store.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, letters, "dead-lettered block reverted by the undo signal should be dropped")
+
+	require.Len(t, recorder.orphaned, 1)
+	require.Len(t, recorder.orphaned[0], 1)
+	assert.Equal(t, "#3 (a)", recorder.orphaned[0][0].Ref().String())
+}
+
+func TestRedriveDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryDeadLetterStore()
+	for _, id := range []string{"1a", "2a", "3a"} {
+		require.NoError(t, store.Append(ctx, &DeadLetter{Data: blockScopedData(id, 0), Cursor: testCursor(id), Err: "invalid", Attempts: 1}))
+	}
+
+	var handled []string
+	failAt := uint64(2)
+	handler := NewSinkerHandlers(
+		func(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+			if data.Clock.Number == failAt {
+				return errors.New("still invalid")
+			}
+
+			handled = append(handled, blockToRef(data).String())
+			return nil
+		},
+		func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+			return nil
+		},
+	)
+
+	redriven, err := RedriveDeadLetters(ctx, store, handler)
+	require.EqualError(t, err, "redrive block #2 (a): still invalid")
+	assert.Equal(t, 1, redriven)
+	assert.Equal(t, []string{"#1 (a)"}, handled)
+
+	letters, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, letters, 2)
+	assert.Equal(t, "#2 (a)", letters[0].Block().String())
+	assert.Equal(t, "still invalid", letters[0].Err)
+	assert.Equal(t, 2, letters[0].Attempts)
+
+	failAt = 0
+	redriven, err = RedriveDeadLetters(ctx, store, handler)
+	require.NoError(t, err)
+	assert.Equal(t, 2, redriven)
+	assert.Equal(t, []string{"#1 (a)", "#2 (a)", "#3 (a)"}, handled)
+
+	letters, err = store.List(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+}
@@ -0,0 +1,249 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streamingfast/substreams/client"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultEndpointFailoverThreshold = 3
+	defaultPrimaryEndpointRecheck    = 10 * time.Minute
+
+	// maxPrimaryEndpointRecheckFactor caps the primary recheck back off to this many times the
+	// configured primary recheck period.
+	maxPrimaryEndpointRecheckFactor = 16
+)
+
+// errReturnToPrimaryEndpoint is returned by [Sinker.doRequest] when the stream has been ended
+// voluntarily, at a message boundary, to reconnect to the primary endpoint. It's not an error
+// condition and it's never surfaced to the user.
+var errReturnToPrimaryEndpoint = errors.New("returning to primary endpoint")
+
+// endpointClient is a connected Substreams client for one of the configured endpoints.
+type endpointClient struct {
+	client    pbsubstreamsrpc.StreamClient
+	closeFunc func() error
+	callOpts  []grpc.CallOption
+	headers   []string
+}
+
+// endpointPool holds the ordered list of endpoints the [Sinker] can stream from. The first
+// endpoint is the primary one, the pool rotates to the next endpoint after `failoverThreshold`
+// consecutive failures and returns to the primary once the current endpoint has been in use for
+// `primaryRecheck`.
+//
+// A return to the primary is only confirmed once a message is received from it. If the pool
+// fails over again before that, the primary is considered still unhealthy and the delay before
+// the next return is doubled, up to [maxPrimaryEndpointRecheckFactor] times `primaryRecheck`,
+// so that a down primary is not retried at a fixed pace. The delay is reset once the primary
+// delivers a message again.
+//
+// Clients are created lazily the first time an endpoint is used and kept until the pool is
+// closed. Apart from [endpointPool.Close], the pool is not safe for concurrent use.
+type endpointPool struct {
+	configs           []*client.SubstreamsClientConfig
+	extraHeaders      []string
+	failoverThreshold int
+	primaryRecheck    time.Duration
+	logger            *zap.Logger
+	nowFunc           func() time.Time
+
+	clientsLock         sync.Mutex
+	clients             map[int]*endpointClient
+	active              int
+	activeSince         time.Time
+	consecutiveFailures int
+	recheckDelay        time.Duration
+	returnedToPrimary   bool
+}
+
+func newEndpointPool(configs []*client.SubstreamsClientConfig, extraHeaders []string, failoverThreshold int, primaryRecheck time.Duration, logger *zap.Logger) *endpointPool {
+	if failoverThreshold <= 0 {
+		failoverThreshold = defaultEndpointFailoverThreshold
+	}
+
+	if primaryRecheck <= 0 {
+		primaryRecheck = defaultPrimaryEndpointRecheck
+	}
+
+	p := &endpointPool{
+		configs:           configs,
+		extraHeaders:      extraHeaders,
+		failoverThreshold: failoverThreshold,
+		primaryRecheck:    primaryRecheck,
+		recheckDelay:      primaryRecheck,
+		logger:            logger,
+		nowFunc:           time.Now,
+		clients:           make(map[int]*endpointClient),
+	}
+
+	p.activate(0)
+	return p
+}
+
+// Active returns the client of the active endpoint, creating it if it's the first time
+// the endpoint is used.
+func (p *endpointPool) Active() (*endpointClient, error) {
+	p.clientsLock.Lock()
+	defer p.clientsLock.Unlock()
+
+	if c, found := p.clients[p.active]; found {
+		return c, nil
+	}
+
+	config := p.ActiveConfig()
+	ssClient, closeFunc, callOpts, headers, err := client.NewSubstreamsClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %s: %w", config.Endpoint(), err)
+	}
+
+	c := &endpointClient{
+		client:    ssClient,
+		closeFunc: closeFunc,
+		callOpts:  callOpts,
+		headers:   mergeHeaders(headers, p.extraHeaders),
+	}
+
+	p.clients[p.active] = c
+	return c, nil
+}
+
+// setClient makes the endpoint at `index` use `streamClient` instead of creating a client
+// from its configuration.
+func (p *endpointPool) setClient(index int, streamClient pbsubstreamsrpc.StreamClient) {
+	p.clientsLock.Lock()
+	defer p.clientsLock.Unlock()
+
+	p.clients[index] = &endpointClient{
+		client:    streamClient,
+		closeFunc: func() error { return nil },
+	}
+}
+
+// ActiveConfig returns the configuration of the active endpoint.
+func (p *endpointPool) ActiveConfig() *client.SubstreamsClientConfig {
+	return p.configs[p.active]
+}
+
+// RecordSuccess resets the consecutive failures count, it must be called once at least
+// one message was received from the active endpoint. It also confirms a return to the
+// primary endpoint, resetting the primary recheck back off.
+func (p *endpointPool) RecordSuccess() {
+	p.consecutiveFailures = 0
+
+	if p.active == 0 && p.returnedToPrimary {
+		p.returnedToPrimary = false
+		p.recheckDelay = p.primaryRecheck
+	}
+}
+
+// RecordFailure records a failure of the active endpoint and rotates to the next endpoint
+// once the failover threshold is reached. It returns true if the active endpoint changed.
+func (p *endpointPool) RecordFailure() bool {
+	p.consecutiveFailures++
+	if len(p.configs) <= 1 || p.consecutiveFailures < p.failoverThreshold {
+		return false
+	}
+
+	previous := p.ActiveConfig()
+	if p.active == 0 && p.returnedToPrimary {
+		// The primary failed again before delivering anything since we returned to it
+		p.returnedToPrimary = false
+		p.recheckDelay = min(2*p.recheckDelay, maxPrimaryEndpointRecheckFactor*p.primaryRecheck)
+	}
+
+	p.activate((p.active + 1) % len(p.configs))
+
+	p.logger.Warn("too many consecutive failures on endpoint, failing over to next endpoint",
+		zap.Stringer("from", (*substramsClientStringer)(previous)),
+		zap.Stringer("to", (*substramsClientStringer)(p.ActiveConfig())),
+		zap.Int("failover_threshold", p.failoverThreshold),
+	)
+	EndpointFailoverCount.Inc()
+
+	return true
+}
+
+// ShouldReturnToPrimary returns true when a secondary endpoint is active and has been
+// for longer than the primary recheck period, backed off after each failed return.
+func (p *endpointPool) ShouldReturnToPrimary() bool {
+	return p.active != 0 && p.nowFunc().Sub(p.activeSince) >= p.recheckDelay
+}
+
+// ReturnToPrimary makes the primary endpoint the active one again.
+func (p *endpointPool) ReturnToPrimary() {
+	p.logger.Info("returning to primary endpoint",
+		zap.Stringer("from", (*substramsClientStringer)(p.ActiveConfig())),
+		zap.Stringer("to", (*substramsClientStringer)(p.configs[0])),
+		zap.Duration("used_for", p.nowFunc().Sub(p.activeSince)),
+		zap.Duration("recheck_delay", p.recheckDelay),
+	)
+
+	p.activate(0)
+	p.returnedToPrimary = true
+}
+
+// Close closes every client created by the pool.
+func (p *endpointPool) Close() {
+	p.clientsLock.Lock()
+	defer p.clientsLock.Unlock()
+
+	for i, c := range p.clients {
+		if err := c.closeFunc(); err != nil {
+			p.logger.Debug("failed to close endpoint client", zap.String("endpoint", p.configs[i].Endpoint()), zap.Error(err))
+		}
+	}
+
+	p.clients = make(map[int]*endpointClient)
+}
+
+func (p *endpointPool) activate(index int) {
+	p.active = index
+	p.activeSince = p.nowFunc()
+	p.consecutiveFailures = 0
+
+	for i, config := range p.configs {
+		value := uint64(0)
+		if i == index {
+			value = 1
+		}
+
+		ActiveEndpoint.SetUint64(value, endpointLabel(i, config))
+	}
+}
+
+func endpointLabel(index int, config *client.SubstreamsClientConfig) string {
+	return strconv.Itoa(index) + ":" + config.Endpoint()
+}
+
+// mergeHeaders merges the client's headers with the user's extra headers, the latter
+// taking precedence, and flattens them into a key/value list.
+func mergeHeaders(headers client.Headers, extraHeaders []string) []string {
+	if len(extraHeaders) == 0 && len(headers) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]string, len(headers)+len(extraHeaders))
+	for k, v := range headers {
+		merged[k] = v
+	}
+
+	for k, v := range parseHeaders(extraHeaders) {
+		merged[k] = v
+	}
+
+	out := make([]string, 0, len(merged)*2)
+	for k, v := range merged {
+		out = append(out, k, v)
+	}
+
+	return out
+}
@@ -0,0 +1,161 @@
+package sink
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/substreams/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointPool_Failover(t *testing.T) {
+	now := time.Unix(0, 0)
+	pool := newTestEndpointPool(&now, 2, time.Minute, "primary:443", "secondary:443", "tertiary:443")
+
+	assert.Equal(t, "primary:443", pool.ActiveConfig().Endpoint())
+	assert.False(t, pool.RecordFailure())
+
+	// A received message resets the consecutive failures count
+	pool.RecordSuccess()
+	assert.False(t, pool.RecordFailure())
+	assert.True(t, pool.RecordFailure())
+	assert.Equal(t, "secondary:443", pool.ActiveConfig().Endpoint())
+
+	assert.False(t, pool.RecordFailure())
+	assert.True(t, pool.RecordFailure())
+	assert.Equal(t, "tertiary:443", pool.ActiveConfig().Endpoint())
+
+	assert.False(t, pool.RecordFailure())
+	assert.True(t, pool.RecordFailure())
+	assert.Equal(t, "primary:443", pool.ActiveConfig().Endpoint(), "rotation should wrap around")
+}
+
+func TestEndpointPool_ReturnToPrimary(t *testing.T) {
+	now := time.Unix(0, 0)
+	pool := newTestEndpointPool(&now, 1, time.Minute, "primary:443", "secondary:443")
+
+	now = now.Add(2 * time.Minute)
+	assert.False(t, pool.ShouldReturnToPrimary(), "primary endpoint is never left voluntarily")
+
+	require.True(t, pool.RecordFailure())
+	assert.False(t, pool.ShouldReturnToPrimary())
+
+	now = now.Add(59 * time.Second)
+	assert.False(t, pool.ShouldReturnToPrimary())
+
+	now = now.Add(time.Second)
+	assert.True(t, pool.ShouldReturnToPrimary())
+
+	pool.ReturnToPrimary()
+	assert.Equal(t, "primary:443", pool.ActiveConfig().Endpoint())
+	assert.False(t, pool.ShouldReturnToPrimary())
+}
+
+func TestEndpointPool_ReturnToPrimaryBackOff(t *testing.T) {
+	now := time.Unix(0, 0)
+	pool := newTestEndpointPool(&now, 1, time.Minute, "primary:443", "secondary:443")
+
+	// failAndReturn fails over to the secondary endpoint and returns to the primary once allowed,
+	// reporting after how long the return happened
+	failAndReturn := func() time.Duration {
+		t.Helper()
+
+		require.True(t, pool.RecordFailure())
+		require.Equal(t, "secondary:443", pool.ActiveConfig().Endpoint())
+
+		waited := time.Duration(0)
+		for !pool.ShouldReturnToPrimary() {
+			now = now.Add(time.Minute)
+			waited += time.Minute
+		}
+
+		pool.ReturnToPrimary()
+		return waited
+	}
+
+	assert.Equal(t, time.Minute, failAndReturn())
+
+	// The primary keeps failing right after each return, the delay is doubled up to the cap
+	assert.Equal(t, 2*time.Minute, failAndReturn())
+	assert.Equal(t, 4*time.Minute, failAndReturn())
+	assert.Equal(t, 8*time.Minute, failAndReturn())
+	assert.Equal(t, 16*time.Minute, failAndReturn())
+	assert.Equal(t, 16*time.Minute, failAndReturn())
+
+	// A message received from the primary confirms it's healthy again
+	pool.RecordSuccess()
+	assert.Equal(t, time.Minute, failAndReturn())
+
+	// A success on a secondary endpoint doesn't reset the back off
+	require.True(t, pool.RecordFailure())
+	pool.RecordSuccess()
+	now = now.Add(time.Minute)
+	assert.False(t, pool.ShouldReturnToPrimary())
+	now = now.Add(time.Minute)
+	assert.True(t, pool.ShouldReturnToPrimary())
+}
+
+func TestEndpointPool_SingleEndpoint(t *testing.T) {
+	now := time.Unix(0, 0)
+	pool := newTestEndpointPool(&now, 1, time.Minute, "primary:443")
+
+	assert.False(t, pool.RecordFailure())
+	assert.False(t, pool.RecordFailure())
+	assert.Equal(t, "primary:443", pool.ActiveConfig().Endpoint())
+}
+
+func TestMergeHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		headers      client.Headers
+		extraHeaders []string
+		expected     []string
+	}{
+		{"none", nil, nil, nil},
+		{"client headers only", client.Headers{"a": "1"}, nil, []string{"a", "1"}},
+		{"extra headers only", nil, []string{"b: 2"}, []string{"b", "2"}},
+		{"extra headers override", client.Headers{"a": "1", "b": "1"}, []string{"b: 2"}, []string{"a", "1", "b", "2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, sortedHeaderPairs(mergeHeaders(tt.headers, tt.extraHeaders)))
+		})
+	}
+}
+
+func newTestEndpointPool(now *time.Time, failoverThreshold int, primaryRecheck time.Duration, endpoints ...string) *endpointPool {
+	configs := make([]*client.SubstreamsClientConfig, len(endpoints))
+	for i, endpoint := range endpoints {
+		configs[i] = client.NewSubstreamsClientConfig(endpoint, "", client.None, false, true)
+	}
+
+	pool := newEndpointPool(configs, nil, failoverThreshold, primaryRecheck, zlog)
+	pool.nowFunc = func() time.Time { return *now }
+	pool.activate(0)
+
+	return pool
+}
+
+// sortedHeaderPairs sorts a flattened key/value list by key so it can be compared
+func sortedHeaderPairs(in []string) []string {
+	if in == nil {
+		return nil
+	}
+
+	pairs := make([][2]string, 0, len(in)/2)
+	for i := 0; i+1 < len(in); i += 2 {
+		pairs = append(pairs, [2]string{in[i], in[i+1]})
+	}
+
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	out := make([]string, 0, len(in))
+	for _, pair := range pairs {
+		out = append(out, pair[0], pair[1])
+	}
+
+	return out
+}
@@ -2,6 +2,59 @@ package sink
 
 import (
 	"errors"
+	"fmt"
+
+	"github.com/streamingfast/bstream"
 )
 
 var ErrBackOffExpired = errors.New("unable to complete work within backoff time limit")
+
+var ErrCursorMismatch = errors.New("cursor was produced by a different module")
+
+var ErrStreamStalled = errors.New("stream stalled")
+
+// DecodeError is returned by the handler created through [NewTypedSinkerHandlers] when
+// the module's output of a block cannot be decoded into the handler's type.
+type DecodeError struct {
+	Block   bstream.BlockRef
+	TypeURL string
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode module output of type %q at block %s: %s", e.TypeURL, e.Block, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// HandlerRetryExhaustedError is returned when a handler call kept returning a retryable error
+// until the attempts configured through [WithHandlerRetry] were exhausted. `Err` is the last
+// error returned through the middleware chain, it's not retryable anymore: the [Sinker]
+// terminates instead of reconnecting the stream even though `Err` wraps a [derr.RetryableError].
+type HandlerRetryExhaustedError struct {
+	Method   string
+	Block    bstream.BlockRef
+	Attempts int
+	Err      error
+}
+
+func (e *HandlerRetryExhaustedError) Error() string {
+	return fmt.Sprintf("%s at block %s failed after %d attempts: %s", e.Method, e.Block, e.Attempts, e.Err)
+}
+
+func (e *HandlerRetryExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+// UndoOverflowError is returned when an undo signal reverts blocks that the undo buffer
+// already emitted to the handler, meaning the reorganization is deeper than the buffer.
+type UndoOverflowError struct {
+	LastValidBlock   bstream.BlockRef
+	LastEmittedBlock bstream.BlockRef
+}
+
+func (e *UndoOverflowError) Error() string {
+	return fmt.Sprintf("cannot undo down to last valid Block %s because we already sent you Block %s which is after last valid block", e.LastValidBlock, e.LastEmittedBlock)
+}
@@ -11,6 +11,7 @@ import (
 	pbchanges "github.com/streamingfast/substreams-sink-database-changes/pb/sf/substreams/sink/database/v1"
 	"github.com/streamingfast/substreams/client"
 	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
 )
 
 var expectedOutputModuleType = string(new(pbchanges.DatabaseChanges).ProtoReflect().Descriptor().FullName())
@@ -66,6 +67,9 @@ func main() {
 		zlog,
 		tracer,
 		sink.WithBlockRange(blockRange),
+		// The cursor is loaded from this file on start up and saved in it each time a block
+		// was successfully handled, on re-start, the sinker resumes where it left off.
+		sink.WithCursorStore(sink.NewFileCursorStore("cursor.txt")),
 	)
 	cli.NoError(err, "unable to create sinker: %s", err)
 
@@ -75,29 +79,22 @@ func main() {
 		zlog.Info("sink is terminating")
 	})
 
-	// You **must** save the cursor somewhere, saving it to memory while
-	// make it last until the process is killed, in which on re-start, the
-	// sinker will resume from start block again. You can simply read from
-	// a file the string value of the cursor and use `sink.NewCursor(value)`
-	// to load it.
-
-	sinker.Run(context.Background(), sink.NewBlankCursor(), sink.NewSinkerHandlers(handleBlockScopedData, handleBlockUndoSignal))
+	// The cursor store configured above takes care of loading the cursor, if you manage
+	// the cursor yourself, pass it here, you can use `sink.NewCursor(value)` to load it.
+	//
+	// The typed handlers decode the module's output for you, use `sink.NewSinkerHandlers` instead if
+	// you prefer to receive the raw `*pbsubstreamsrpc.BlockScopedData` message.
+	sinker.Run(context.Background(), sink.NewBlankCursor(), sink.NewTypedSinkerHandlers(sinker, handleDatabaseChanges, handleBlockUndoSignal))
 }
 
-func handleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *sink.Cursor) error {
+func handleDatabaseChanges(ctx context.Context, clock *pbsubstreams.Clock, changes *pbchanges.DatabaseChanges, isLive *bool, cursor *sink.Cursor) error {
 	_ = ctx
 
-	changes := &pbchanges.DatabaseChanges{}
-	if err := data.Output.MapOutput.UnmarshalTo(changes); err != nil {
-		return fmt.Errorf("unable to unmarshal database changes: %w", err)
-	}
-
-	fmt.Printf("Block #%d (%s) data received with %d changes\n", data.Clock.Number, data.Clock.Id, len(changes.TableChanges))
+	fmt.Printf("Block #%d (%s) data received with %d changes\n", clock.Number, clock.Id, len(changes.TableChanges))
 
-	// Once you have processed the block, you **must** persist the cursor, persistence
-	// can take differnet form. For example, you can save it to a file, or to a database.
-	// You can simply use `os.WriteFile("cursor.txt", []byte(cursor.String()), 0644)` to
-	// save it to a file.
+	// The cursor is persisted for you by the configured cursor store once this handler
+	// returns without error. If you store your data in a database, you can instead save
+	// the cursor in the same transaction as your data.
 	_ = cursor
 
 	// The isLive boolean is set to true when the sinker is running in the live portion
@@ -112,10 +109,9 @@ func handleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.Bloc
 	_ = ctx
 
 	// The chain forked for one or more blocks, you **must** rewind your changes back to the
-	// last valid block, which is provided in the undo signal. You **must** also persist the
-	// last valid cursor also provided in the undo signal. You can simply use
-	// `os.WriteFile("cursor.txt", []byte(cursor.String()), 0644)` to
-	// save it to a file.
+	// last valid block, which is provided in the undo signal. The last valid cursor also
+	// provided in the undo signal is persisted by the configured cursor store once this
+	// handler returns without error.
 	_ = cursor
 
 	fmt.Printf("Rewinding changes back to block %s\n", undoSignal.LastValidBlock)
@@ -0,0 +1,113 @@
+package sink
+
+import (
+	"time"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+)
+
+// Session describes the Substreams session established with the server, it's received
+// once per connection, see [SinkerSessionHandler].
+type Session struct {
+	// TraceID is the server's trace identifier of the request, useful when reporting issues
+	// to your Substreams provider.
+	TraceID string
+
+	// ResolvedStartBlock is the block from which data is streamed, it's resolved by the server
+	// from the requested start block or cursor.
+	ResolvedStartBlock uint64
+
+	// LinearHandoffBlock is the block from which the server stops processing in parallel and
+	// processes blocks linearly.
+	LinearHandoffBlock uint64
+
+	// MaxParallelWorkers is the maximum number of parallel workers allowed for the session.
+	MaxParallelWorkers uint64
+}
+
+func newSession(session *pbsubstreamsrpc.SessionInit) *Session {
+	return &Session{
+		TraceID:            session.TraceId,
+		ResolvedStartBlock: session.ResolvedStartBlock,
+		LinearHandoffBlock: session.LinearHandoffBlock,
+		MaxParallelWorkers: session.MaxParallelWorkers,
+	}
+}
+
+// Progress describes the server's parallel processing progress, see [SinkerProgressHandler].
+// Each message is a full overview of the current progress, not a delta since the previous one.
+type Progress struct {
+	Stages      []*StageProgress
+	RunningJobs []*JobProgress
+
+	// TotalProcessedBlocks is the total number of blocks processed by all stages and
+	// jobs, including blocks that were already cached by the server.
+	TotalProcessedBlocks uint64
+}
+
+// StageProgress describes the progress of a stage, a group of modules processed together.
+type StageProgress struct {
+	Modules         []string
+	CompletedRanges []*BlockRangeProgress
+}
+
+// BlockRangeProgress is a range of blocks completed by a stage, `EndBlock` is exclusive.
+type BlockRangeProgress struct {
+	StartBlock uint64
+	EndBlock   uint64
+}
+
+// JobProgress describes a job currently running on the server.
+type JobProgress struct {
+	Stage           uint32
+	StartBlock      uint64
+	StopBlock       uint64
+	ProcessedBlocks uint64
+}
+
+func newProgress(progress *pbsubstreamsrpc.ModulesProgress, totalProcessedBlocks uint64) *Progress {
+	out := &Progress{
+		Stages:               make([]*StageProgress, len(progress.Stages)),
+		RunningJobs:          make([]*JobProgress, len(progress.RunningJobs)),
+		TotalProcessedBlocks: totalProcessedBlocks,
+	}
+
+	for i, stage := range progress.Stages {
+		ranges := make([]*BlockRangeProgress, len(stage.CompletedRanges))
+		for j, r := range stage.CompletedRanges {
+			ranges[j] = &BlockRangeProgress{StartBlock: r.StartBlock, EndBlock: r.EndBlock}
+		}
+
+		out.Stages[i] = &StageProgress{Modules: stage.Modules, CompletedRanges: ranges}
+	}
+
+	for i, job := range progress.RunningJobs {
+		out.RunningJobs[i] = &JobProgress{
+			Stage:           job.Stage,
+			StartBlock:      job.StartBlock,
+			StopBlock:       job.StopBlock,
+			ProcessedBlocks: job.ProcessedBlocks,
+		}
+	}
+
+	return out
+}
+
+// ReconnectEvent describes a reconnection of the [Sinker] to the Substreams server following
+// a retryable error, see [SinkerReconnectHandler].
+type ReconnectEvent struct {
+	// Err is the retryable error that interrupted the stream.
+	Err error
+
+	// Attempt is the number of consecutive reconnections without any message received, starting at 1.
+	Attempt int
+
+	// Delay is how long the [Sinker] waits before reconnecting.
+	Delay time.Duration
+
+	// Cursor is the cursor the stream resumes from, blank if no message was processed yet.
+	Cursor *Cursor
+
+	// Endpoint is the Substreams endpoint the [Sinker] reconnects to.
+	Endpoint string
+}
@@ -0,0 +1,100 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProgress(t *testing.T) {
+	progress := newProgress(&pbsubstreamsrpc.ModulesProgress{
+		RunningJobs: []*pbsubstreamsrpc.Job{
+			{Stage: 1, StartBlock: 100, StopBlock: 200, ProcessedBlocks: 50},
+		},
+		Stages: []*pbsubstreamsrpc.Stage{
+			{Modules: []string{"store_a"}, CompletedRanges: []*pbsubstreamsrpc.BlockRange{{StartBlock: 0, EndBlock: 100}}},
+			{Modules: []string{"map_b"}},
+		},
+	}, 150)
+
+	assert.Equal(t, &Progress{
+		Stages: []*StageProgress{
+			{Modules: []string{"store_a"}, CompletedRanges: []*BlockRangeProgress{{StartBlock: 0, EndBlock: 100}}},
+			{Modules: []string{"map_b"}, CompletedRanges: []*BlockRangeProgress{}},
+		},
+		RunningJobs:          []*JobProgress{{Stage: 1, StartBlock: 100, StopBlock: 200, ProcessedBlocks: 50}},
+		TotalProcessedBlocks: 150,
+	}, progress)
+}
+
+type livenessRecorder struct {
+	SinkerHandler
+	changes []string
+}
+
+func (r *livenessRecorder) HandleLivenessChange(ctx context.Context, isLive bool, block bstream.BlockRef) error {
+	state := "historical"
+	if isLive {
+		state = "live"
+	}
+
+	r.changes = append(r.changes, state+"@"+block.String())
+	return nil
+}
+
+func TestSinker_HandleLivenessChange(t *testing.T) {
+	ctx := context.Background()
+	s := &Sinker{logger: zlog}
+	recorder := &livenessRecorder{}
+
+	for _, step := range []struct {
+		id     string
+		isLive bool
+	}{
+		{"1a", false},
+		{"2a", true},
+		{"3a", true},
+		{"4a", false},
+		{"5a", true},
+	} {
+		require.NoError(t, s.handleLivenessChange(ctx, recorder, step.isLive, blockScopedData(step.id, 0)))
+	}
+
+	assert.Equal(t, []string{"live@#2 (a)", "historical@#4 (a)", "live@#5 (a)"}, recorder.changes)
+}
+
+type finalityRecorder struct {
+	SinkerHandler
+	heights []string
+}
+
+func (r *finalityRecorder) HandleFinalBlockHeight(ctx context.Context, finalBlockHeight uint64, block bstream.BlockRef) error {
+	r.heights = append(r.heights, fmt.Sprintf("%d@%s", finalBlockHeight, block))
+	return nil
+}
+
+func TestSinker_HandleFinalBlockHeight(t *testing.T) {
+	ctx := context.Background()
+	s := &Sinker{logger: zlog}
+	recorder := &finalityRecorder{}
+
+	for _, step := range []struct {
+		id          string
+		finalHeight uint64
+	}{
+		{"1a", 0},
+		{"2a", 1},
+		{"3a", 1},
+		{"4a", 3},
+		{"5a", 3},
+	} {
+		require.NoError(t, s.handleFinalBlockHeight(ctx, recorder, blockScopedData(step.id, step.finalHeight)))
+	}
+
+	assert.Equal(t, []string{"1@#2 (a)", "3@#4 (a)"}, recorder.heights)
+}
@@ -0,0 +1,181 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	handlerMethodBlockScopedData = "HandleBlockScopedData"
+	handlerMethodBlockUndoSignal = "HandleBlockUndoSignal"
+)
+
+// HandlerCall describes a call made by the [Sinker] to its [SinkerHandler], see [HandlerMiddleware].
+type HandlerCall struct {
+	// Method is the name of the [SinkerHandler] method called, either "HandleBlockScopedData"
+	// or "HandleBlockUndoSignal".
+	Method string
+
+	// Block is the block handled, the last valid block for "HandleBlockUndoSignal".
+	Block bstream.BlockRef
+
+	// Data is the block handled by "HandleBlockScopedData", nil otherwise.
+	Data *pbsubstreamsrpc.BlockScopedData
+
+	// UndoSignal is the undo signal handled by "HandleBlockUndoSignal", nil otherwise.
+	UndoSignal *pbsubstreamsrpc.BlockUndoSignal
+
+	IsLive *bool
+	Cursor *Cursor
+}
+
+func newBlockScopedDataCall(data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) *HandlerCall {
+	return &HandlerCall{Method: handlerMethodBlockScopedData, Block: blockToRef(data), Data: data, IsLive: isLive, Cursor: cursor}
+}
+
+func newBlockUndoSignalCall(undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) *HandlerCall {
+	return &HandlerCall{Method: handlerMethodBlockUndoSignal, Block: asBlockRef(undoSignal.LastValidBlock), UndoSignal: undoSignal, Cursor: cursor}
+}
+
+// HandlerFunc performs the handler call, or the rest of the middleware chain, see [HandlerMiddleware].
+type HandlerFunc func(ctx context.Context) error
+
+// HandlerMiddleware wraps each [SinkerHandler] call made by the [Sinker], see [WithHandlerMiddleware].
+// The middleware must call `next` to continue the chain and ultimately call the handler, it can
+// change the context passed to it and the error returned.
+type HandlerMiddleware func(ctx context.Context, call *HandlerCall, next HandlerFunc) error
+
+// chainHandlerMiddlewares returns a [HandlerFunc] calling `middlewares` in order, the first one
+// being the outermost, and ultimately `handle`.
+func chainHandlerMiddlewares(middlewares []HandlerMiddleware, call *HandlerCall, handle HandlerFunc) HandlerFunc {
+	next := handle
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		middleware, inner := middlewares[i], next
+		next = func(ctx context.Context) error {
+			return middleware(ctx, call, inner)
+		}
+	}
+
+	return next
+}
+
+// callHandler performs `handle` through the configured [HandlerMiddleware] chain, retrying
+// the whole chain in place when a handler retry policy is configured (see [WithHandlerRetry]).
+func (s *Sinker) callHandler(ctx context.Context, call *HandlerCall, handle HandlerFunc) error {
+	if len(s.middlewares) > 0 {
+		handle = chainHandlerMiddlewares(s.middlewares, call, handle)
+	}
+
+	if s.handlerRetryAttempts > 1 {
+		return s.retryHandlerCall(ctx, call, handle)
+	}
+
+	return handle(ctx)
+}
+
+// middlewareHandler is a [SinkerHandler] calling `handler` through the [Sinker]'s middleware chain,
+// used where the handler is called outside of the [Sinker] like in [ParallelBackfill].
+type middlewareHandler struct {
+	sinker  *Sinker
+	handler SinkerHandler
+}
+
+func (h *middlewareHandler) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+	_, err := h.sinker.handleBlockScopedData(ctx, h.handler, data, isLive, cursor)
+	return err
+}
+
+func (h *middlewareHandler) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	return h.sinker.callHandler(ctx, newBlockUndoSignalCall(undoSignal, cursor), func(ctx context.Context) error {
+		return h.handler.HandleBlockUndoSignal(ctx, undoSignal, cursor)
+	})
+}
+
+// HandlerPanicError is returned by the [RecoverMiddleware] when the handler panics.
+type HandlerPanicError struct {
+	Method string
+	Block  bstream.BlockRef
+	Value  any
+	Stack  []byte
+}
+
+func (e *HandlerPanicError) Error() string {
+	return fmt.Sprintf("%s panicked at block %s: %v", e.Method, e.Block, e.Value)
+}
+
+// RecoverMiddleware recovers from a panic of the handler and turns it into a [HandlerPanicError]
+// naming the block, which terminates the [Sinker] like any non-retryable error.
+func RecoverMiddleware() HandlerMiddleware {
+	return func(ctx context.Context, call *HandlerCall, next HandlerFunc) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &HandlerPanicError{Method: call.Method, Block: call.Block, Value: r, Stack: debug.Stack()}
+			}
+		}()
+
+		return next(ctx)
+	}
+}
+
+// TimeoutMiddleware cancels the context passed to the handler once the call has been running
+// for `timeout`. The handler must honor its context for the call to be interrupted, the error
+// it returns then wraps [context.DeadlineExceeded].
+func TimeoutMiddleware(timeout time.Duration) HandlerMiddleware {
+	return func(ctx context.Context, call *HandlerCall, next HandlerFunc) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err := next(ctx)
+		if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return err
+		}
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+		}
+
+		return fmt.Errorf("%s at block %s timed out after %s: %w", call.Method, call.Block, timeout, err)
+	}
+}
+
+// LoggingMiddleware logs each call, at debug level, with its block and duration and failed
+// calls at warn level.
+func LoggingMiddleware(logger *zap.Logger) HandlerMiddleware {
+	return func(ctx context.Context, call *HandlerCall, next HandlerFunc) error {
+		start := time.Now()
+		err := next(ctx)
+
+		fields := []zap.Field{zap.String("method", call.Method), zap.Stringer("block", call.Block), zap.Duration("duration", time.Since(start))}
+		if err != nil {
+			logger.Warn("handler call failed", append(fields, zap.Error(err))...)
+		} else {
+			logger.Debug("handler call completed", fields...)
+		}
+
+		return err
+	}
+}
+
+// MetricsMiddleware records the duration of each call in the `substreams_sink_handler_call_duration`
+// metric and counts failed calls in the `substreams_sink_handler_call_error` metric, both labelled
+// by method.
+func MetricsMiddleware() HandlerMiddleware {
+	return func(ctx context.Context, call *HandlerCall, next HandlerFunc) error {
+		start := time.Now()
+		err := next(ctx)
+
+		HandlerCallDuration.ObserveSince(start, call.Method)
+		if err != nil {
+			HandlerCallErrorCount.Inc(call.Method)
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,72 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinker_CallHandler_MiddlewareOrder(t *testing.T) {
+	var calls []string
+	tracing := func(name string) HandlerMiddleware {
+		return func(ctx context.Context, call *HandlerCall, next HandlerFunc) error {
+			calls = append(calls, name+" before "+call.Method+" "+call.Block.String())
+			err := next(ctx)
+			calls = append(calls, name+" after")
+			return err
+		}
+	}
+
+	s := &Sinker{logger: zlog}
+	WithHandlerMiddleware(tracing("outer"))(s)
+	WithHandlerMiddleware(tracing("inner"))(s)
+
+	call := newBlockScopedDataCall(blockScopedData("1a", 0), nil, testCursor("1a"))
+	require.NoError(t, s.callHandler(context.Background(), call, func(ctx context.Context) error {
+		calls = append(calls, "handler")
+		return nil
+	}))
+
+	assert.Equal(t, []string{
+		"outer before HandleBlockScopedData #1 (a)",
+		"inner before HandleBlockScopedData #1 (a)",
+		"handler",
+		"inner after",
+		"outer after",
+	}, calls)
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	s := &Sinker{logger: zlog, middlewares: []HandlerMiddleware{RecoverMiddleware()}}
+
+	call := newBlockUndoSignalCall(msgBlockUndoSignal("2a").blockUndoSignal, testCursor("2a"))
+	err := s.callHandler(context.Background(), call, func(ctx context.Context) error {
+		panic("boom")
+	})
+
+	var panicErr *HandlerPanicError
+	require.ErrorAs(t, err, &panicErr)
+	assert.EqualError(t, err, "HandleBlockUndoSignal panicked at block #2 (a): boom")
+	assert.NotEmpty(t, panicErr.Stack)
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	s := &Sinker{logger: zlog, middlewares: []HandlerMiddleware{TimeoutMiddleware(10 * time.Millisecond)}}
+	call := newBlockScopedDataCall(blockScopedData("1a", 0), nil, testCursor("1a"))
+
+	err := s.callHandler(context.Background(), call, func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.New("interrupted")
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.EqualError(t, err, "HandleBlockScopedData at block #1 (a) timed out after 10ms: context deadline exceeded: interrupted")
+
+	err = s.callHandler(context.Background(), call, func(ctx context.Context) error {
+		return errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+}
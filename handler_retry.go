@@ -0,0 +1,53 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/streamingfast/derr"
+	"go.uber.org/zap"
+)
+
+// retryHandlerCall performs `handle` until it succeeds, returns a non-retryable error or the
+// configured number of attempts is reached, waiting between attempts according to the handler
+// retry back off. Once the attempts are exhausted, the last error is returned in a
+// [HandlerRetryExhaustedError] so that the [Sinker] does not reconnect the stream to retry again.
+func (s *Sinker) retryHandlerCall(ctx context.Context, call *HandlerCall, handle HandlerFunc) error {
+	s.handlerRetryBackOff.Reset()
+
+	for attempt := 1; ; attempt++ {
+		err := handle(ctx)
+
+		var retryableError *derr.RetryableError
+		if err == nil || !errors.As(err, &retryableError) {
+			return err
+		}
+
+		if attempt >= s.handlerRetryAttempts {
+			return &HandlerRetryExhaustedError{Method: call.Method, Block: call.Block, Attempts: attempt, Err: err}
+		}
+
+		sleepFor := s.handlerRetryBackOff.NextBackOff()
+		if sleepFor == backoff.Stop {
+			return &HandlerRetryExhaustedError{Method: call.Method, Block: call.Block, Attempts: attempt, Err: fmt.Errorf("%w: %w", ErrBackOffExpired, err)}
+		}
+
+		s.logger.Warn("handler returned a retryable error, retrying the call in place",
+			zap.String("method", call.Method),
+			zap.Stringer("block", call.Block),
+			zap.Int("attempt", attempt),
+			zap.Duration("sleep", sleepFor),
+			zap.Error(err),
+		)
+		HandlerRetryCount.Inc()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleepFor):
+		}
+	}
+}
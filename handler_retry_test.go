@@ -0,0 +1,79 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/streamingfast/derr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinker_HandlerRetry(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         int
+		err              error
+		expectedAttempts int
+		expectedErr      string
+	}{
+		{"succeeds first time", 0, nil, 1, ""},
+		{"succeeds after retries", 2, derr.NewRetryableError(errors.New("busy")), 3, ""},
+		{"attempts exhausted", 5, derr.NewRetryableError(errors.New("busy")), 3, "HandleBlockScopedData at block #1 (a) failed after 3 attempts: busy (retryable)"},
+		{"non-retryable error", 5, errors.New("invalid"), 1, "invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Sinker{logger: zlog}
+			WithHandlerRetry(3, &backoff.ZeroBackOff{})(s)
+
+			attempts := 0
+			call := newBlockScopedDataCall(blockScopedData("1a", 0), nil, testCursor("1a"))
+			err := s.callHandler(context.Background(), call, func(ctx context.Context) error {
+				attempts++
+				if attempts <= tt.failures {
+					return tt.err
+				}
+
+				return nil
+			})
+
+			assert.Equal(t, tt.expectedAttempts, attempts)
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestSinker_HandlerRetry_Exhausted(t *testing.T) {
+	busy := errors.New("busy")
+
+	s := &Sinker{logger: zlog}
+	WithHandlerRetry(2, &backoff.ZeroBackOff{})(s)
+	WithHandlerMiddleware(func(ctx context.Context, call *HandlerCall, next HandlerFunc) error {
+		if err := next(ctx); err != nil {
+			return fmt.Errorf("middleware at block %s: %w", call.Block, err)
+		}
+
+		return nil
+	})(s)
+
+	call := newBlockScopedDataCall(blockScopedData("1a", 0), nil, testCursor("1a"))
+	err := s.callHandler(context.Background(), call, func(ctx context.Context) error {
+		return derr.NewRetryableError(busy)
+	})
+
+	require.EqualError(t, err, "HandleBlockScopedData at block #1 (a) failed after 2 attempts: middleware at block #1 (a): busy (retryable)")
+	assert.ErrorIs(t, err, busy)
+
+	var exhausted *HandlerRetryExhaustedError
+	require.True(t, errors.As(err, &exhausted), "exhausted handler retries must not reconnect the stream")
+	assert.Equal(t, 2, exhausted.Attempts)
+}
@@ -0,0 +1,50 @@
+package sink
+
+import (
+	"sync/atomic"
+	"time"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+)
+
+// idleWatcher detects a stream that stopped sending messages without being closed. The timer
+// only runs while a receive call is blocked, so time spent in the handler, or waiting on a full
+// prefetch queue, is never accounted as idle time.
+type idleWatcher struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+// newIdleWatcher returns an [idleWatcher] calling `onStall` once a receive call has been
+// blocked for longer than `timeout`, `onStall` is expected to cancel the stream so that
+// the blocked receive call returns.
+func newIdleWatcher(timeout time.Duration, onStall func()) *idleWatcher {
+	w := &idleWatcher{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		w.stalled.Store(true)
+		onStall()
+	})
+	w.timer.Stop()
+
+	return w
+}
+
+// wrap returns a receive function that arms the idle timer for the duration of each `receive` call.
+func (w *idleWatcher) wrap(receive func() (*pbsubstreamsrpc.Response, error)) func() (*pbsubstreamsrpc.Response, error) {
+	return func() (*pbsubstreamsrpc.Response, error) {
+		w.timer.Reset(w.timeout)
+		defer w.timer.Stop()
+
+		return receive()
+	}
+}
+
+// Stalled returns true if the idle timeout was reached, in which case the stream has been canceled.
+func (w *idleWatcher) Stalled() bool {
+	return w.stalled.Load()
+}
+
+func (w *idleWatcher) Stop() {
+	w.timer.Stop()
+}
@@ -0,0 +1,52 @@
+package sink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleWatcher_Stall(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watcher := newIdleWatcher(20*time.Millisecond, cancel)
+	defer watcher.Stop()
+
+	receive := watcher.wrap(func() (*pbsubstreamsrpc.Response, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	_, err := receive()
+	require.ErrorIs(t, err, context.Canceled)
+	assert.True(t, watcher.Stalled())
+}
+
+func TestIdleWatcher_OnlyCountsReceiveTime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watcher := newIdleWatcher(50*time.Millisecond, cancel)
+	defer watcher.Stop()
+
+	receive := watcher.wrap(func() (*pbsubstreamsrpc.Response, error) {
+		time.Sleep(5 * time.Millisecond)
+		return &pbsubstreamsrpc.Response{}, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := receive()
+		require.NoError(t, err)
+
+		// Simulates a slow handler, the watcher must not fire in-between receive calls
+		time.Sleep(60 * time.Millisecond)
+	}
+
+	assert.False(t, watcher.Stalled())
+	assert.NoError(t, ctx.Err())
+}
@@ -0,0 +1,18 @@
+// Package rpcutil holds helpers around the Substreams RPC messages shared by the sink packages.
+package rpcutil
+
+import (
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+)
+
+// ResponseCursor returns the cursor carried by the response, "" if the response has none.
+func ResponseCursor(response *pbsubstreamsrpc.Response) string {
+	switch r := response.Message.(type) {
+	case *pbsubstreamsrpc.Response_BlockScopedData:
+		return r.BlockScopedData.Cursor
+	case *pbsubstreamsrpc.Response_BlockUndoSignal:
+		return r.BlockUndoSignal.LastValidCursor
+	}
+
+	return ""
+}
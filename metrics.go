@@ -24,4 +24,24 @@ var ProgressMessageLastContiguousBlock = metrics.NewGaugeVec("substreams_sink_pr
 var UndoMessageCount = metrics.NewCounter("substreams_sink_undo_message", "The number of block undo message received")
 var UnknownMessageCount = metrics.NewCounter("substreams_sink_unknown_message", "The number of unknown message received")
 
+var PrefetchQueueDepth = metrics.NewGauge("substreams_sink_prefetch_queue_depth", "The number of received messages waiting in the prefetch queue to be processed by the handler")
+
+var ActiveEndpoint = metrics.NewGaugeVec("substreams_sink_active_endpoint", []string{"endpoint"}, "Set to 1 for the Substreams endpoint currently in use, 0 for the other configured endpoints")
+var EndpointFailoverCount = metrics.NewCounter("substreams_sink_endpoint_failover", "The number of times the sinker failed over to the next configured Substreams endpoint")
+
+var StreamStallCount = metrics.NewCounter("substreams_sink_stream_stall", "The number of times the stream was reconnected because no message was received within the configured idle timeout")
+
+var UndoBufferCapacity = metrics.NewGauge("substreams_sink_undo_buffer_capacity", "The number of blocks the undo buffer can hold, it grows over time when the buffer is adaptive")
+var UndoMaxObservedDepth = metrics.NewGauge("substreams_sink_undo_max_observed_depth", "The depth, in blocks, of the deepest reorganization observed through undo signals")
+
+var UndoOverflowCount = metrics.NewCounter("substreams_sink_undo_overflow", "The number of undo signals that reverted blocks already emitted by the undo buffer")
+var UndoBufferMaxBytesEvictionCount = metrics.NewCounter("substreams_sink_undo_buffer_max_bytes_eviction", "The number of non-final blocks emitted by the undo buffer as if they were final because its byte cap was reached, see sink.WithBlockDataBufferMaxBytes")
+
+var HandlerCallDuration = metrics.NewHistogramVec("substreams_sink_handler_call_duration", []string{"method"}, "The duration of the handler calls, recorded by sink.MetricsMiddleware")
+var HandlerCallErrorCount = metrics.NewCounterVec("substreams_sink_handler_call_error", []string{"method"}, "The number of handler calls that returned an error, recorded by sink.MetricsMiddleware")
+
+var HandlerRetryCount = metrics.NewCounter("substreams_sink_handler_retry", "The number of handler calls retried in place following a retryable error, see sink.WithHandlerRetry")
+var StreamReconnectCount = metrics.NewCounter("substreams_sink_stream_reconnect", "The number of times the stream was reconnected following a retryable error")
+var DeadLetterCount = metrics.NewCounter("substreams_sink_dead_letter", "The number of blocks the handler failed to process that were dead-lettered and skipped, see sink.WithDeadLetter")
+
 var BackprocessingCompletion = metrics.NewGauge("substreams_sink_backprocessing_completion", "Determines if backprocessing is completed, which is if we receive a first data message")
@@ -0,0 +1,517 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/shutter"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"go.uber.org/zap"
+)
+
+type ParallelBackfillOption func(p *ParallelBackfill)
+
+// WithBackfillSegmentCursorStores configures the [CursorStore] used by each segment, the factory
+// receives the segment's block range and must always return the same store for the same range.
+// A segment for which the factory returns nil keeps no progress, like every segment when this
+// option is not used: on restart it re-processes its whole range, even if it had completed.
+func WithBackfillSegmentCursorStores(factory func(segment *bstream.Range) CursorStore) ParallelBackfillOption {
+	return func(p *ParallelBackfill) {
+		p.segmentCursorStore = factory
+	}
+}
+
+// WithBackfillOrderedDelivery configures the [ParallelBackfill] to deliver blocks to the handler
+// in strict block order. Segments still process in parallel but each segment, except the one
+// currently being delivered, can only hold `bufferSize` blocks waiting for delivery after which
+// it's paused until its turn comes.
+func WithBackfillOrderedDelivery(bufferSize int) ParallelBackfillOption {
+	return func(p *ParallelBackfill) {
+		p.ordered = true
+		p.reorderBufferSize = bufferSize
+	}
+}
+
+// WithBackfillLiveHandoff must be used when the [Sinker]'s block range is open-ended, segments
+// are computed up to `handoffBlock` (exclusive) and, once they all completed, a single live
+// [Sinker] continues from `handoffBlock` onward. [NewParallelBackfill] fails if it's used with
+// a block range that has an end block.
+func WithBackfillLiveHandoff(handoffBlock uint64) ParallelBackfillOption {
+	return func(p *ParallelBackfill) {
+		p.liveHandoffBlock = handoffBlock
+	}
+}
+
+// ParallelBackfill splits the block range of a [Sinker] into segments that are streamed
+// concurrently, each segment being its own request in final blocks only mode.
+//
+// The [Sinker] received is used as a template, it's never run directly, each segment gets a
+// derived [Sinker] with the same configuration but its own block range.
+//
+// By default, handler calls are serialized but blocks from different segments are delivered in
+// the order they are received, use [WithBackfillOrderedDelivery] if your handler requires blocks
+// in order.
+//
+// Progress is only kept through the per-segment cursor stores configured with
+// [WithBackfillSegmentCursorStores], the [Sinker]'s own [CursorStore] being used by the live
+// [Sinker] only. Without them, a restarted [ParallelBackfill] processes every segment again from
+// its start and the handler receives again the blocks it already handled.
+type ParallelBackfill struct {
+	sinker       *Sinker
+	segmentCount int
+	logger       *zap.Logger
+
+	segmentCursorStore func(segment *bstream.Range) CursorStore
+	ordered            bool
+	reorderBufferSize  int
+	liveHandoffBlock   uint64
+}
+
+func NewParallelBackfill(sinker *Sinker, segmentCount int, opts ...ParallelBackfillOption) (*ParallelBackfill, error) {
+	p := &ParallelBackfill{
+		sinker:       sinker,
+		segmentCount: segmentCount,
+		logger:       sinker.logger.Named("backfill"),
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if segmentCount < 1 {
+		return nil, fmt.Errorf("segment count must be at least 1, got %d", segmentCount)
+	}
+
+	if sinker.blockRange == nil {
+		return nil, errors.New("sinker must be configured with a block range, see WithBlockRange")
+	}
+
+	if sinker.blockRange.EndBlock() == nil && p.liveHandoffBlock == 0 {
+		return nil, errors.New("sinker block range is open-ended, a live handoff block must be configured, see WithBackfillLiveHandoff")
+	}
+
+	if sinker.blockRange.EndBlock() != nil && p.liveHandoffBlock != 0 {
+		return nil, fmt.Errorf("live handoff block %d cannot be used with block range %s which has an end block", p.liveHandoffBlock, sinker.blockRange)
+	}
+
+	if _, err := sinker.copyBackOff(); err != nil {
+		return nil, err
+	}
+
+	if p.backfillEndBlock() <= sinker.blockRange.StartBlock() {
+		return nil, fmt.Errorf("backfill end block %d must be above block range start block %d", p.backfillEndBlock(), sinker.blockRange.StartBlock())
+	}
+
+	return p, nil
+}
+
+// backfillEndBlock returns the exclusive end block of the backfilled range.
+func (p *ParallelBackfill) backfillEndBlock() uint64 {
+	if end := p.sinker.blockRange.EndBlock(); end != nil {
+		return *end
+	}
+
+	return p.liveHandoffBlock
+}
+
+// Segments returns the block ranges each processed by a dedicated [Sinker].
+func (p *ParallelBackfill) Segments() []*bstream.Range {
+	return splitBlockRange(p.sinker.blockRange.StartBlock(), p.backfillEndBlock(), p.segmentCount)
+}
+
+// Run processes all segments concurrently and returns once they all completed, or after the
+// live [Sinker] terminated if the block range is open-ended. The first error encountered
+// stops every segment and is returned.
+//
+// When the range is closed and every segment completed, the handler's [SinkerCompletionHandler]
+// is called if implemented.
+func (p *ParallelBackfill) Run(ctx context.Context, handler SinkerHandler) error {
+	segments := p.Segments()
+	p.logger.Info("starting parallel backfill",
+		zap.Stringer("block_range", p.sinker.blockRange),
+		zap.Int("segment_count", len(segments)),
+		zap.Bool("ordered", p.ordered),
+		zap.Uint64("live_handoff_block", p.liveHandoffBlock),
+	)
+
+	if p.segmentCursorStore == nil {
+		p.logger.Warn("no segment cursor stores configured, every segment is processed from its start on restart, see WithBackfillSegmentCursorStores")
+	}
+
+	stores := make([]CursorStore, len(segments))
+	children := make([]*Sinker, len(segments))
+	for i, segment := range segments {
+		if p.segmentCursorStore != nil {
+			stores[i] = p.segmentCursorStore(segment)
+		}
+
+		child, err := p.sinker.derive(p.logger.With(zap.Stringer("segment", segment)), segment, stores[i], true)
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", segment, err)
+		}
+
+		children[i] = child
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Segments deliver blocks to the handler directly, it goes through the middlewares, handler retry and dead letter here
+	deliveryHandler := handler
+	if len(p.sinker.middlewares) > 0 || p.sinker.handlerRetryAttempts > 1 || p.sinker.deadLetterStore != nil {
+		deliveryHandler = &middlewareHandler{sinker: p.sinker, handler: handler}
+	}
+
+	var delivery segmentDelivery = &serializedDelivery{handler: deliveryHandler}
+	if p.ordered {
+		delivery = newOrderedDelivery(ctx, deliveryHandler, len(segments), p.reorderBufferSize)
+	}
+
+	deliveryDone := make(chan struct{})
+	go func() {
+		defer close(deliveryDone)
+
+		// A delivery error must stop the segments right away, they could be blocked waiting for delivery
+		if err := delivery.wait(); err != nil {
+			cancel(err)
+		}
+	}()
+
+	lastCursors := make([]*Cursor, len(segments))
+
+	wg := sync.WaitGroup{}
+	for i, segment := range segments {
+		i, segment := i, segment
+		store := stores[i]
+		child := children[i]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			segmentHandler := delivery.segmentHandler(i)
+			child.Run(ctx, nil, segmentHandler)
+
+			if err := child.Err(); err != nil {
+				cancel(fmt.Errorf("segment %s: %w", segment, err))
+				delivery.segmentCompleted(i, nil)
+				return
+			}
+
+			lastCursors[i] = segmentHandler.lastCursor()
+			delivery.segmentCompleted(i, func(cursor *Cursor) error {
+				// Delivery of the segment is complete, ensure its final cursor is persisted
+				if store == nil || cursor.IsBlank() {
+					return nil
+				}
+
+				return store.Save(ctx, child.cursorRecord(cursor))
+			})
+		}()
+	}
+
+	wg.Wait()
+	<-deliveryDone
+
+	if err := context.Cause(ctx); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+
+		return err
+	}
+
+	p.logger.Info("parallel backfill completed all segments")
+
+	if p.sinker.blockRange.EndBlock() == nil {
+		return p.runLive(ctx, handler)
+	}
+
+	if v, ok := extraHandler[SinkerCompletionHandler](handler); ok {
+		if err := v.HandleBlockRangeCompletion(ctx, lastCursors[len(lastCursors)-1]); err != nil {
+			return fmt.Errorf("completion handler error: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *ParallelBackfill) runLive(ctx context.Context, handler SinkerHandler) error {
+	liveRange := bstream.NewOpenRange(p.liveHandoffBlock)
+	p.logger.Info("handing off to live sinker", zap.Stringer("block_range", liveRange))
+
+	live, err := p.sinker.derive(p.sinker.logger, liveRange, p.sinker.cursorStore, false)
+	if err != nil {
+		return fmt.Errorf("live sinker: %w", err)
+	}
+
+	live.Run(ctx, nil, handler)
+
+	return live.Err()
+}
+
+// derive returns a new [Sinker] with the same configuration as this one but its own state, the
+// received block range and cursor store. A `segment` [Sinker] streams final blocks only and leaves
+// out the configuration applied by the [ParallelBackfill] on delivery to the actual handler, or
+// that cannot be shared by concurrent segments.
+func (s *Sinker) derive(logger *zap.Logger, blockRange *bstream.Range, cursorStore CursorStore, segment bool) (*Sinker, error) {
+	backOff, err := s.copyBackOff()
+	if err != nil {
+		return nil, err
+	}
+
+	child := &Sinker{
+		Shutter:          shutter.New(),
+		mode:             s.mode,
+		pkg:              s.pkg,
+		outputModule:     s.outputModule,
+		outputModuleHash: s.outputModuleHash,
+		clientConfig:     s.clientConfig,
+		logger:           logger,
+		tracer:           s.tracer,
+
+		backOff:           backOff,
+		backOffFactory:    s.backOffFactory,
+		blockRange:        blockRange,
+		infiniteRetry:     s.infiniteRetry,
+		finalBlocksOnly:   s.finalBlocksOnly,
+		livenessChecker:   s.livenessChecker,
+		extraHeaders:      s.extraHeaders,
+		cursorStore:       cursorStore,
+		cursorMismatch:    s.cursorMismatch,
+		prefetch:          s.prefetch,
+		endpoints:         s.endpoints,
+		failoverThreshold: s.failoverThreshold,
+		primaryRecheck:    s.primaryRecheck,
+		idleTimeout:       s.idleTimeout,
+		recordPath:        s.recordPath,
+		replayPath:        s.replayPath,
+		bufferStatePath:   s.bufferStatePath,
+		bufferMaxBytes:    s.bufferMaxBytes,
+		undoOverflow:      s.undoOverflow,
+		undoOverflowHook:  s.undoOverflowHook,
+		orphanedBlockData: s.orphanedBlockData,
+		middlewares:       s.middlewares,
+
+		handlerRetryAttempts: s.handlerRetryAttempts,
+		handlerRetryBackOff:  s.handlerRetryBackOff,
+		deadLetterStore:      s.deadLetterStore,
+		deadLetterPolicy:     s.deadLetterPolicy,
+
+		stats: newStats(logger),
+	}
+
+	if s.buffer != nil {
+		child.buffer = s.buffer.emptyCopy()
+	}
+
+	if segment {
+		child.finalBlocksOnly = true
+		child.buffer = nil
+		child.bufferStatePath = ""
+
+		// Segments deliver to the actual handler through the ParallelBackfill which applies those itself
+		child.middlewares = nil
+		child.handlerRetryAttempts = 0
+		child.handlerRetryBackOff = nil
+		child.deadLetterStore = nil
+		child.deadLetterPolicy = DeadLetterPolicy{}
+
+		// Concurrent segments would overwrite each other's recording
+		child.recordPath = ""
+	}
+
+	return child, nil
+}
+
+// splitBlockRange splits [start, end( in `count` contiguous segments of equal size, the last
+// one being possibly smaller. Less than `count` segments are returned if the range is too small.
+func splitBlockRange(start, end uint64, count int) (out []*bstream.Range) {
+	total := end - start
+	size := (total + uint64(count) - 1) / uint64(count)
+
+	for segmentStart := start; segmentStart < end; segmentStart += size {
+		segmentEnd := segmentStart + size
+		if segmentEnd > end {
+			segmentEnd = end
+		}
+
+		out = append(out, bstream.NewRangeExcludingEnd(segmentStart, segmentEnd))
+	}
+
+	return
+}
+
+type segmentDelivery interface {
+	segmentHandler(segment int) *segmentHandler
+	// segmentCompleted is called once the segment's [Sinker] terminated, `onDelivered`
+	// is nil if it terminated with an error, otherwise it's called with the segment's last
+	// cursor once all its blocks were delivered to the handler.
+	segmentCompleted(segment int, onDelivered func(cursor *Cursor) error)
+	wait() error
+}
+
+// segmentHandler is the [SinkerHandler] received by a segment's [Sinker], it forwards blocks to
+// the actual handler through its `deliver` function.
+//
+// It implements [SinkerCommittedCursorHandler] so that the segment's [CursorStore] only records
+// blocks actually processed by the actual handler, which can lag behind when delivery is ordered.
+type segmentHandler struct {
+	deliver func(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error
+
+	received  atomic.Pointer[Cursor]
+	committed atomic.Pointer[Cursor]
+}
+
+func (h *segmentHandler) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+	if err := h.deliver(ctx, data, isLive, cursor); err != nil {
+		return err
+	}
+
+	h.received.Store(cursor)
+	return nil
+}
+
+func (h *segmentHandler) CommittedCursor() *Cursor {
+	return h.committed.Load()
+}
+
+func (h *segmentHandler) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	return fmt.Errorf("received undo signal to block %s while streaming final blocks only", asBlockRef(undoSignal.LastValidBlock))
+}
+
+func (h *segmentHandler) lastCursor() *Cursor {
+	return h.received.Load()
+}
+
+// serializedDelivery calls the handler as soon as a block is received by any segment, using
+// a lock so that the handler is never called concurrently.
+type serializedDelivery struct {
+	handler SinkerHandler
+	lock    sync.Mutex
+}
+
+func (d *serializedDelivery) segmentHandler(segment int) *segmentHandler {
+	h := &segmentHandler{}
+	h.deliver = func(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		// Another segment failed while waiting for the lock, the handler must not receive blocks anymore
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := d.handler.HandleBlockScopedData(ctx, data, isLive, cursor); err != nil {
+			return err
+		}
+
+		h.committed.Store(cursor)
+		return nil
+	}
+
+	return h
+}
+
+func (d *serializedDelivery) segmentCompleted(segment int, onDelivered func(cursor *Cursor) error) {}
+
+func (d *serializedDelivery) wait() error { return nil }
+
+type orderedBlock struct {
+	data   *pbsubstreamsrpc.BlockScopedData
+	isLive *bool
+	cursor *Cursor
+}
+
+// orderedDelivery queues blocks of each segment in a bounded channel, a single goroutine
+// drains the channels one segment after the other calling the handler, giving strict
+// block ordering.
+type orderedDelivery struct {
+	ctx       context.Context
+	handler   SinkerHandler
+	queues    []chan orderedBlock
+	handlers  []*segmentHandler
+	completed []chan func(cursor *Cursor) error
+	done      chan error
+}
+
+func newOrderedDelivery(ctx context.Context, handler SinkerHandler, segmentCount int, bufferSize int) *orderedDelivery {
+	d := &orderedDelivery{
+		ctx:       ctx,
+		handler:   handler,
+		queues:    make([]chan orderedBlock, segmentCount),
+		handlers:  make([]*segmentHandler, segmentCount),
+		completed: make([]chan func(cursor *Cursor) error, segmentCount),
+		done:      make(chan error, 1),
+	}
+
+	for i := range d.queues {
+		d.queues[i] = make(chan orderedBlock, bufferSize)
+		d.completed[i] = make(chan func(cursor *Cursor) error, 1)
+	}
+
+	go d.deliverAll()
+
+	return d
+}
+
+func (d *orderedDelivery) segmentHandler(segment int) *segmentHandler {
+	queue := d.queues[segment]
+
+	h := &segmentHandler{deliver: func(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+		select {
+		case queue <- orderedBlock{data, isLive, cursor}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+	d.handlers[segment] = h
+
+	return h
+}
+
+func (d *orderedDelivery) segmentCompleted(segment int, onDelivered func(cursor *Cursor) error) {
+	d.completed[segment] <- onDelivered
+	close(d.queues[segment])
+}
+
+func (d *orderedDelivery) deliverAll() {
+	d.done <- func() error {
+		for i, queue := range d.queues {
+			var lastCursor *Cursor
+			for block := range queue {
+				// A segment failed, its error is the cause of the cancellation and is reported by Run
+				if d.ctx.Err() != nil {
+					return nil
+				}
+
+				if err := d.handler.HandleBlockScopedData(d.ctx, block.data, block.isLive, block.cursor); err != nil {
+					return fmt.Errorf("handle BlockScopedData message at block %s: %w", blockToRef(block.data), err)
+				}
+
+				lastCursor = block.cursor
+				d.handlers[i].committed.Store(lastCursor)
+			}
+
+			onDelivered := <-d.completed[i]
+			if onDelivered == nil {
+				return nil
+			}
+
+			if err := onDelivered(lastCursor); err != nil {
+				return fmt.Errorf("segment delivered: %w", err)
+			}
+		}
+
+		return nil
+	}()
+}
+
+func (d *orderedDelivery) wait() error {
+	return <-d.done
+}
@@ -0,0 +1,112 @@
+package sink
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bobg/go-generics/v2/slices"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/streamingfast/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitBlockRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    uint64
+		end      uint64
+		count    int
+		expected []string
+	}{
+		{"single segment", 10, 20, 1, []string{"[10, 20)"}},
+		{"even split", 0, 100, 4, []string{"[0, 25)", "[25, 50)", "[50, 75)", "[75, 100)"}},
+		{"last segment smaller", 10, 20, 3, []string{"[10, 14)", "[14, 18)", "[18, 20)"}},
+		{"more segments than blocks", 10, 12, 5, []string{"[10, 11)", "[11, 12)"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := slices.Map(splitBlockRange(tt.start, tt.end, tt.count), func(r *bstream.Range) string {
+				return rangeString(r)
+			})
+
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestSinker_derive(t *testing.T) {
+	template := &Sinker{
+		logger:               zlog,
+		backOff:              backoff.NewExponentialBackOff(),
+		buffer:               newBlockDataBuffer(3),
+		bufferMaxBytes:       1024,
+		recordPath:           "stream.rec",
+		middlewares:          []HandlerMiddleware{RecoverMiddleware()},
+		handlerRetryAttempts: 3,
+		deadLetterStore:      NewInMemoryDeadLetterStore(),
+	}
+
+	live, err := template.derive(zlog, bstream.NewOpenRange(10), nil, false)
+	require.NoError(t, err)
+	assert.NotSame(t, template.backOff, live.backOff)
+	assert.NotSame(t, template.buffer, live.buffer)
+	assert.Equal(t, 1024, live.bufferMaxBytes)
+	assert.Equal(t, "stream.rec", live.recordPath)
+	assert.Len(t, live.middlewares, 1)
+	assert.Equal(t, 3, live.handlerRetryAttempts)
+	assert.NotNil(t, live.deadLetterStore)
+
+	segment, err := template.derive(zlog, bstream.NewRangeExcludingEnd(0, 10), nil, true)
+	require.NoError(t, err)
+	assert.NotSame(t, template.backOff, segment.backOff)
+	assert.NotSame(t, live.backOff, segment.backOff)
+	assert.True(t, segment.finalBlocksOnly)
+	assert.Nil(t, segment.buffer)
+	assert.Empty(t, segment.recordPath)
+	assert.Empty(t, segment.middlewares)
+	assert.Zero(t, segment.handlerRetryAttempts)
+	assert.Nil(t, segment.deadLetterStore)
+
+	template.backOff = &unknownBackOff{}
+	_, err = template.derive(zlog, bstream.NewOpenRange(10), nil, false)
+	require.EqualError(t, err, "retry back off of type *sink.unknownBackOff cannot be copied, configure it through WithRetryBackOffFactory")
+
+	WithRetryBackOffFactory(func() backoff.BackOff { return &unknownBackOff{} })(template)
+	live, err = template.derive(zlog, bstream.NewOpenRange(10), nil, false)
+	require.NoError(t, err)
+	assert.NotSame(t, template.backOff, live.backOff)
+}
+
+func TestNewParallelBackfill_InvalidConfiguration(t *testing.T) {
+	tests := []struct {
+		name        string
+		blockRange  *bstream.Range
+		opts        []ParallelBackfillOption
+		expectedErr string
+	}{
+		{"open-ended range without live handoff", bstream.NewOpenRange(10), nil, "sinker block range is open-ended, a live handoff block must be configured, see WithBackfillLiveHandoff"},
+		{"bounded range with live handoff", bstream.NewRangeExcludingEnd(10, 20), []ParallelBackfillOption{WithBackfillLiveHandoff(15)}, "live handoff block 15 cannot be used with block range [10, 20) which has an end block"},
+		{"live handoff below start block", bstream.NewOpenRange(10), []ParallelBackfillOption{WithBackfillLiveHandoff(5)}, "backfill end block 5 must be above block range start block 10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sinker := &Sinker{logger: zlog, backOff: backoff.NewExponentialBackOff(), blockRange: tt.blockRange}
+
+			_, err := NewParallelBackfill(sinker, 2, tt.opts...)
+			require.EqualError(t, err, tt.expectedErr)
+		})
+	}
+}
+
+type unknownBackOff struct{ backoff.ConstantBackOff }
+
+func rangeString(r *bstream.Range) string {
+	if r.EndBlock() == nil {
+		return fmt.Sprintf("[%d, +∞)", r.StartBlock())
+	}
+
+	return fmt.Sprintf("[%d, %d)", r.StartBlock(), *r.EndBlock())
+}
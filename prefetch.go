@@ -0,0 +1,52 @@
+package sink
+
+import (
+	"context"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+)
+
+type receivedResponse struct {
+	response *pbsubstreamsrpc.Response
+	err      error
+}
+
+// prefetchResponses starts a goroutine calling `receive` continuously and queuing results in
+// a channel of `s.prefetch` capacity, providing backpressure once full. The returned function
+// must be used in place of `receive`, it returns queued responses in order.
+//
+// The goroutine stops after forwarding the first error it gets or once `ctx` is done, the
+// `ctx` must be the one bound to the stream so that canceling it unblocks `receive`.
+func (s *Sinker) prefetchResponses(
+	ctx context.Context,
+	receive func() (*pbsubstreamsrpc.Response, error),
+) func() (*pbsubstreamsrpc.Response, error) {
+	queue := make(chan receivedResponse, s.prefetch)
+
+	go func() {
+		for {
+			response, err := receive()
+
+			select {
+			case queue <- receivedResponse{response, err}:
+				PrefetchQueueDepth.SetUint64(uint64(len(queue)))
+			case <-ctx.Done():
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return func() (*pbsubstreamsrpc.Response, error) {
+		select {
+		case received := <-queue:
+			PrefetchQueueDepth.SetUint64(uint64(len(queue)))
+			return received.response, received.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
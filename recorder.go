@@ -0,0 +1,328 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/streamingfast/substreams-sink/internal/rpcutil"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+)
+
+// responseRecorder appends every [pbsubstreamsrpc.Response] it receives to a file, each message
+// being prefixed by its size as a varint (see [protodelim]). Writes are flushed after each
+// message so that a recording is usable even if the process crashes.
+//
+// Each connection starts with a marker, an empty response followed by a [pbsubstreamsrpc.Request]
+// holding the cursor and block range requested, so that responses delivered again after a
+// reconnection are replayed on their own connection.
+type responseRecorder struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func newResponseRecorder(path string) (*responseRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create recording file: %w", err)
+	}
+
+	return &responseRecorder{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// RecordConnection records the start of a new connection made with `request`.
+func (r *responseRecorder) RecordConnection(request *pbsubstreamsrpc.Request) error {
+	marker := &pbsubstreamsrpc.Request{
+		StartBlockNum: request.StartBlockNum,
+		StopBlockNum:  request.StopBlockNum,
+		StartCursor:   request.StartCursor,
+	}
+
+	return r.write(&pbsubstreamsrpc.Response{}, marker)
+}
+
+func (r *responseRecorder) Record(response *pbsubstreamsrpc.Response) error {
+	return r.write(response)
+}
+
+func (r *responseRecorder) write(messages ...proto.Message) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return errors.New("recorder is closed")
+	}
+
+	for _, message := range messages {
+		if _, err := protodelim.MarshalTo(r.writer, message); err != nil {
+			return err
+		}
+	}
+
+	return r.writer.Flush()
+}
+
+func (r *responseRecorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	flushErr := r.writer.Flush()
+	closeErr := r.file.Close()
+	r.file = nil
+
+	return errors.Join(flushErr, closeErr)
+}
+
+var _ pbsubstreamsrpc.StreamClient = (*replayStreamClient)(nil)
+
+// replayStreamClient is a [pbsubstreamsrpc.StreamClient] serving the responses of a recording
+// made with [WithRecorder] instead of calling a Substreams server.
+//
+// Each call to `Blocks` serves a single recorded connection, or the end of it. With a cursor, the
+// stream resumes from the latest point of the recording where the server did: the start of a
+// connection made with this cursor, or the response following the one carrying this cursor.
+// Without cursor, the first recorded connection made without cursor and not served yet is served,
+// block data below the request's start block being skipped.
+//
+// A recorded connection that is not the last one ends with a `codes.Unavailable` error so that
+// the [Sinker] reconnects like it did while recording, the last one ends normally. A connection
+// also ends normally when a block data reaches the request's stop block.
+type replayStreamClient struct {
+	path string
+
+	// next is the index of the first recorded connection a request without cursor can be served
+	next atomic.Int64
+}
+
+func (c *replayStreamClient) Blocks(ctx context.Context, in *pbsubstreamsrpc.Request, opts ...grpc.CallOption) (pbsubstreamsrpc.Stream_BlocksClient, error) {
+	file, err := os.Open(c.path)
+	if err != nil {
+		return nil, fmt.Errorf("open recording: %w", err)
+	}
+
+	stream := &replayBlocksClient{
+		client:  c,
+		ctx:     ctx,
+		file:    file,
+		request: in,
+	}
+
+	// Like a gRPC stream, the recording is released once the stream's context is done even if
+	// the stream was not read until the end
+	stream.stopClose = context.AfterFunc(ctx, stream.close)
+
+	return stream, nil
+}
+
+type replayBlocksClient struct {
+	client    *replayStreamClient
+	ctx       context.Context
+	file      *os.File
+	closeOnce sync.Once
+	stopClose func() bool
+	reader    *recordingReader
+	request   *pbsubstreamsrpc.Request
+
+	// connection is the index of the recorded connection served, set once located
+	connection int
+}
+
+func (c *replayBlocksClient) Recv() (*pbsubstreamsrpc.Response, error) {
+	if c.reader == nil {
+		if err := c.locate(); err != nil {
+			c.release()
+
+			if ctxErr := c.ctx.Err(); ctxErr != nil {
+				return nil, status.FromContextError(ctxErr).Err()
+			}
+
+			return nil, err
+		}
+	}
+
+	for {
+		if err := c.ctx.Err(); err != nil {
+			return nil, status.FromContextError(err).Err()
+		}
+
+		response := &pbsubstreamsrpc.Response{}
+		if err := c.reader.read(response); err != nil {
+			c.release()
+
+			if ctxErr := c.ctx.Err(); ctxErr != nil {
+				return nil, status.FromContextError(ctxErr).Err()
+			}
+
+			if errors.Is(err, io.EOF) {
+				return nil, io.EOF
+			}
+
+			return nil, status.Errorf(codes.DataLoss, "read recording %q: %s", c.file.Name(), err)
+		}
+
+		if response.Message == nil {
+			c.release()
+			return nil, status.Errorf(codes.Unavailable, "recorded connection %d ended", c.connection)
+		}
+
+		if data := response.GetBlockScopedData(); data != nil {
+			if c.request.StopBlockNum != 0 && data.Clock.Number >= c.request.StopBlockNum {
+				c.release()
+				return nil, io.EOF
+			}
+
+			if c.request.StartCursor == "" && c.request.StartBlockNum > 0 && data.Clock.Number < uint64(c.request.StartBlockNum) {
+				continue
+			}
+		}
+
+		return response, nil
+	}
+}
+
+// locate reads the whole recording to find where the stream resumes for the request, see
+// [replayStreamClient], and positions the reader there.
+func (c *replayBlocksClient) locate() error {
+	reader := newRecordingReader(c.file)
+	cursor := c.request.StartCursor
+	next := int(c.client.next.Load())
+
+	connection, found := -1, false
+	var offset int64
+
+	for !found || cursor != "" {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+
+		recordOffset := reader.offset
+		response := &pbsubstreamsrpc.Response{}
+		if err := reader.read(response); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return status.Errorf(codes.DataLoss, "read recording %q: %s", c.file.Name(), err)
+		}
+
+		if response.Message == nil {
+			marker := &pbsubstreamsrpc.Request{}
+			if err := reader.read(marker); err != nil {
+				return status.Errorf(codes.DataLoss, "read recording %q connection marker: %s", c.file.Name(), err)
+			}
+
+			connection++
+			if marker.StartCursor == cursor && (cursor != "" || connection >= next) {
+				c.connection, offset, found = connection, reader.offset, true
+			}
+
+			continue
+		}
+
+		if connection == -1 {
+			// Responses recorded before the first marker belong to a single connection
+			connection = 0
+			if cursor == "" && next == 0 {
+				c.connection, offset, found = 0, recordOffset, true
+			}
+		}
+
+		if cursor != "" && rpcutil.ResponseCursor(response) == cursor {
+			c.connection, offset, found = connection, reader.offset, true
+		}
+	}
+
+	if !found && cursor != "" {
+		return status.Errorf(codes.InvalidArgument, "cursor %q not found in recording %q", cursor, c.file.Name())
+	}
+
+	if !found {
+		// Every recorded connection was served, the stream ends right away
+		offset = reader.offset
+	}
+
+	if _, err := c.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek recording %q: %w", c.file.Name(), err)
+	}
+
+	c.reader = newRecordingReader(c.file)
+	c.client.next.Store(int64(c.connection + 1))
+	return nil
+}
+
+// release closes the recording once the stream ended on its own.
+func (c *replayBlocksClient) release() {
+	c.stopClose()
+	c.close()
+}
+
+func (c *replayBlocksClient) close() {
+	c.closeOnce.Do(func() { c.file.Close() })
+}
+
+func (c *replayBlocksClient) Header() (metadata.MD, error) { return nil, nil }
+func (c *replayBlocksClient) Trailer() metadata.MD         { return nil }
+func (c *replayBlocksClient) CloseSend() error             { return nil }
+func (c *replayBlocksClient) Context() context.Context     { return c.ctx }
+func (c *replayBlocksClient) SendMsg(m any) error          { return nil }
+
+func (c *replayBlocksClient) RecvMsg(m any) error {
+	response, err := c.Recv()
+	if err != nil {
+		return err
+	}
+
+	target, ok := m.(*pbsubstreamsrpc.Response)
+	if !ok {
+		return fmt.Errorf("expected *pbsubstreamsrpc.Response, got %T", m)
+	}
+
+	target.Message = response.Message
+	return nil
+}
+
+// recordingReader reads the length-delimited messages of a recording, keeping track of the
+// offset of the next message.
+type recordingReader struct {
+	reader *bufio.Reader
+	offset int64
+}
+
+func newRecordingReader(file *os.File) *recordingReader {
+	return &recordingReader{reader: bufio.NewReader(file)}
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *recordingReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.offset++
+	}
+
+	return b, err
+}
+
+func (r *recordingReader) read(message proto.Message) error {
+	return (protodelim.UnmarshalOptions{MaxSize: -1}).UnmarshalFrom(r, message)
+}
@@ -0,0 +1,161 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecorderReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream.bin")
+
+	recorder, err := newResponseRecorder(path)
+	require.NoError(t, err)
+
+	for _, response := range []*pbsubstreamsrpc.Response{
+		{Message: &pbsubstreamsrpc.Response_Session{Session: &pbsubstreamsrpc.SessionInit{TraceId: "abc"}}},
+		recordedBlock("1a"),
+		recordedBlock("2a"),
+		recordedBlock("3a"),
+		recordedBlock("4a"),
+	} {
+		require.NoError(t, recorder.Record(response))
+	}
+	require.NoError(t, recorder.Close())
+
+	tests := []struct {
+		name        string
+		request     *pbsubstreamsrpc.Request
+		expected    []string
+		expectedErr codes.Code
+	}{
+		{"full", &pbsubstreamsrpc.Request{}, []string{"session", "#1 (a)", "#2 (a)", "#3 (a)", "#4 (a)"}, codes.OK},
+		{"start block", &pbsubstreamsrpc.Request{StartBlockNum: 3}, []string{"session", "#3 (a)", "#4 (a)"}, codes.OK},
+		{"stop block", &pbsubstreamsrpc.Request{StopBlockNum: 3}, []string{"session", "#1 (a)", "#2 (a)"}, codes.OK},
+		{"cursor", &pbsubstreamsrpc.Request{StartCursor: testCursor("2a").String()}, []string{"#3 (a)", "#4 (a)"}, codes.OK},
+		{"unknown cursor", &pbsubstreamsrpc.Request{StartCursor: testCursor("9a").String()}, nil, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := (&replayStreamClient{path: path}).Blocks(context.Background(), tt.request)
+			require.NoError(t, err)
+
+			var received []string
+			for {
+				response, err := stream.Recv()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+
+				if tt.expectedErr != codes.OK {
+					assert.Equal(t, tt.expectedErr, status.Code(err))
+					return
+				}
+
+				require.NoError(t, err)
+				if data := response.GetBlockScopedData(); data != nil {
+					received = append(received, blockToRef(data).String())
+				} else {
+					received = append(received, "session")
+				}
+			}
+
+			assert.Equal(t, tt.expected, received)
+		})
+	}
+}
+
+func TestRecorderReplay_Reconnection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream.bin")
+
+	// The first connection fails after #3, the stream resumes from #2 which was the last block handled
+	recorder, err := newResponseRecorder(path)
+	require.NoError(t, err)
+	require.NoError(t, recorder.RecordConnection(&pbsubstreamsrpc.Request{StartBlockNum: 1}))
+	for _, id := range []string{"1a", "2a", "3a"} {
+		require.NoError(t, recorder.Record(recordedBlock(id)))
+	}
+	require.NoError(t, recorder.RecordConnection(&pbsubstreamsrpc.Request{StartBlockNum: 1, StartCursor: testCursor("2a").String()}))
+	for _, id := range []string{"3a", "4a"} {
+		require.NoError(t, recorder.Record(recordedBlock(id)))
+	}
+	require.NoError(t, recorder.Close())
+
+	client := &replayStreamClient{path: path}
+	replay := func(request *pbsubstreamsrpc.Request) (received []string, err error) {
+		stream, err := client.Blocks(context.Background(), request)
+		require.NoError(t, err)
+
+		for {
+			response, err := stream.Recv()
+			if err != nil {
+				return received, err
+			}
+
+			received = append(received, blockToRef(response.GetBlockScopedData()).String())
+		}
+	}
+
+	received, err := replay(&pbsubstreamsrpc.Request{StartBlockNum: 1})
+	assert.Equal(t, codes.Unavailable, status.Code(err), "first recorded connection should end like it did")
+	assert.Equal(t, []string{"#1 (a)", "#2 (a)", "#3 (a)"}, received)
+
+	received, err = replay(&pbsubstreamsrpc.Request{StartBlockNum: 1, StartCursor: testCursor("2a").String()})
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, []string{"#3 (a)", "#4 (a)"}, received, "second recorded connection should be served")
+
+	received, err = replay(&pbsubstreamsrpc.Request{StartBlockNum: 1, StartCursor: testCursor("3a").String()})
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, []string{"#4 (a)"}, received, "stream should resume from the latest point where the server did")
+
+	received, err = replay(&pbsubstreamsrpc.Request{StartBlockNum: 1})
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Empty(t, received, "every recorded connection without cursor was served")
+}
+
+func TestRecorderReplay_ClosedOnCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stream.bin")
+
+	recorder, err := newResponseRecorder(path)
+	require.NoError(t, err)
+	require.NoError(t, recorder.Record(recordedBlock("1a")))
+	require.NoError(t, recorder.Record(recordedBlock("2a")))
+	require.NoError(t, recorder.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := (&replayStreamClient{path: path}).Blocks(ctx, &pbsubstreamsrpc.Request{})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// The stream is abandoned before its end, like after a handler error
+	cancel()
+
+	file := stream.(*replayBlocksClient).file
+	require.Eventually(t, func() bool {
+		_, err := file.Stat()
+		return errors.Is(err, os.ErrClosed)
+	}, time.Second, 10*time.Millisecond, "recording should be closed once the stream's context is done")
+
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
+
+func recordedBlock(id string) *pbsubstreamsrpc.Response {
+	data := blockScopedData(id, 0)
+	data.Cursor = testCursor(id).String()
+
+	return &pbsubstreamsrpc.Response{Message: &pbsubstreamsrpc.Response_BlockScopedData{BlockScopedData: data}}
+}
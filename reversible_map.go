@@ -0,0 +1,232 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+)
+
+// Reversible is implemented by in-memory state that can be reverted block by block when a
+// fork happens, see [ReversibleMap] and [NewReversibleStateHandler].
+type Reversible interface {
+	// BeginBlock makes `block` the block subsequent changes belong to. Changes previously made
+	// for blocks at or above `block`'s number, delivered again after a reconnection, are reverted.
+	BeginBlock(block bstream.BlockRef)
+
+	// Undo reverts every change made for blocks after `lastValidBlock`.
+	Undo(lastValidBlock bstream.BlockRef) error
+
+	// Finalize forgets how to revert the changes made for blocks at or below `finalBlockHeight`.
+	Finalize(finalBlockHeight uint64)
+}
+
+var _ Reversible = (*ReversibleMap[string, int])(nil)
+
+// ReversibleMap is a map whose changes are journaled per block so that they can be reverted
+// with [ReversibleMap.Undo] when the blocks are forked out. The journal of a block is discarded
+// once it's final, see [ReversibleMap.Finalize].
+//
+// Changes made before the first call to [ReversibleMap.BeginBlock] are not journaled and cannot
+// be reverted, which is useful to load the initial state. Changes made for blocks already final
+// are not journaled either.
+//
+// Like the [Sinker], it's expected to be used from a single goroutine.
+type ReversibleMap[K comparable, V any] struct {
+	values         map[K]V
+	journal        []*reversibleBlock[K, V]
+	current        *reversibleBlock[K, V]
+	finalizedBlock uint64
+}
+
+type reversibleBlock[K comparable, V any] struct {
+	ref     bstream.BlockRef
+	changes []reversibleChange[K, V]
+}
+
+// reversibleChange records the value of `key` before it was changed.
+type reversibleChange[K comparable, V any] struct {
+	key      K
+	previous V
+	existed  bool
+}
+
+func NewReversibleMap[K comparable, V any]() *ReversibleMap[K, V] {
+	return &ReversibleMap[K, V]{
+		values: make(map[K]V),
+	}
+}
+
+func (m *ReversibleMap[K, V]) Get(key K) (value V, found bool) {
+	value, found = m.values[key]
+	return
+}
+
+func (m *ReversibleMap[K, V]) Set(key K, value V) {
+	m.record(key)
+	m.values[key] = value
+}
+
+func (m *ReversibleMap[K, V]) Delete(key K) {
+	if _, found := m.values[key]; !found {
+		return
+	}
+
+	m.record(key)
+	delete(m.values, key)
+}
+
+// Update sets `key` to the value returned by `update`, called with the current value of `key`.
+func (m *ReversibleMap[K, V]) Update(key K, update func(current V, found bool) V) {
+	current, found := m.values[key]
+	m.Set(key, update(current, found))
+}
+
+// Range calls `f` for each key and value of the map in no particular order, it stops if
+// `f` returns false. The map must not be modified while iterating.
+func (m *ReversibleMap[K, V]) Range(f func(key K, value V) bool) {
+	for k, v := range m.values {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func (m *ReversibleMap[K, V]) Len() int {
+	return len(m.values)
+}
+
+// JournalLen returns the number of blocks whose changes can still be reverted.
+func (m *ReversibleMap[K, V]) JournalLen() int {
+	return len(m.journal)
+}
+
+func (m *ReversibleMap[K, V]) BeginBlock(block bstream.BlockRef) {
+	m.revertFrom(block.Num())
+
+	m.current = nil
+	if block.Num() > m.finalizedBlock {
+		m.current = &reversibleBlock[K, V]{ref: block}
+		m.journal = append(m.journal, m.current)
+	}
+}
+
+func (m *ReversibleMap[K, V]) Undo(lastValidBlock bstream.BlockRef) error {
+	if lastValidBlock.Num() < m.finalizedBlock {
+		return fmt.Errorf("cannot undo down to last valid block %s, changes up to final block height %d are not journaled anymore", lastValidBlock, m.finalizedBlock)
+	}
+
+	m.revertFrom(lastValidBlock.Num() + 1)
+	return nil
+}
+
+func (m *ReversibleMap[K, V]) Finalize(finalBlockHeight uint64) {
+	if finalBlockHeight <= m.finalizedBlock {
+		return
+	}
+
+	finalCount := 0
+	for finalCount < len(m.journal) && m.journal[finalCount].ref.Num() <= finalBlockHeight {
+		m.journal[finalCount] = nil
+		finalCount++
+	}
+
+	m.journal = m.journal[finalCount:]
+	m.finalizedBlock = finalBlockHeight
+
+	if m.current != nil && m.current.ref.Num() <= finalBlockHeight {
+		m.current = nil
+	}
+}
+
+func (m *ReversibleMap[K, V]) record(key K) {
+	if m.current == nil {
+		return
+	}
+
+	previous, existed := m.values[key]
+	m.current.changes = append(m.current.changes, reversibleChange[K, V]{key: key, previous: previous, existed: existed})
+}
+
+// revertFrom reverts, newest first, the changes of every block whose number is equal or above `blockNum`.
+func (m *ReversibleMap[K, V]) revertFrom(blockNum uint64) {
+	for len(m.journal) > 0 && m.journal[len(m.journal)-1].ref.Num() >= blockNum {
+		block := m.journal[len(m.journal)-1]
+		for i := len(block.changes) - 1; i >= 0; i-- {
+			change := block.changes[i]
+			if change.existed {
+				m.values[change.key] = change.previous
+			} else {
+				delete(m.values, change.key)
+			}
+		}
+
+		if block == m.current {
+			m.current = nil
+		}
+
+		m.journal[len(m.journal)-1] = nil
+		m.journal = m.journal[:len(m.journal)-1]
+	}
+}
+
+var _ SinkerHandler = (*ReversibleStateHandler)(nil)
+var _ SinkerFinalityHandler = (*ReversibleStateHandler)(nil)
+var _ SinkerHandlerWrapper = (*ReversibleStateHandler)(nil)
+
+// ReversibleStateHandler is a [SinkerHandler] keeping [Reversible] states in sync with the
+// stream: each state begins the block before the wrapped handler receives it, undo signals
+// are applied to the states before being forwarded and final block height advances, reported
+// through [SinkerFinalityHandler], finalize them.
+//
+// The other extra interfaces implemented by the wrapped handler, like [SinkerCompletionHandler]
+// or [SinkerCommittedCursorHandler], are used by the [Sinker] as if it was given the wrapped
+// handler directly, see [SinkerHandlerWrapper].
+type ReversibleStateHandler struct {
+	handler SinkerHandler
+	states  []Reversible
+}
+
+func NewReversibleStateHandler(handler SinkerHandler, states ...Reversible) *ReversibleStateHandler {
+	return &ReversibleStateHandler{
+		handler: handler,
+		states:  states,
+	}
+}
+
+func (h *ReversibleStateHandler) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+	block := blockToRef(data)
+	for _, state := range h.states {
+		state.BeginBlock(block)
+	}
+
+	return h.handler.HandleBlockScopedData(ctx, data, isLive, cursor)
+}
+
+func (h *ReversibleStateHandler) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	lastValidBlock := asBlockRef(undoSignal.LastValidBlock)
+	for _, state := range h.states {
+		if err := state.Undo(lastValidBlock); err != nil {
+			return err
+		}
+	}
+
+	return h.handler.HandleBlockUndoSignal(ctx, undoSignal, cursor)
+}
+
+func (h *ReversibleStateHandler) HandleFinalBlockHeight(ctx context.Context, finalBlockHeight uint64, block bstream.BlockRef) error {
+	for _, state := range h.states {
+		state.Finalize(finalBlockHeight)
+	}
+
+	if v, ok := extraHandler[SinkerFinalityHandler](h.handler); ok {
+		return v.HandleFinalBlockHeight(ctx, finalBlockHeight, block)
+	}
+
+	return nil
+}
+
+func (h *ReversibleStateHandler) Unwrap() SinkerHandler {
+	return h.handler
+}
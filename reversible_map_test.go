@@ -0,0 +1,131 @@
+package sink
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReversibleMap(t *testing.T) {
+	m := NewReversibleMap[string, int]()
+	m.Set("alice", 10)
+
+	m.BeginBlock(bstream.NewBlockRef("a", 1))
+	m.Update("alice", func(current int, found bool) int { return current + 5 })
+	m.Set("bob", 1)
+
+	m.BeginBlock(bstream.NewBlockRef("a", 2))
+	m.Delete("alice")
+	m.Update("bob", func(current int, found bool) int { return current + 1 })
+	m.Update("bob", func(current int, found bool) int { return current + 1 })
+
+	m.BeginBlock(bstream.NewBlockRef("a", 3))
+	m.Set("carol", 7)
+
+	assert.Equal(t, map[string]int{"bob": 3, "carol": 7}, reversibleMapContent(m))
+	assert.Equal(t, 3, m.JournalLen())
+
+	require.NoError(t, m.Undo(bstream.NewBlockRef("a", 1)))
+	assert.Equal(t, map[string]int{"alice": 15, "bob": 1}, reversibleMapContent(m))
+	assert.Equal(t, 1, m.JournalLen())
+
+	// A block delivered again replaces the changes previously made for it
+	m.BeginBlock(bstream.NewBlockRef("b", 2))
+	m.Set("dave", 1)
+	m.BeginBlock(bstream.NewBlockRef("b", 2))
+	m.Set("erin", 1)
+	assert.Equal(t, map[string]int{"alice": 15, "bob": 1, "erin": 1}, reversibleMapContent(m))
+
+	m.Finalize(1)
+	assert.Equal(t, 1, m.JournalLen())
+
+	require.NoError(t, m.Undo(bstream.NewBlockRef("a", 1)))
+	assert.Equal(t, map[string]int{"alice": 15, "bob": 1}, reversibleMapContent(m))
+
+	m.Finalize(2)
+	assert.EqualError(t, m.Undo(bstream.NewBlockRef("a", 1)), "cannot undo down to last valid block #1 (a), changes up to final block height 2 are not journaled anymore")
+
+	// Changes for blocks already final are not journaled
+	m.BeginBlock(bstream.NewBlockRef("a", 2))
+	m.Set("frank", 1)
+	assert.Equal(t, 0, m.JournalLen())
+}
+
+func TestReversibleStateHandler(t *testing.T) {
+	ctx := context.Background()
+	balances := NewReversibleMap[string, int]()
+
+	var undos []string
+	handler := NewReversibleStateHandler(NewSinkerHandlers(
+		func(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+			balances.Update("alice", func(current int, found bool) int { return current + int(data.Clock.Number) })
+			return nil
+		},
+		func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+			undos = append(undos, asBlockRef(undoSignal.LastValidBlock).String())
+			return nil
+		},
+	), balances)
+
+	for _, id := range []string{"1a", "2a", "3a"} {
+		require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData(id, 0), nil, testCursor(id)))
+	}
+
+	value, _ := balances.Get("alice")
+	assert.Equal(t, 6, value)
+
+	require.NoError(t, handler.HandleBlockUndoSignal(ctx, msgBlockUndoSignal("1a").blockUndoSignal, testCursor("1a")))
+	value, _ = balances.Get("alice")
+	assert.Equal(t, 1, value)
+	assert.Equal(t, []string{"#1 (a)"}, undos)
+
+	require.NoError(t, handler.HandleFinalBlockHeight(ctx, 1, bstream.NewBlockRef("a", 1)))
+	assert.Equal(t, 0, balances.JournalLen())
+}
+
+func TestReversibleStateHandler_WrappedExtraInterfaces(t *testing.T) {
+	ctx := context.Background()
+	recorder := &batchRecorder{}
+	handler := NewReversibleStateHandler(NewBatchingHandler(recorder.flush, WithBatchMaxBlocks(2)), NewReversibleMap[string, int]())
+
+	store := NewInMemoryCursorStore()
+	s := &Sinker{logger: zlog, pkg: &pbsubstreams.Package{}, cursorStore: store}
+
+	for _, id := range []string{"1a", "2a", "3a"} {
+		require.NoError(t, handler.HandleBlockScopedData(ctx, blockScopedData(id, 0), nil, testCursor(id)))
+		require.NoError(t, s.saveCursor(ctx, handler, testCursor(id)))
+	}
+
+	// Only the flushed blocks are covered by the saved cursor
+	record, err := store.Load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, testCursor("2a").String(), record.Cursor.String())
+
+	completion, ok := extraHandler[SinkerCompletionHandler](handler)
+	require.True(t, ok, "completion handler of the wrapped handler should be found")
+	require.NoError(t, completion.HandleBlockRangeCompletion(ctx, testCursor("3a")))
+	assert.Equal(t, []string{"#1 (a),#2 (a)", "#3 (a)"}, recorder.flushes)
+
+	require.NoError(t, s.saveCursor(ctx, handler, testCursor("3a")))
+	record, err = store.Load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, testCursor("3a").String(), record.Cursor.String())
+
+	_, ok = extraHandler[SinkerSessionHandler](handler)
+	assert.False(t, ok, "wrapped handler does not implement SinkerSessionHandler")
+}
+
+func reversibleMapContent[K comparable, V any](m *ReversibleMap[K, V]) map[K]V {
+	out := make(map[K]V, m.Len())
+	m.Range(func(key K, value V) bool {
+		out[key] = value
+		return true
+	})
+
+	return out
+}
@@ -50,17 +50,48 @@ type Sinker struct {
 	tracer           logging.Tracer
 
 	// Options
-	backOff         backoff.BackOff
-	buffer          *blockDataBuffer
-	blockRange      *bstream.Range
-	infiniteRetry   bool
-	finalBlocksOnly bool
-	livenessChecker LivenessChecker
-	extraHeaders    []string
+	backOff           backoff.BackOff
+	backOffFactory    func() backoff.BackOff
+	buffer            *blockDataBuffer
+	blockRange        *bstream.Range
+	infiniteRetry     bool
+	finalBlocksOnly   bool
+	livenessChecker   LivenessChecker
+	extraHeaders      []string
+	cursorStore       CursorStore
+	cursorMismatch    CursorMismatchPolicy
+	prefetch          int
+	endpoints         []*client.SubstreamsClientConfig
+	failoverThreshold int
+	primaryRecheck    time.Duration
+	idleTimeout       time.Duration
+	recordPath        string
+	replayPath        string
+	bufferStatePath   string
+	bufferMaxBytes    int
+	undoOverflow      UndoOverflowPolicy
+	undoOverflowHook  UndoOverflowHook
+	orphanedBlockData bool
+	middlewares       []HandlerMiddleware
+
+	handlerRetryAttempts int
+	handlerRetryBackOff  backoff.BackOff
+	deadLetterStore      DeadLetterStore
+	deadLetterPolicy     DeadLetterPolicy
 
 	// State
 	stats                   *Stats
 	requestActiveStartBlock uint64
+	lastSavedCursor         *Cursor
+	endpointPool            *endpointPool
+	lastIsLive              bool
+	recorder                *responseRecorder
+	bufferStore             *blockDataBufferStore
+	emittedCursor           *Cursor
+	emittedBlocks           *blockHistory
+	endBlockPadding         int
+	lastFinalBlockHeight    uint64
+	deadLetterHighestBlock  *uint64
 }
 
 func New(
@@ -94,11 +125,23 @@ func New(
 		opt(s)
 	}
 
+	if len(s.endpoints) > 0 {
+		s.clientConfig = s.endpoints[0]
+	}
+
+	if s.undoOverflow == UndoOverflowPolicyHook && s.undoOverflowHook == nil {
+		return nil, errors.New("undo overflow policy is Hook but no hook is configured, see WithUndoOverflowHook")
+	}
+
 	if s.finalBlocksOnly && s.buffer != nil {
 		s.logger.Debug("discarding undo buffer since final blocks only requested")
 		s.buffer = nil
 	}
 
+	if s.buffer != nil && s.bufferMaxBytes > 0 {
+		s.buffer.setMaxBytes(s.bufferMaxBytes)
+	}
+
 	s.logger.Info("sinker configured",
 		zap.Stringer("mode", s.mode),
 		zap.Int("module_count", len(s.pkg.Modules.Modules)),
@@ -106,11 +149,22 @@ func New(
 		zap.String("output_module_type", s.outputModule.Output.Type),
 		zap.String("output_module_hash", s.outputModuleHash),
 		zap.Stringer("client_config", (*substramsClientStringer)(s.clientConfig)),
+		zap.Int("endpoint_count", max(len(s.endpoints), 1)),
 		zap.Stringer("buffer", s.buffer),
+		zap.Int("handler_retry_attempts", s.handlerRetryAttempts),
+		zap.Bool("dead_letter", s.deadLetterStore != nil),
+		zap.String("buffer_state_path", s.bufferStatePath),
+		zap.Stringer("undo_overflow_policy", s.undoOverflow),
 		zap.Stringer("block_range", s.blockRange),
 		zap.Bool("infinite_retry", s.infiniteRetry),
 		zap.Bool("final_blocks_only", s.finalBlocksOnly),
 		zap.Bool("liveness_checker", s.livenessChecker != nil),
+		zap.Bool("cursor_store", s.cursorStore != nil),
+		zap.Stringer("cursor_mismatch_policy", s.cursorMismatch),
+		zap.Int("prefetch", s.prefetch),
+		zap.Duration("idle_timeout", s.idleTimeout),
+		zap.String("record_path", s.recordPath),
+		zap.String("replay_path", s.replayPath),
 	)
 
 	return s, nil
@@ -137,7 +191,8 @@ func (s *Sinker) OutputModule() *pbsubstreams.Module {
 }
 
 // OutputModuleHash returns the module output hash, can be used by consumer
-// to warn if the module changed between restart of the process.
+// to warn if the module changed between restart of the process. When a [CursorStore]
+// is configured, the [Sinker] performs this check itself, see [WithCursorMismatchPolicy].
 func (s *Sinker) OutputModuleHash() string {
 	return s.outputModuleHash
 }
@@ -160,7 +215,8 @@ func (s *Sinker) OutputModuleTypeUnprefixed() (unprefixed string) {
 	return
 }
 
-// ClientConfig returns the the `SubstreamsClientConfig`used by this sinker instance.
+// ClientConfig returns the the `SubstreamsClientConfig`used by this sinker instance. When
+// multiple endpoints are configured through [WithEndpoints], the primary one is returned.
 func (s *Sinker) ClientConfig() *client.SubstreamsClientConfig {
 	return s.clientConfig
 }
@@ -184,6 +240,44 @@ func (s *Sinker) Run(ctx context.Context, cursor *Cursor, handler SinkerHandler)
 	})
 	s.stats.OnTerminated(func(err error) { s.Shutdown(err) })
 
+	if s.cursorStore != nil {
+		storedCursor, err := s.loadCursor(ctx, cursor)
+		if err != nil {
+			s.Shutdown(err)
+			return
+		}
+
+		cursor = storedCursor
+	}
+
+	s.emittedCursor = cursor
+	if s.buffer != nil && s.bufferStatePath != "" {
+		streamCursor, replay, err := s.restoreBlockDataBuffer(cursor)
+		if err != nil {
+			s.Shutdown(err)
+			return
+		}
+
+		s.OnTerminating(func(_ error) {
+			if err := s.bufferStore.Close(); err != nil {
+				s.logger.Warn("failed to close persisted block data buffer", zap.String("path", s.bufferStatePath), zap.Error(err))
+			}
+		})
+
+		if len(replay) > 0 {
+			if err := s.emitBlocks(ctx, handler, replay, blockToRef(replay[len(replay)-1])); err != nil {
+				s.Shutdown(fmt.Errorf("emit restored blocks: %w", err))
+				return
+			}
+		}
+
+		cursor = streamCursor
+	}
+
+	if s.buffer != nil {
+		UndoBufferCapacity.SetUint64(uint64(s.buffer.Capacity()))
+	}
+
 	logEach := 15 * time.Second
 	if s.logger.Core().Enabled(zap.DebugLevel) {
 		logEach = 5 * time.Second
@@ -204,7 +298,7 @@ func (s *Sinker) Run(ctx context.Context, cursor *Cursor, handler SinkerHandler)
 	if err == nil {
 		s.logger.Info("substreams ended correctly, reached your stop block", zap.Stringer("last_block_seen", lastCursor.Block()))
 
-		if v, ok := handler.(SinkerCompletionHandler); ok {
+		if v, ok := extraHandler[SinkerCompletionHandler](handler); ok {
 			s.logger.Info("substreams handler has completion callback defined, calling it")
 
 			if err := v.HandleBlockRangeCompletion(ctx, lastCursor); err != nil {
@@ -212,6 +306,14 @@ func (s *Sinker) Run(ctx context.Context, cursor *Cursor, handler SinkerHandler)
 				return
 			}
 		}
+
+		// Handlers persisting data at their own pace might have committed more data on completion
+		if _, ok := extraHandler[SinkerCommittedCursorHandler](handler); ok {
+			if err := s.saveCursor(ctx, handler, lastCursor); err != nil {
+				s.Shutdown(err)
+				return
+			}
+		}
 	}
 
 	// If the context is canceled and we are here, it we have stop running without any other error, so Shutdown without error,
@@ -227,31 +329,40 @@ func (s *Sinker) Run(ctx context.Context, cursor *Cursor, handler SinkerHandler)
 func (s *Sinker) run(ctx context.Context, cursor *Cursor, handler SinkerHandler) (activeCursor *Cursor, err error) {
 	activeCursor = cursor
 
-	ssClient, closeFunc, callOpts, headers, err := client.NewSubstreamsClient(s.clientConfig)
-
-	if err != nil {
-		return activeCursor, fmt.Errorf("new substreams client: %w", err)
+	endpoints := s.endpoints
+	if len(endpoints) == 0 {
+		endpoints = []*client.SubstreamsClientConfig{s.clientConfig}
 	}
-	s.OnTerminating(func(_ error) { closeFunc() })
 
-	var headersArray []string
+	pool := newEndpointPool(endpoints, s.extraHeaders, s.failoverThreshold, s.primaryRecheck, s.logger)
+	s.OnTerminating(func(_ error) { pool.Close() })
+	s.endpointPool = pool
 
-	if len(s.extraHeaders) > 0 || headers != nil {
-		if headers == nil {
-			headers = make(client.Headers)
+	if s.replayPath != "" {
+		s.logger.Info("replaying recorded stream instead of connecting to endpoint", zap.String("path", s.replayPath))
+		for i := range endpoints {
+			pool.setClient(i, &replayStreamClient{path: s.replayPath})
 		}
+	}
 
-		for k, v := range parseHeaders(s.extraHeaders) {
-			headers[k] = v
+	if s.recordPath != "" {
+		recorder, err := newResponseRecorder(s.recordPath)
+		if err != nil {
+			return activeCursor, err
 		}
 
-		headersArray = make([]string, 0, len(headers)*2)
-		for k, v := range parseHeaders(s.extraHeaders) {
-			headersArray = append(headersArray, k, v)
-		}
+		s.OnTerminating(func(_ error) {
+			if err := recorder.Close(); err != nil {
+				s.logger.Warn("failed to close stream recording", zap.String("path", s.recordPath), zap.Error(err))
+			}
+		})
+		s.recorder = recorder
+	}
 
-		for k, v := range headers {
-			headersArray = append(headersArray, k, v)
+	if _, ok := extraHandler[SinkerOrphanedBlocksHandler](handler); ok && s.buffer == nil && !s.finalBlocksOnly {
+		s.emittedBlocks = newBlockHistory(s.orphanedBlockData)
+		if !cursor.IsBlank() {
+			s.emittedBlocks.markUntrackedUpTo(cursor.Block().Num())
 		}
 	}
 
@@ -268,6 +379,10 @@ func (s *Sinker) run(ctx context.Context, cursor *Cursor, handler SinkerHandler)
 
 	startBlock := s.BlockRange().StartBlock()
 	stopBlock := s.adjustedEndBlock()
+	if s.buffer != nil {
+		s.endBlockPadding = s.buffer.Capacity()
+	}
+	reconnectAttempt := 0
 
 	for {
 		req := &pbsubstreamsrpc.Request{
@@ -280,18 +395,25 @@ func (s *Sinker) run(ctx context.Context, cursor *Cursor, handler SinkerHandler)
 			ProductionMode:  s.mode == SubstreamsModeProduction,
 		}
 
+		endpoint, err := s.endpointPool.Active()
+		if err != nil {
+			return activeCursor, fmt.Errorf("new substreams client: %w", err)
+		}
+
 		// Add extra headers if set
 		streamCtx := ctx
-		if len(headersArray) > 0 {
-			streamCtx = metadata.AppendToOutgoingContext(streamCtx, headersArray...)
+		if len(endpoint.headers) > 0 {
+			streamCtx = metadata.AppendToOutgoingContext(streamCtx, endpoint.headers...)
 		}
 
 		var receivedMessage bool
-		activeCursor, receivedMessage, err = s.doRequest(streamCtx, activeCursor, req, ssClient, callOpts, handler)
+		activeCursor, receivedMessage, err = s.doRequest(streamCtx, activeCursor, req, endpoint.client, endpoint.callOpts, handler)
 
 		// If we received at least one message, we must reset the backoff
 		if receivedMessage {
 			backOff.Reset()
+			s.endpointPool.RecordSuccess()
+			reconnectAttempt = 0
 		}
 
 		if err != nil {
@@ -309,19 +431,44 @@ func (s *Sinker) run(ctx context.Context, cursor *Cursor, handler SinkerHandler)
 				return activeCursor, nil
 			}
 
+			if errors.Is(err, errReturnToPrimaryEndpoint) {
+				s.endpointPool.ReturnToPrimary()
+				continue
+			}
+
 			// Retryable or not, we increment the error counter in all those cases
 			SubstreamsErrorCount.Inc()
 
 			var retryableError *derr.RetryableError
-			if errors.As(err, &retryableError) {
-				s.logger.Error("substreams encountered a retryable error", zap.Error(retryableError.Unwrap()))
+			var retryExhausted *HandlerRetryExhaustedError
+			if errors.As(err, &retryableError) && !errors.As(err, &retryExhausted) {
+				s.logger.Error("substreams encountered a retryable error", zap.Error(retryableError.Unwrap()), zap.String("endpoint", s.endpointPool.ActiveConfig().Endpoint()))
+
+				// The cursor is kept as-is when failing over, the next endpoint resumes from it
+				s.endpointPool.RecordFailure()
 
 				sleepFor := backOff.NextBackOff()
 				if sleepFor == backoff.Stop {
 					return activeCursor, fmt.Errorf("%w: %w", ErrBackOffExpired, retryableError.Unwrap())
 				}
 
+				if v, ok := extraHandler[SinkerReconnectHandler](handler); ok {
+					reconnectAttempt++
+
+					err := v.HandleReconnect(ctx, &ReconnectEvent{
+						Err:      retryableError.Unwrap(),
+						Attempt:  reconnectAttempt,
+						Delay:    sleepFor,
+						Cursor:   activeCursor,
+						Endpoint: s.endpointPool.ActiveConfig().Endpoint(),
+					})
+					if err != nil {
+						return activeCursor, fmt.Errorf("handle reconnect: %w", err)
+					}
+				}
+
 				s.logger.Info("sleeping before re-connecting", zap.Duration("sleep", sleepFor))
+				StreamReconnectCount.Inc()
 				time.Sleep(sleepFor)
 			} else {
 				// Let's not wrap the error, it's not retryable to user will see directly his own error
@@ -362,19 +509,53 @@ func (s *Sinker) doRequest(
 	s.logger.Debug("launching substreams request", zap.Int64("start_block", req.StartBlockNum), zap.Stringer("cursor", activeCursor))
 	receivedMessage := false
 
-	stream, err := ssClient.Blocks(ctx, req, callOpts...)
+	// The stream is bound to its own context so that it's closed, along with any goroutine
+	// receiving from it, as soon as we return
+	streamCtx, cancelStream := context.WithCancel(ctx)
+	defer cancelStream()
+
+	stream, err := ssClient.Blocks(streamCtx, req, callOpts...)
 	if err != nil {
 		return activeCursor, receivedMessage, retryable(fmt.Errorf("call sf.substreams.rpc.v2.Stream/Blocks: %w", err))
 	}
 
+	if s.recorder != nil {
+		if err := s.recorder.RecordConnection(req); err != nil {
+			return activeCursor, receivedMessage, fmt.Errorf("record connection: %w", err)
+		}
+	}
+
+	receive := stream.Recv
+
+	var idle *idleWatcher
+	if s.idleTimeout > 0 {
+		idle = newIdleWatcher(s.idleTimeout, cancelStream)
+		defer idle.Stop()
+
+		receive = idle.wrap(receive)
+	}
+
+	if s.prefetch > 0 {
+		receive = s.prefetchResponses(streamCtx, receive)
+	}
+
 	for {
 		if s.tracer.Enabled() {
 			s.logger.Debug("substreams waiting to receive message", zap.Stringer("cursor", activeCursor))
 		}
 
-		resp, err := stream.Recv()
+		resp, err := receive()
 		if err != nil {
+			if idle != nil && idle.Stalled() {
+				StreamStallCount.Inc()
+				return activeCursor, receivedMessage, retryable(fmt.Errorf("%w: no message received for %s", ErrStreamStalled, s.idleTimeout))
+			}
+
 			if errors.Is(err, io.EOF) {
+				if err := s.flushBufferBeforeEndBlock(ctx, handler, activeCursor); err != nil {
+					return s.resumeCursorAfterError(), receivedMessage, err
+				}
+
 				return activeCursor, receivedMessage, err
 			}
 
@@ -395,6 +576,12 @@ func (s *Sinker) doRequest(
 		receivedMessage = true
 		MessageSizeBytes.AddInt(proto.Size(resp))
 
+		if s.recorder != nil {
+			if err := s.recorder.Record(resp); err != nil {
+				return activeCursor, receivedMessage, fmt.Errorf("record response: %w", err)
+			}
+		}
+
 		switch r := resp.Message.(type) {
 		case *pbsubstreamsrpc.Response_Progress:
 			msg := r.Progress
@@ -444,6 +631,12 @@ func (s *Sinker) doRequest(
 				s.logger.Debug("received response Progress", zap.Reflect("progress", r))
 			}
 
+			if v, ok := extraHandler[SinkerProgressHandler](handler); ok {
+				if err := v.HandleProgress(ctx, newProgress(msg, totalProcessedBlocks)); err != nil {
+					return activeCursor, receivedMessage, fmt.Errorf("handle Progress message: %w", err)
+				}
+			}
+
 		case *pbsubstreamsrpc.Response_BlockScopedData:
 			block := bstream.NewBlockRef(r.BlockScopedData.Clock.Id, r.BlockScopedData.Clock.Number)
 			moduleOutput := r.BlockScopedData.Output
@@ -472,29 +665,27 @@ func (s *Sinker) doRequest(
 				// No buffering, process directly
 				dataToProcess = []*pbsubstreamsrpc.BlockScopedData{r.BlockScopedData}
 			} else {
+				evictions := s.buffer.maxBytesEvictions
 				dataToProcess, err = s.buffer.HandleBlockScopedData(r.BlockScopedData)
 				if err != nil {
 					return activeCursor, receivedMessage, fmt.Errorf("buffer add block data: %w", err)
 				}
-			}
 
-			for _, blockScopedData := range dataToProcess {
-				currentCursor, err := NewCursor(blockScopedData.Cursor)
-				if err != nil {
-					return activeCursor, receivedMessage, fmt.Errorf("invalid received cursor, 'bstream' library in here is probably not up to date: %w", err)
+				if evictions == 0 && s.buffer.maxBytesEvictions > 0 {
+					s.logger.Warn("undo buffer byte cap reached, non-final blocks are emitted as if they were final, forks reverting them will overflow the buffer, further occurrences are only counted in metrics",
+						zap.Int("max_bytes", s.buffer.maxBytes),
+						zap.Int("buffered_blocks", s.buffer.Len()),
+						zap.Int("capacity", s.buffer.Capacity()),
+					)
 				}
+			}
 
-				var isLive *bool
-				if s.livenessChecker != nil {
-					isLive = &blockNotLive
-					if s.livenessChecker.IsLive(blockScopedData.Clock) {
-						isLive = &liveBlock
-					}
-				}
+			if err := s.emitBlocks(ctx, handler, dataToProcess, block); err != nil {
+				return s.resumeCursorAfterError(), receivedMessage, err
+			}
 
-				if err := handler.HandleBlockScopedData(ctx, blockScopedData, isLive, currentCursor); err != nil {
-					return activeCursor, receivedMessage, fmt.Errorf("handle BlockScopedData message at block %s: %w", block, err)
-				}
+			if err := s.persistBlockDataBuffer(activeCursor); err != nil {
+				return activeCursor, receivedMessage, err
 			}
 
 		case *pbsubstreamsrpc.Response_BlockUndoSignal:
@@ -510,6 +701,7 @@ func (s *Sinker) doRequest(
 				return activeCursor, receivedMessage, fmt.Errorf("invalid received cursor, 'bstream' library in here is probably not up to date: %w", err)
 			}
 
+			retryCursor := activeCursor
 			activeCursor = cursor
 
 			// We record our stats before the buffer action, so user sees state of "stream" and not state of buffer
@@ -519,19 +711,40 @@ func (s *Sinker) doRequest(
 			// We don't have the block time in undo case for now, so we don't change it
 
 			if s.buffer == nil {
-				if err := handler.HandleBlockUndoSignal(ctx, r.BlockUndoSignal, activeCursor); err != nil {
-					return activeCursor, receivedMessage, fmt.Errorf("handle BlockUndoSignal: %w", err)
+				if err := s.dropRevertedDeadLetters(ctx, asBlockRef(r.BlockUndoSignal.LastValidBlock)); err != nil {
+					return retryCursor, receivedMessage, err
+				}
+
+				if err := s.handleBlockUndoSignal(ctx, handler, r.BlockUndoSignal, activeCursor); err != nil {
+					return retryCursor, receivedMessage, fmt.Errorf("handle BlockUndoSignal: %w", err)
+				}
+
+				s.emittedCursor = activeCursor
+				if err := s.saveCursor(ctx, handler, activeCursor); err != nil {
+					return activeCursor, receivedMessage, err
 				}
 			} else {
 				// In the case of dealing with an undo buffer, it's expected that a fork will never
 				// go beyong the first block in the buffer because if it does, `s.buffer.HandleBlockUndoSignal` here
-				// returns an error.
+				// returns an [UndoOverflowError].
 				//
-				// This means ultimately that we expect to never call the downstream `BlockUndoSignalHandler` function.
+				// This means ultimately that we expect to never call the downstream `BlockUndoSignalHandler` function
+				// unless the [UndoOverflowPolicy] is [UndoOverflowPolicyForward].
 				err = s.buffer.HandleBlockUndoSignal(r.BlockUndoSignal)
-				if err != nil {
+				UndoBufferCapacity.SetUint64(uint64(s.buffer.Capacity()))
+
+				var overflowErr *UndoOverflowError
+				if errors.As(err, &overflowErr) && s.undoOverflow != UndoOverflowPolicyFail {
+					if err := s.handleUndoOverflow(ctx, handler, overflowErr, r.BlockUndoSignal, activeCursor); err != nil {
+						return retryCursor, receivedMessage, err
+					}
+				} else if err != nil {
 					return activeCursor, receivedMessage, fmt.Errorf("buffer undo block: %w", err)
 				}
+
+				if err := s.persistBlockDataBuffer(activeCursor); err != nil {
+					return activeCursor, receivedMessage, err
+				}
 			}
 
 		case *pbsubstreamsrpc.Response_DebugSnapshotData, *pbsubstreamsrpc.Response_DebugSnapshotComplete:
@@ -546,11 +759,288 @@ func (s *Sinker) doRequest(
 			)
 			s.requestActiveStartBlock = r.Session.ResolvedStartBlock
 
+			if v, ok := extraHandler[SinkerSessionHandler](handler); ok {
+				if err := v.HandleSession(ctx, newSession(r.Session)); err != nil {
+					return activeCursor, receivedMessage, fmt.Errorf("handle Session message: %w", err)
+				}
+			}
+
 		default:
 			s.logger.Info("received unknown type of message", zap.Reflect("message", r))
 			UnknownMessageCount.Inc()
 		}
+
+		// Message is fully processed, it's safe to end the stream here, we resume from `activeCursor`
+		if s.endpointPool != nil && s.endpointPool.ShouldReturnToPrimary() {
+			return activeCursor, receivedMessage, errReturnToPrimaryEndpoint
+		}
+	}
+}
+
+// handleBlockUndoSignal forwards an undo signal to the handler, with the blocks it reverts when
+// the handler implements [SinkerOrphanedBlocksHandler].
+func (s *Sinker) handleBlockUndoSignal(ctx context.Context, handler SinkerHandler, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	v, ok := extraHandler[SinkerOrphanedBlocksHandler](handler)
+	if !ok || s.emittedBlocks == nil {
+		return s.callHandler(ctx, newBlockUndoSignalCall(undoSignal, cursor), func(ctx context.Context) error {
+			return handler.HandleBlockUndoSignal(ctx, undoSignal, cursor)
+		})
+	}
+
+	orphaned, truncated := s.emittedBlocks.Undo(asBlockRef(undoSignal.LastValidBlock))
+	err := s.callHandler(ctx, newBlockUndoSignalCall(undoSignal, cursor), func(ctx context.Context) error {
+		return v.HandleOrphanedBlocks(ctx, undoSignal, orphaned, truncated, cursor)
+	})
+	if err != nil {
+		// The undo signal is received again after reconnection, the blocks must be reported again
+		s.emittedBlocks.restore(orphaned)
+		return err
 	}
+
+	return nil
+}
+
+// handleUndoOverflow deals with an undo signal reverting blocks already emitted by the buffer
+// according to the configured [UndoOverflowPolicy]. The buffer is reset to the last valid block
+// only once the undo has been successfully dealt with so that it's retried on error.
+func (s *Sinker) handleUndoOverflow(ctx context.Context, handler SinkerHandler, overflowErr *UndoOverflowError, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	s.logger.Warn("undo signal reverts blocks already emitted by the undo buffer, consider increasing its size",
+		zap.Stringer("last_valid_block", overflowErr.LastValidBlock),
+		zap.Stringer("last_emitted_block", overflowErr.LastEmittedBlock),
+		zap.Stringer("policy", s.undoOverflow),
+	)
+	UndoOverflowCount.Inc()
+
+	if err := s.dropRevertedDeadLetters(ctx, overflowErr.LastValidBlock); err != nil {
+		return err
+	}
+
+	switch s.undoOverflow {
+	case UndoOverflowPolicyForward:
+		if err := s.handleBlockUndoSignal(ctx, handler, undoSignal, cursor); err != nil {
+			return fmt.Errorf("handle BlockUndoSignal: %w", err)
+		}
+
+	case UndoOverflowPolicyHook:
+		if err := s.undoOverflowHook(ctx, overflowErr, undoSignal, cursor); err != nil {
+			return fmt.Errorf("undo overflow hook: %w", err)
+		}
+	}
+
+	s.buffer.forceUndo(overflowErr.LastValidBlock)
+
+	if err := s.saveCursor(ctx, handler, cursor); err != nil {
+		return err
+	}
+
+	s.emittedCursor = cursor
+	return nil
+}
+
+// emitBlocks delivers `blocks`, emitted by the buffer or received directly from the stream, to
+// the handler, `block` being the block received from the stream.
+func (s *Sinker) emitBlocks(ctx context.Context, handler SinkerHandler, blocks []*pbsubstreamsrpc.BlockScopedData, block bstream.BlockRef) error {
+	for _, blockScopedData := range blocks {
+		currentCursor, err := NewCursor(blockScopedData.Cursor)
+		if err != nil {
+			return fmt.Errorf("invalid received cursor, 'bstream' library in here is probably not up to date: %w", err)
+		}
+
+		var isLive *bool
+		if s.livenessChecker != nil {
+			isLive = &blockNotLive
+			if s.livenessChecker.IsLive(blockScopedData.Clock) {
+				isLive = &liveBlock
+			}
+
+			if err := s.handleLivenessChange(ctx, handler, *isLive, blockScopedData); err != nil {
+				return err
+			}
+		}
+
+		deadLettered, err := s.handleBlockScopedData(ctx, handler, blockScopedData, isLive, currentCursor)
+		if err != nil {
+			return fmt.Errorf("handle BlockScopedData message at block %s: %w", block, err)
+		}
+
+		// A dead-lettered block was never processed by the handler, it must not be reported as orphaned
+		s.emittedCursor = currentCursor
+		if s.emittedBlocks != nil && !deadLettered && s.emittedBlocks.Record(blockScopedData) {
+			s.logger.Warn("final block height is not advancing, oldest blocks handled are not tracked anymore, undo signals reverting them are reported as truncated",
+				zap.Int("max_tracked_blocks", maxBlockHistorySize),
+				zap.Uint64("final_block_height", blockScopedData.FinalBlockHeight),
+			)
+		}
+
+		if err := s.saveCursor(ctx, handler, currentCursor); err != nil {
+			return err
+		}
+
+		if err := s.handleFinalBlockHeight(ctx, handler, blockScopedData); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flushBufferBeforeEndBlock emits the blocks of the range still buffered once the stream reached
+// its end. The request's end block is padded by the buffer's capacity when the stream starts but an
+// adaptive buffer can grow afterwards, keeping blocks of the range buffered that a buffer of the
+// original capacity would have emitted. Only those are emitted, the last `endBlockPadding` blocks
+// are kept buffered like they are with a fixed size buffer.
+func (s *Sinker) flushBufferBeforeEndBlock(ctx context.Context, handler SinkerHandler, streamCursor *Cursor) error {
+	if s.buffer == nil || s.blockRange == nil || s.blockRange.EndBlock() == nil {
+		return nil
+	}
+
+	blocks := s.buffer.popInRange(s.blockRange, s.endBlockPadding)
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	s.logger.Debug("emitting blocks kept buffered by the buffer growth", zap.Int("block_count", len(blocks)), zap.Stringer("block_range", s.blockRange), zap.Int("padding", s.endBlockPadding))
+	if err := s.emitBlocks(ctx, handler, blocks, blockToRef(blocks[len(blocks)-1])); err != nil {
+		return err
+	}
+
+	return s.persistBlockDataBuffer(streamCursor)
+}
+
+// resumeCursorAfterError returns the cursor to reconnect from when the handling of the blocks
+// received fails, which is the cursor of the last block successfully emitted to the handler.
+// Buffered blocks are discarded since they are streamed again from there.
+func (s *Sinker) resumeCursorAfterError() *Cursor {
+	if s.buffer != nil {
+		var lastEmittedBlock bstream.BlockRef
+		if !s.emittedCursor.IsBlank() {
+			lastEmittedBlock = s.emittedCursor.Block()
+		}
+
+		s.buffer.forceUndo(lastEmittedBlock)
+	}
+
+	return s.emittedCursor
+}
+
+// handleLivenessChange notifies the handler, if it implements [SinkerLivenessHandler], when
+// `isLive` differs from the liveness of the previous block.
+func (s *Sinker) handleLivenessChange(ctx context.Context, handler SinkerHandler, isLive bool, data *pbsubstreamsrpc.BlockScopedData) error {
+	if isLive == s.lastIsLive {
+		return nil
+	}
+
+	if v, ok := extraHandler[SinkerLivenessHandler](handler); ok {
+		block := blockToRef(data)
+		if err := v.HandleLivenessChange(ctx, isLive, block); err != nil {
+			return fmt.Errorf("handle liveness change at block %s: %w", block, err)
+		}
+	}
+
+	s.lastIsLive = isLive
+	return nil
+}
+
+// handleFinalBlockHeight notifies the handler, if it implements [SinkerFinalityHandler], when
+// the final block height of `data` is higher than the one previously notified.
+func (s *Sinker) handleFinalBlockHeight(ctx context.Context, handler SinkerHandler, data *pbsubstreamsrpc.BlockScopedData) error {
+	if data.FinalBlockHeight <= s.lastFinalBlockHeight {
+		return nil
+	}
+
+	if v, ok := extraHandler[SinkerFinalityHandler](handler); ok {
+		block := blockToRef(data)
+		if err := v.HandleFinalBlockHeight(ctx, data.FinalBlockHeight, block); err != nil {
+			return fmt.Errorf("handle final block height %d at block %s: %w", data.FinalBlockHeight, block, err)
+		}
+	}
+
+	s.lastFinalBlockHeight = data.FinalBlockHeight
+	return nil
+}
+
+// loadCursor loads the [CursorRecord] from the configured [CursorStore] and validates that it
+// was produced by the currently configured module, applying the [CursorMismatchPolicy] if it's
+// not the case. The `fallback` cursor is returned if the store is empty.
+func (s *Sinker) loadCursor(ctx context.Context, fallback *Cursor) (*Cursor, error) {
+	record, err := s.cursorStore.Load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("load cursor from store: %w", err)
+	}
+
+	if record == nil || record.Cursor.IsBlank() {
+		return fallback, nil
+	}
+
+	mismatches := record.mismatches(s.cursorRecord(record.Cursor))
+	if len(mismatches) == 0 {
+		return record.Cursor, nil
+	}
+
+	fields := []zap.Field{
+		zap.Stringer("cursor_block", record.Cursor.Block()),
+		zap.Strings("mismatches", mismatches),
+		zap.String("stored_package_version", record.PackageVersion),
+	}
+
+	switch s.cursorMismatch {
+	case CursorMismatchPolicyWarn:
+		s.logger.Warn("stored cursor was produced by a different module, resuming anyway, data from both modules will be mixed", fields...)
+		return record.Cursor, nil
+
+	case CursorMismatchPolicyRestart:
+		s.logger.Warn("stored cursor was produced by a different module, discarding it and restarting from block range start", fields...)
+		if err := s.cursorStore.Delete(ctx); err != nil {
+			return nil, fmt.Errorf("delete mismatched cursor from store: %w", err)
+		}
+
+		return NewBlankCursor(), nil
+
+	default:
+		return nil, fmt.Errorf("%w: stored cursor at block %s has %s", ErrCursorMismatch, record.Cursor.Block(), strings.Join(mismatches, ", "))
+	}
+}
+
+// cursorRecord returns a [CursorRecord] for the received cursor bound to the module
+// currently configured on this [Sinker].
+func (s *Sinker) cursorRecord(cursor *Cursor) *CursorRecord {
+	record := &CursorRecord{
+		Cursor:           cursor,
+		OutputModuleHash: s.outputModuleHash,
+		Network:          s.pkg.Network,
+	}
+
+	if len(s.pkg.PackageMeta) > 0 {
+		record.PackageName = s.pkg.PackageMeta[0].Name
+		record.PackageVersion = s.pkg.PackageMeta[0].Version
+	}
+
+	return record
+}
+
+// saveCursor persists the cursor in the configured [CursorStore], if any. It must only be
+// called once the handler has successfully processed the message the cursor points to.
+//
+// If the handler implements [SinkerCommittedCursorHandler], its committed cursor is saved
+// instead of the received one.
+func (s *Sinker) saveCursor(ctx context.Context, handler SinkerHandler, cursor *Cursor) error {
+	if s.cursorStore == nil {
+		return nil
+	}
+
+	if v, ok := extraHandler[SinkerCommittedCursorHandler](handler); ok {
+		cursor = v.CommittedCursor()
+		if cursor.IsBlank() || cursor == s.lastSavedCursor {
+			return nil
+		}
+	}
+
+	if err := s.cursorStore.Save(ctx, s.cursorRecord(cursor)); err != nil {
+		return fmt.Errorf("save cursor at block %s: %w", cursor.Block(), err)
+	}
+
+	s.lastSavedCursor = cursor
+	return nil
 }
 
 func stageString(i uint32) string {
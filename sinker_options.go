@@ -1,8 +1,11 @@
 package sink
 
 import (
+	"time"
+
 	"github.com/cenkalti/backoff/v4"
 	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/substreams/client"
 )
 
 type Option func(s *Sinker)
@@ -25,6 +28,59 @@ func WithBlockDataBuffer(bufferSize int) Option {
 	}
 }
 
+// WithAdaptiveBlockDataBuffer creates a buffer of block data like [WithBlockDataBuffer] starting
+// with a capacity of `initialSize` blocks that grows automatically, up to `maxSize` blocks, as
+// reorganizations are observed. Each time an undo signal reverts more than half the current
+// capacity, the capacity is doubled relative to the reorganization depth, never exceeding the
+// distance between the head block and the final block height reported by the server since final
+// blocks are never reverted.
+//
+// The current capacity and the deepest reorganization observed are exposed through the
+// `substreams_sink_undo_buffer_capacity` and `substreams_sink_undo_max_observed_depth` metrics.
+func WithAdaptiveBlockDataBuffer(initialSize int, maxSize int) Option {
+	return func(s *Sinker) {
+		if initialSize == 0 {
+			s.buffer = nil
+		} else {
+			s.buffer = newAdaptiveBlockDataBuffer(initialSize, max(initialSize, maxSize))
+		}
+	}
+}
+
+// WithPersistentBlockDataBuffer creates a buffer of block data like [WithBlockDataBuffer] whose
+// content is saved to the file at `path` each time it changes, along with the cursor of the last
+// message received from the stream.
+//
+// On startup, if the file was saved while streaming the same output module from the cursor the
+// [Sinker] starts from, the buffer is restored and the stream resumes from the newest received
+// cursor instead of re-streaming the buffered blocks. The cursor the [Sinker] starts from can be
+// older than the last block emitted to your handler when it implements [SinkerCommittedCursorHandler],
+// the blocks emitted after it are kept in the file and emitted again before resuming the stream.
+// Otherwise, the file is ignored and the buffer is rebuilt from the stream.
+//
+// Only the changes are appended, with fsync, to the file after each message, the whole buffer is
+// written again once as many changes as the buffer's capacity were appended or after an undo.
+func WithPersistentBlockDataBuffer(bufferSize int, path string) Option {
+	return func(s *Sinker) {
+		WithBlockDataBuffer(bufferSize)(s)
+		s.bufferStatePath = path
+	}
+}
+
+// WithBlockDataBufferMaxBytes caps the total size, in bytes, of the blocks held by the buffer
+// configured through [WithBlockDataBuffer], [WithAdaptiveBlockDataBuffer] or [WithPersistentBlockDataBuffer].
+// Once adding a block would exceed `maxBytes`, the oldest blocks are considered final and emitted
+// like when the buffer is full, so a small cap reduces the depth of the forks the buffer can absorb.
+// The first time it happens a warning is logged, each block emitted that way is counted by the
+// `substreams_sink_undo_buffer_max_bytes_eviction` metric.
+//
+// It has no effect if no buffer is configured.
+func WithBlockDataBufferMaxBytes(maxBytes int) Option {
+	return func(s *Sinker) {
+		s.bufferMaxBytes = maxBytes
+	}
+}
+
 // WithInfiniteRetry remove the maximum retry limit of 15 (hard-coded right now)
 // which spans approximatively 5m so that retry is perform indefinitely without
 // never exiting the process.
@@ -53,6 +109,57 @@ func WithFinalBlocksOnly() Option {
 func WithRetryBackOff(backOff backoff.BackOff) Option {
 	return func(s *Sinker) {
 		s.backOff = backOff
+		s.backOffFactory = nil
+	}
+}
+
+// WithRetryBackOffFactory is like [WithRetryBackOff] but receives a factory returning a new
+// back off each time it's called. It's required by [ParallelBackfill], which gives each
+// derived [Sinker] its own back off, when the back off is not one of the standard types
+// of the `backoff` package, which are copied instead.
+func WithRetryBackOffFactory(factory func() backoff.BackOff) Option {
+	return func(s *Sinker) {
+		s.backOff = factory()
+		s.backOffFactory = factory
+	}
+}
+
+// WithHandlerRetry configures the [Sinker] instance to retry, in place, a `HandleBlockScopedData` or
+// `HandleBlockUndoSignal` call of its handler that returned a retryable error (see `derr.NewRetryableError`),
+// up to `maxAttempts` attempts in total, waiting between attempts according to `backOff` (immediately if
+// nil). The stream is kept open while retrying, unlike stream errors which reconnect according to
+// [WithRetryBackOff].
+//
+// Once `maxAttempts` is reached, or `backOff` stops, the [Sinker] terminates with a [HandlerRetryExhaustedError]
+// wrapping the last error returned through the middleware chain.
+// When configured, the [HandlerMiddleware] chain is performed again for each attempt.
+func WithHandlerRetry(maxAttempts int, backOff backoff.BackOff) Option {
+	if backOff == nil {
+		backOff = &backoff.ZeroBackOff{}
+	}
+
+	return func(s *Sinker) {
+		s.handlerRetryAttempts = maxAttempts
+		s.handlerRetryBackOff = backOff
+	}
+}
+
+// WithDeadLetter configures the [Sinker] instance to skip a block that `HandleBlockScopedData` keeps
+// failing to process instead of terminating. Once the handler failed `policy.MaxAttempts` times for
+// the block, the block data, the error and the block's cursor are appended to `store` and the stream
+// advances to the next block, the cursor of the skipped block being saved like for a handled one.
+//
+// Dead-lettered blocks can be re-driven through the handler later on with [RedriveDeadLetters].
+// A dead-lettered block reverted by an undo signal is removed from `store` since it's not part of
+// the chain anymore, the block of the new branch being streamed like any other block. It's also
+// never reported to a [SinkerOrphanedBlocksHandler] since the handler did not process it.
+// Undo signals are never dead-lettered, a failing `HandleBlockUndoSignal` call still terminates the
+// [Sinker]. A handler relying on each block being processed in sequence, for example to maintain
+// state across blocks, must account for the gaps left by the skipped blocks.
+func WithDeadLetter(store DeadLetterStore, policy DeadLetterPolicy) Option {
+	return func(s *Sinker) {
+		s.deadLetterStore = store
+		s.deadLetterPolicy = policy
 	}
 }
 
@@ -82,3 +189,166 @@ func WithExtraHeaders(headers []string) Option {
 		s.extraHeaders = headers
 	}
 }
+
+// WithCursorStore configures the [Sinker] instance to load its starting cursor from the
+// given [CursorStore] and to save the cursor back to it each time the handler successfully
+// processed a [pbsubstreamsrpc.BlockScopedData] or a [pbsubstreamsrpc.BlockUndoSignal].
+//
+// When the store contains a cursor, it takes precedence over the cursor passed to [Sinker.Run],
+// the latter being used only when the store is empty.
+func WithCursorStore(store CursorStore) Option {
+	return func(s *Sinker) {
+		s.cursorStore = store
+	}
+}
+
+// WithCursorMismatchPolicy configures what the [Sinker] does when the [CursorRecord] loaded
+// from the [CursorStore] (see [WithCursorStore]) was produced by a different module than the
+// one currently configured, which happens when the module's code, its params or the network
+// changed between two runs.
+//
+// The default policy is [CursorMismatchPolicyFail] which terminates the [Sinker] with an
+// error wrapping [ErrCursorMismatch], preventing data from two different module versions
+// to be mixed together. [CursorMismatchPolicyWarn] logs a warning and resumes from the
+// stored cursor while [CursorMismatchPolicyRestart] deletes the stored cursor and starts
+// over from the block range start.
+func WithCursorMismatchPolicy(policy CursorMismatchPolicy) Option {
+	return func(s *Sinker) {
+		s.cursorMismatch = policy
+	}
+}
+
+// WithPrefetch configures the [Sinker] instance to receive messages from the Substreams stream
+// in a dedicated goroutine that keeps up to `count` received messages in a queue while your
+// handler processes them, in order. This prevents a slow handler from stalling the gRPC stream
+// which can lead to disconnections from the server side. When the queue is full, receiving is
+// paused until the handler catches up.
+//
+// Messages still in the queue when the stream is interrupted are discarded, the [Sinker]
+// reconnects from the cursor of the last message your handler processed so nothing is lost.
+//
+// A `count` of 0 disables prefetching, which is the default.
+func WithPrefetch(count int) Option {
+	return func(s *Sinker) {
+		s.prefetch = count
+	}
+}
+
+// WithEndpoints configures the [Sinker] instance to stream from an ordered list of Substreams
+// endpoints instead of the single `SubstreamsClientConfig` received by [New], which is then
+// ignored. The first endpoint is the primary one.
+//
+// After a number of consecutive failures on the active endpoint (see [WithEndpointFailover]),
+// the [Sinker] fails over to the next endpoint in the list, resuming from the cursor of the
+// last processed message. Once a secondary endpoint has been in use for a while, the [Sinker]
+// ends the stream between two messages and reconnects to the primary endpoint. If the primary
+// endpoint fails over again before delivering any message, the delay before the next return is
+// doubled, up to 16 times the configured one, and reset once the primary delivers a message.
+//
+// The retry budget (see [WithInfiniteRetry]) is shared by all endpoints.
+func WithEndpoints(configs ...*client.SubstreamsClientConfig) Option {
+	return func(s *Sinker) {
+		s.endpoints = configs
+	}
+}
+
+// WithEndpointFailover configures when the [Sinker] switches endpoints when multiple endpoints
+// are configured through [WithEndpoints]. The [Sinker] fails over to the next endpoint after
+// `consecutiveFailures` failed attempts without receiving any message (default 3) and returns
+// to the primary endpoint once a secondary endpoint has been active for `primaryRecheck`
+// (default 10m), backed off after each failed return (see [WithEndpoints]).
+func WithEndpointFailover(consecutiveFailures int, primaryRecheck time.Duration) Option {
+	return func(s *Sinker) {
+		s.failoverThreshold = consecutiveFailures
+		s.primaryRecheck = primaryRecheck
+	}
+}
+
+// WithIdleTimeout configures the [Sinker] instance to consider the Substreams stream as stalled
+// when no message of any kind (data, progress, undo) is received for `timeout`. A stalled stream
+// is canceled and the [Sinker] reconnects from the cursor of the last processed message, going
+// through the usual retry back off. Time spent by your handler processing a message is not
+// accounted for.
+//
+// Progress messages are sent regularly by the server while it's processing, so the timeout can
+// be kept relatively low, a `timeout` of 0 disables the check, which is the default.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Sinker) {
+		s.idleTimeout = timeout
+	}
+}
+
+// WithRecorder configures the [Sinker] instance to write every response received from the
+// Substreams server to the file at `path`, truncated when the [Sinker] starts. Responses are
+// written as length-delimited protobuf messages, each connection being recorded separately so that
+// responses received again after a reconnection are replayed on their own connection. The recording
+// can be replayed with [WithReplay].
+//
+// A [ParallelBackfill] does not record the streams of its segments.
+func WithRecorder(path string) Option {
+	return func(s *Sinker) {
+		s.recordPath = path
+	}
+}
+
+// WithReplay configures the [Sinker] instance to stream the responses recorded at `path` through
+// [WithRecorder] instead of connecting to the Substreams server, the client configuration is then
+// ignored, every endpoint configured through [WithEndpoints] replays the recording too. This makes
+// it possible to re-run a handler deterministically against a stream seen in production.
+//
+// Each recorded connection is replayed on its own connection, a recorded connection that is not the
+// last one ends with a retryable error so that the [Sinker] reconnects like it did while recording.
+// When resuming from a cursor, the stream resumes from the latest point of the recording where the
+// server did, the [Sinker] fails if the cursor is not part of the recording. The stream ends after
+// the last recorded response or when the block range's end is reached.
+func WithReplay(path string) Option {
+	return func(s *Sinker) {
+		s.replayPath = path
+	}
+}
+
+// WithUndoOverflowPolicy configures what the [Sinker] instance does when an undo signal reverts
+// blocks that were already emitted to the handler by the undo buffer (see [WithBlockDataBuffer]),
+// which happens when a fork is deeper than the buffer. By default, it fails with an [UndoOverflowError].
+//
+// With [UndoOverflowPolicyForward], the undo signal is forwarded to the handler's `HandleBlockUndoSignal`
+// like when no undo buffer is configured. With [UndoOverflowPolicyHook], the hook configured through
+// [WithUndoOverflowHook] is called instead. In both cases, the undo buffer is emptied and the [Sinker]
+// continues from the last valid block.
+func WithUndoOverflowPolicy(policy UndoOverflowPolicy) Option {
+	return func(s *Sinker) {
+		s.undoOverflow = policy
+	}
+}
+
+// WithUndoOverflowHook configures the [Sinker] instance to call `hook` when an undo signal reverts
+// blocks that were already emitted to the handler by the undo buffer. It implies
+// [UndoOverflowPolicyHook], see [WithUndoOverflowPolicy].
+func WithUndoOverflowHook(hook UndoOverflowHook) Option {
+	return func(s *Sinker) {
+		s.undoOverflow = UndoOverflowPolicyHook
+		s.undoOverflowHook = hook
+	}
+}
+
+// WithOrphanedBlockData configures the [Sinker] instance to keep the data of the blocks handled
+// until they are final so that it's given back, through [OrphanedBlock.Data], to a handler
+// implementing [SinkerOrphanedBlocksHandler] when the blocks are reverted.
+func WithOrphanedBlockData() Option {
+	return func(s *Sinker) {
+		s.orphanedBlockData = true
+	}
+}
+
+// WithHandlerMiddleware configures the [Sinker] instance to perform each `HandleBlockScopedData` and
+// `HandleBlockUndoSignal` (or [SinkerOrphanedBlocksHandler.HandleOrphanedBlocks]) call of its handler
+// through `middlewares`, the first one being the outermost.
+// Calling it multiple times appends to the chain. See [RecoverMiddleware], [TimeoutMiddleware],
+// [LoggingMiddleware] and [MetricsMiddleware] for the built-in middlewares.
+//
+// The calls of the optional handler interfaces, like [SinkerCompletionHandler], are not wrapped.
+func WithHandlerMiddleware(middlewares ...HandlerMiddleware) Option {
+	return func(s *Sinker) {
+		s.middlewares = append(s.middlewares, middlewares...)
+	}
+}
@@ -0,0 +1,54 @@
+package sinktest_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/streamingfast/substreams-sink/sinktest"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveBufferGrowthNearEndBlock(t *testing.T) {
+	// The request's end block is padded by the initial capacity of 2 blocks, the reorg grows
+	// the buffer to 4 blocks so #7 and #8 are still buffered when the stream ends after #10
+	server := sinktest.NewServer(t, sinktest.NewStream().
+		BlockScopedData(blocks(1, 6, "a")...).
+		Undo(sinktest.BlockUndoSignal(4, "4a")).
+		BlockScopedData(blocks(5, 10, "b")...),
+	)
+	sinker := sinktest.NewSinker(t, server,
+		sink.WithBlockRange(bstream.NewRangeExcludingEnd(1, 9)),
+		sink.WithAdaptiveBlockDataBuffer(2, 10),
+	)
+
+	var handled []string
+	handler := sink.NewSinkerHandlers(
+		func(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *sink.Cursor) error {
+			handled = append(handled, data.Clock.Id)
+			return nil
+		},
+		func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
+			return fmt.Errorf("unexpected undo signal to #%d", undoSignal.LastValidBlock.Number)
+		},
+	)
+
+	sinker.Run(context.Background(), nil, handler)
+	require.NoError(t, sinker.Err())
+
+	assert.Equal(t, []string{"1a", "2a", "3a", "4a", "5b", "6b", "7b", "8b"}, handled)
+	assert.Equal(t, uint64(11), server.Requests()[0].StopBlockNum)
+}
+
+// blocks returns the non-final block data of blocks [start, end] on branch `branch`.
+func blocks(start, end uint64, branch string) (out []*pbsubstreamsrpc.BlockScopedData) {
+	for number := start; number <= end; number++ {
+		out = append(out, sinktest.BlockScopedData(number, fmt.Sprintf("%d%s", number, branch), 0, nil))
+	}
+
+	return
+}
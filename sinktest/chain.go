@@ -0,0 +1,172 @@
+package sinktest
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// ChainConfig configures the synthetic chain generated by [SimulateChain].
+type ChainConfig struct {
+	// StartBlock is the number of the first block emitted.
+	StartBlock uint64
+
+	// BlockCount is the number of blocks of the final canonical chain.
+	BlockCount int
+
+	// ForkProbability is the probability, in [0, 1], that a fork happens after each block.
+	ForkProbability float64
+
+	// MaxForkDepth is the maximum number of blocks reverted by a fork, the depth of each fork is
+	// picked randomly between 1 and this value. A fork never reverts final blocks, so forks
+	// are also bounded by `FinalityLag`.
+	MaxForkDepth int
+
+	// FinalityLag is the distance between the head block and the final block height reported
+	// in each [pbsubstreamsrpc.BlockScopedData].
+	FinalityLag uint64
+
+	// Seed makes the generation deterministic, the same configuration always generates the
+	// same chain.
+	Seed int64
+
+	// Output, if set, returns the output of the module for the given block, otherwise blocks
+	// are emitted without output.
+	Output func(block bstream.BlockRef) proto.Message
+}
+
+// Chain is a synthetic chain generated by [SimulateChain]: the sequence of responses a
+// Substreams server would send while following it, forks included, and the canonical chain
+// that remains once every fork has been resolved.
+type Chain struct {
+	Responses []*pbsubstreamsrpc.Response
+	Canonical []bstream.BlockRef
+
+	// ForkCount is the number of forks, so the number of undo signals, in `Responses`.
+	ForkCount int
+}
+
+// SimulateChain generates a [Chain] following `config`. Blocks of the n-th branch have ids
+// made of the block number followed by the branch name (`12a`, `12b`, ..., `12aa`), cursors
+// and final block heights are consistent with the chain's state at each point.
+func SimulateChain(config ChainConfig) *Chain {
+	random := rand.New(rand.NewSource(config.Seed))
+	chain := &Chain{}
+
+	var head []bstream.BlockRef
+	var finalHeight uint64
+	branch := 0
+	lastNumber := config.StartBlock + uint64(config.BlockCount) - 1
+
+	lib := func() bstream.BlockRef {
+		if finalHeight < config.StartBlock {
+			return bstream.NewBlockRef("", finalHeight)
+		}
+
+		return head[finalHeight-config.StartBlock]
+	}
+
+	for config.BlockCount > 0 {
+		number := config.StartBlock + uint64(len(head))
+		block := bstream.NewBlockRef(fmt.Sprintf("%d%s", number, branchName(branch)), number)
+		head = append(head, block)
+
+		if number >= config.FinalityLag && number-config.FinalityLag > finalHeight {
+			finalHeight = number - config.FinalityLag
+		}
+
+		var output proto.Message
+		if config.Output != nil {
+			output = config.Output(block)
+		}
+
+		data := BlockScopedData(number, block.ID(), finalHeight, output)
+		data.Cursor = Cursor(block, lib())
+		chain.Responses = append(chain.Responses, &pbsubstreamsrpc.Response{
+			Message: &pbsubstreamsrpc.Response_BlockScopedData{BlockScopedData: data},
+		})
+
+		if number == lastNumber {
+			break
+		}
+
+		// Reverted blocks must not be final and the last valid block must have been emitted
+		maxDepth := min(config.MaxForkDepth, len(head)-1)
+		if finalHeight >= config.StartBlock {
+			maxDepth = min(maxDepth, int(number-finalHeight))
+		}
+
+		if maxDepth < 1 || random.Float64() >= config.ForkProbability {
+			continue
+		}
+
+		depth := 1 + random.Intn(maxDepth)
+		head = head[:len(head)-depth]
+		lastValid := head[len(head)-1]
+
+		undo := BlockUndoSignal(lastValid.Num(), lastValid.ID())
+		undo.LastValidCursor = Cursor(lastValid, lib())
+		chain.Responses = append(chain.Responses, &pbsubstreamsrpc.Response{
+			Message: &pbsubstreamsrpc.Response_BlockUndoSignal{BlockUndoSignal: undo},
+		})
+
+		chain.ForkCount++
+		branch++
+	}
+
+	chain.Canonical = head
+	return chain
+}
+
+// Stream returns a [Stream] sending all the chain's responses.
+func (c *Chain) Stream() *Stream {
+	stream := NewStream()
+	for _, response := range c.Responses {
+		stream.Response(response)
+	}
+
+	return stream
+}
+
+// Verify returns an error describing the first difference between `applied`, the blocks
+// a handler holds once the stream is over, and the canonical chain.
+func (c *Chain) Verify(applied []bstream.BlockRef) error {
+	for i, expected := range c.Canonical {
+		if i >= len(applied) {
+			return fmt.Errorf("missing %d canonical blocks starting at %s", len(c.Canonical)-i, expected)
+		}
+
+		if !bstream.EqualsBlockRefs(expected, applied[i]) {
+			return fmt.Errorf("expected canonical block %s at position %d, got %s", expected, i, applied[i])
+		}
+	}
+
+	if len(applied) > len(c.Canonical) {
+		return fmt.Errorf("%d unexpected blocks after canonical chain, starting at %s", len(applied)-len(c.Canonical), applied[len(c.Canonical)])
+	}
+
+	return nil
+}
+
+// branchName returns the name of the n-th branch: a, b, ..., z, aa, ab, ...
+func branchName(n int) string {
+	var name strings.Builder
+	for {
+		name.WriteByte(byte('a' + n%26))
+		n = n/26 - 1
+		if n < 0 {
+			break
+		}
+	}
+
+	out := []byte(name.String())
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+
+	return string(out)
+}
@@ -0,0 +1,102 @@
+package sinktest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/streamingfast/substreams-sink/sinktest"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chainHandler keeps the blocks it received, dropping the ones reverted by undo signals
+type chainHandler struct {
+	blocks []bstream.BlockRef
+}
+
+func (h *chainHandler) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *sink.Cursor) error {
+	h.blocks = append(h.blocks, bstream.NewBlockRef(data.Clock.Id, data.Clock.Number))
+	return nil
+}
+
+func (h *chainHandler) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
+	for len(h.blocks) > 0 && h.blocks[len(h.blocks)-1].Num() > undoSignal.LastValidBlock.Number {
+		h.blocks = h.blocks[:len(h.blocks)-1]
+	}
+
+	return nil
+}
+
+func TestSimulateChain(t *testing.T) {
+	config := sinktest.ChainConfig{
+		StartBlock:      10,
+		BlockCount:      200,
+		ForkProbability: 0.2,
+		MaxForkDepth:    4,
+		FinalityLag:     6,
+		Seed:            42,
+	}
+
+	chain := sinktest.SimulateChain(config)
+	require.Len(t, chain.Canonical, 200)
+	assert.Greater(t, chain.ForkCount, 0)
+	assert.Equal(t, chain, sinktest.SimulateChain(config), "generation should be deterministic")
+
+	var finalHeight uint64
+	for _, response := range chain.Responses {
+		switch r := response.Message.(type) {
+		case *pbsubstreamsrpc.Response_BlockScopedData:
+			require.GreaterOrEqual(t, r.BlockScopedData.FinalBlockHeight, finalHeight, "final block height must never decrease")
+			finalHeight = r.BlockScopedData.FinalBlockHeight
+
+			cursor, err := sink.NewCursor(r.BlockScopedData.Cursor)
+			require.NoError(t, err)
+			assert.Equal(t, r.BlockScopedData.Clock.Id, cursor.Block().ID())
+
+		case *pbsubstreamsrpc.Response_BlockUndoSignal:
+			require.GreaterOrEqual(t, r.BlockUndoSignal.LastValidBlock.Number, finalHeight, "final blocks must never be reverted")
+		}
+	}
+}
+
+func TestSimulateChain_Verify(t *testing.T) {
+	chain := sinktest.SimulateChain(sinktest.ChainConfig{StartBlock: 1, BlockCount: 3})
+
+	require.NoError(t, chain.Verify([]bstream.BlockRef{
+		bstream.NewBlockRef("1a", 1),
+		bstream.NewBlockRef("2a", 2),
+		bstream.NewBlockRef("3a", 3),
+	}))
+
+	assert.EqualError(t, chain.Verify([]bstream.BlockRef{
+		bstream.NewBlockRef("1a", 1),
+		bstream.NewBlockRef("2b", 2),
+	}), "expected canonical block #2 (2a) at position 1, got #2 (2b)")
+
+	assert.EqualError(t, chain.Verify([]bstream.BlockRef{
+		bstream.NewBlockRef("1a", 1),
+	}), "missing 2 canonical blocks starting at #2 (2a)")
+}
+
+func TestSimulateChain_Sinker(t *testing.T) {
+	chain := sinktest.SimulateChain(sinktest.ChainConfig{
+		StartBlock:      1,
+		BlockCount:      100,
+		ForkProbability: 0.3,
+		MaxForkDepth:    3,
+		FinalityLag:     5,
+		Seed:            7,
+	})
+
+	server := sinktest.NewServer(t, chain.Stream())
+	handler := &chainHandler{}
+
+	sinker := sinktest.NewSinker(t, server, sink.WithBlockRange(bstream.NewRangeExcludingEnd(1, 101)))
+	sinker.Run(context.Background(), nil, handler)
+	require.NoError(t, sinker.Err())
+
+	require.NoError(t, chain.Verify(handler.blocks))
+}
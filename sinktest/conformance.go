@@ -0,0 +1,227 @@
+package sinktest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/derr"
+	sink "github.com/streamingfast/substreams-sink"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+// ConformanceHandler is a [sink.SinkerHandler] whose persisted state can be inspected by
+// [RunConformance].
+type ConformanceHandler interface {
+	sink.SinkerHandler
+
+	// Blocks returns, in order, the blocks for which the handler durably holds data.
+	Blocks(ctx context.Context) ([]bstream.BlockRef, error)
+}
+
+// ConformanceFactory returns a new handler, with an empty state, for each scenario.
+type ConformanceFactory func(t *testing.T) ConformanceHandler
+
+// RunConformance runs the handler returned by `factory` through a set of standard scenarios,
+// each one being a sub-test of `t`, checking that its persisted state is consistent with the
+// stream once the [sink.Sinker] is done. Each scenario streams from a fresh [Server] with a
+// [sink.InMemoryCursorStore] configured.
+//
+// When the [sink.Sinker] is restarted, the same handler instance is used for the new
+// [sink.Sinker], it must behave as if the process was restarted.
+func RunConformance(t *testing.T, factory ConformanceFactory) {
+	t.Run("RestartFromSavedCursor", func(t *testing.T) { testRestartFromSavedCursor(t, factory(t)) })
+	t.Run("RetryableHandlerError", func(t *testing.T) { testRetryableHandlerError(t, factory(t)) })
+	t.Run("RetryableHandlerErrorWithBuffer", func(t *testing.T) { testRetryableHandlerErrorWithBuffer(t, factory(t)) })
+	t.Run("Undo", func(t *testing.T) { testUndo(t, factory(t)) })
+	t.Run("UndoToLastEmittedBlock", func(t *testing.T) { testUndoToLastEmittedBlock(t, factory(t)) })
+	t.Run("UndoDeeperThanBuffer", func(t *testing.T) { testUndoDeeperThanBuffer(t, factory(t)) })
+	t.Run("CompletionCallback", func(t *testing.T) { testCompletionCallback(t, factory(t)) })
+	t.Run("DuplicateDeliveryAfterReconnect", func(t *testing.T) { testDuplicateDeliveryAfterReconnect(t, factory(t)) })
+}
+
+func testRestartFromSavedCursor(t *testing.T, handler ConformanceHandler) {
+	responses := blockResponses("1a", "2a", "3a", "4a", "5a")
+	server := NewServer(t,
+		NewStream().Response(responses[0:3]...).Error(codes.InvalidArgument, "sinktest: simulated crash"),
+		NewStream().ResumeFrom(responses...),
+	)
+	store := sink.NewInMemoryCursorStore()
+
+	require.Error(t, runConformanceSinker(t, server, handler, store), "first run is expected to fail")
+	require.NoError(t, runConformanceSinker(t, server, handler, store), "second run should resume from the saved cursor and complete")
+
+	assertHandlerBlocks(t, handler, "1a", "2a", "3a", "4a", "5a")
+	assertStoredCursor(t, store, "5a")
+}
+
+func testRetryableHandlerError(t *testing.T, handler ConformanceHandler) {
+	responses := blockResponses("1a", "2a", "3a", "4a", "5a")
+	server := NewServer(t,
+		NewStream().ResumeFrom(responses...),
+		NewStream().ResumeFrom(responses...),
+	)
+
+	failing := &failOnce{failAt: 3}
+	require.NoError(t, runConformanceSinker(t, server, handler, sink.NewInMemoryCursorStore(), sink.WithHandlerMiddleware(failing.middleware)))
+
+	assert.True(t, failing.failed, "handler should have been called for block #3")
+	assertHandlerBlocks(t, handler, "1a", "2a", "3a", "4a", "5a")
+}
+
+func testRetryableHandlerErrorWithBuffer(t *testing.T, handler ConformanceHandler) {
+	// With a buffer of 2 blocks, #5 makes #3 and #4 final so the 3 blocks are emitted at once,
+	// the handler fails on #4 after having handled #3
+	responses := append(blockResponses("1a", "2a", "3a", "4a"), blockResponse(5, "5a", 4), blockResponse(6, "6a", 5))
+	server := NewServer(t,
+		NewStream().ResumeFrom(responses...),
+		NewStream().ResumeFrom(responses...),
+	)
+	store := sink.NewInMemoryCursorStore()
+
+	failing := &failOnce{failAt: 4}
+	require.NoError(t, runConformanceSinker(t, server, handler, store, sink.WithBlockDataBuffer(2), sink.WithHandlerMiddleware(failing.middleware)))
+
+	assert.True(t, failing.failed, "handler should have been called for block #4")
+	assertHandlerBlocks(t, handler, "1a", "2a", "3a", "4a", "5a")
+	assertStoredCursor(t, store, "5a")
+}
+
+func testUndo(t *testing.T, handler ConformanceHandler) {
+	server := NewServer(t, NewStream().
+		Response(blockResponses("1a", "2a", "3a", "4a")...).
+		Undo(BlockUndoSignal(2, "2a")).
+		Response(blockResponses("3b", "4b", "5b")...),
+	)
+
+	require.NoError(t, runConformanceSinker(t, server, handler, sink.NewInMemoryCursorStore()))
+	assertHandlerBlocks(t, handler, "1a", "2a", "3b", "4b", "5b")
+}
+
+func testUndoToLastEmittedBlock(t *testing.T, handler ConformanceHandler) {
+	// With a buffer of 2 blocks, #1 (1a) and #2 (2a) are emitted before the undo, the last
+	// 2 blocks are still buffered when the stream ends and are never emitted
+	server := NewServer(t, NewStream().
+		Response(blockResponses("1a", "2a", "3a", "4a")...).
+		Undo(BlockUndoSignal(2, "2a")).
+		Response(blockResponses("3b", "4b", "5b")...),
+	)
+
+	require.NoError(t, runConformanceSinker(t, server, handler, sink.NewInMemoryCursorStore(), sink.WithBlockDataBuffer(2)))
+	assertHandlerBlocks(t, handler, "1a", "2a", "3b")
+}
+
+func testUndoDeeperThanBuffer(t *testing.T, handler ConformanceHandler) {
+	server := NewServer(t, NewStream().
+		Response(blockResponses("1a", "2a", "3a", "4a")...).
+		Undo(BlockUndoSignal(1, "1a")).
+		Response(blockResponses("2b", "3b")...),
+	)
+
+	err := runConformanceSinker(t, server, handler, sink.NewInMemoryCursorStore(), sink.WithBlockDataBuffer(2))
+	require.Error(t, err, "sinker should fail when undoing blocks already emitted by the buffer")
+
+	assertHandlerBlocks(t, handler, "1a", "2a")
+}
+
+func testCompletionCallback(t *testing.T, handler ConformanceHandler) {
+	if _, ok := handler.(sink.SinkerCompletionHandler); !ok {
+		t.Skip("handler does not implement sink.SinkerCompletionHandler")
+	}
+
+	server := NewServer(t, NewStream().Response(blockResponses("1a", "2a", "3a")...))
+	store := sink.NewInMemoryCursorStore()
+
+	require.NoError(t, runConformanceSinker(t, server, handler, store))
+
+	assertHandlerBlocks(t, handler, "1a", "2a", "3a")
+	assertStoredCursor(t, store, "3a")
+}
+
+func testDuplicateDeliveryAfterReconnect(t *testing.T, handler ConformanceHandler) {
+	server := NewServer(t,
+		NewStream().Response(blockResponses("1a", "2a", "3a")...).Error(codes.Unavailable, "sinktest: simulated disconnection"),
+		NewStream().Response(blockResponses("2a", "3a", "4a", "5a")...),
+	)
+
+	require.NoError(t, runConformanceSinker(t, server, handler, sink.NewInMemoryCursorStore()))
+	assertHandlerBlocks(t, handler, "1a", "2a", "3a", "4a", "5a")
+}
+
+func runConformanceSinker(t *testing.T, server *Server, handler sink.SinkerHandler, store sink.CursorStore, opts ...sink.Option) error {
+	t.Helper()
+
+	sinker := NewSinker(t, server, append([]sink.Option{
+		sink.WithBlockRange(bstream.NewRangeExcludingEnd(1, 100)),
+		sink.WithCursorStore(store),
+	}, opts...)...)
+
+	sinker.Run(context.Background(), nil, handler)
+	return sinker.Err()
+}
+
+func assertHandlerBlocks(t *testing.T, handler ConformanceHandler, expectedIDs ...string) {
+	t.Helper()
+
+	blocks, err := handler.Blocks(context.Background())
+	require.NoError(t, err)
+
+	ids := make([]string, len(blocks))
+	for i, block := range blocks {
+		ids[i] = block.ID()
+	}
+
+	assert.Equal(t, expectedIDs, ids, "handler's persisted blocks do not match the expected chain")
+}
+
+func assertStoredCursor(t *testing.T, store sink.CursorStore, expectedID string) {
+	t.Helper()
+
+	record, err := store.Load(context.Background())
+	require.NoError(t, err)
+	require.NotNil(t, record, "a cursor should have been saved")
+
+	assert.Equal(t, expectedID, record.Cursor.Block().ID(), "saved cursor should point to the last block")
+}
+
+// blockResponses returns block data responses for blocks identified as `<number><branch>`
+func blockResponses(ids ...string) []*pbsubstreamsrpc.Response {
+	out := make([]*pbsubstreamsrpc.Response, len(ids))
+	for i, id := range ids {
+		var number uint64
+		if _, err := fmt.Sscanf(id, "%d", &number); err != nil {
+			panic(fmt.Errorf("invalid block id %q: %w", id, err))
+		}
+
+		out[i] = blockResponse(number, id, 0)
+	}
+
+	return out
+}
+
+func blockResponse(number uint64, id string, finalBlockHeight uint64) *pbsubstreamsrpc.Response {
+	return &pbsubstreamsrpc.Response{Message: &pbsubstreamsrpc.Response_BlockScopedData{
+		BlockScopedData: BlockScopedData(number, id, finalBlockHeight, nil),
+	}}
+}
+
+// failOnce is a [sink.HandlerMiddleware] returning a retryable error, without calling the
+// handler, the first time block `failAt` is handled. Being a middleware, the handler is given
+// as-is to the [sink.Sinker] which sees every optional interface it implements.
+type failOnce struct {
+	failAt uint64
+	failed bool
+}
+
+func (f *failOnce) middleware(ctx context.Context, call *sink.HandlerCall, next sink.HandlerFunc) error {
+	if call.Data != nil && call.Block.Num() == f.failAt && !f.failed {
+		f.failed = true
+		return derr.NewRetryableError(fmt.Errorf("sinktest: simulated retryable error at block #%d", f.failAt))
+	}
+
+	return next(ctx)
+}
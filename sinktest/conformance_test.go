@@ -0,0 +1,80 @@
+package sinktest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/streamingfast/substreams-sink/sinktest"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+)
+
+// memoryHandler persists each block as soon as it's received, replacing blocks at or
+// above a re-delivered block
+type memoryHandler struct {
+	chainHandler
+}
+
+func (h *memoryHandler) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *sink.Cursor) error {
+	for len(h.blocks) > 0 && h.blocks[len(h.blocks)-1].Num() >= data.Clock.Number {
+		h.blocks = h.blocks[:len(h.blocks)-1]
+	}
+
+	return h.chainHandler.HandleBlockScopedData(ctx, data, isLive, cursor)
+}
+
+func (h *memoryHandler) Blocks(ctx context.Context) ([]bstream.BlockRef, error) {
+	return h.blocks, nil
+}
+
+// batchingMemoryHandler persists blocks by batches through a [sink.BatchingHandler]
+type batchingMemoryHandler struct {
+	*sink.BatchingHandler
+	blocks []bstream.BlockRef
+}
+
+func newBatchingMemoryHandler() *batchingMemoryHandler {
+	h := &batchingMemoryHandler{}
+	h.BatchingHandler = sink.NewBatchingHandler(h.flush, sink.WithBatchMaxBlocks(2), sink.WithBatchRollback(h.rollback))
+
+	return h
+}
+
+func (h *batchingMemoryHandler) flush(ctx context.Context, blocks []*pbsubstreamsrpc.BlockScopedData, lastCursor *sink.Cursor) error {
+	for _, block := range blocks {
+		h.truncateFrom(block.Clock.Number)
+		h.blocks = append(h.blocks, bstream.NewBlockRef(block.Clock.Id, block.Clock.Number))
+	}
+
+	return nil
+}
+
+func (h *batchingMemoryHandler) rollback(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
+	h.truncateFrom(undoSignal.LastValidBlock.Number + 1)
+	return nil
+}
+
+func (h *batchingMemoryHandler) truncateFrom(number uint64) {
+	for len(h.blocks) > 0 && h.blocks[len(h.blocks)-1].Num() >= number {
+		h.blocks = h.blocks[:len(h.blocks)-1]
+	}
+}
+
+func (h *batchingMemoryHandler) Blocks(ctx context.Context) ([]bstream.BlockRef, error) {
+	return h.blocks, nil
+}
+
+func TestRunConformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		sinktest.RunConformance(t, func(t *testing.T) sinktest.ConformanceHandler {
+			return &memoryHandler{}
+		})
+	})
+
+	t.Run("batching", func(t *testing.T) {
+		sinktest.RunConformance(t, func(t *testing.T) sinktest.ConformanceHandler {
+			return newBatchingMemoryHandler()
+		})
+	})
+}
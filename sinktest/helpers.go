@@ -0,0 +1,129 @@
+package sinktest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/logging"
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/streamingfast/substreams/manifest"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var _, tracer = logging.PackageLogger("sinktest", "github.com/streamingfast/substreams-sink/sinktest")
+
+// OutputModuleName is the name of the output module of the package returned by [Package].
+const OutputModuleName = "map_sinktest"
+
+// DefaultOutputType is the output type used by [NewSinker].
+const DefaultOutputType = "proto:google.protobuf.StringValue"
+
+// Cursor returns the opaque cursor of `block`, `lib` being the last irreversible block at that point.
+func Cursor(block, lib bstream.BlockRef) string {
+	return (&bstream.Cursor{
+		Step:      bstream.StepNew,
+		Block:     block,
+		LIB:       lib,
+		HeadBlock: block,
+	}).ToOpaque()
+}
+
+// BlockScopedData returns the data of block `number` with id `id`, carrying `output` as the output of
+// [OutputModuleName] (a nil `output` means the module produced nothing for this block). The block's
+// timestamp is `number` seconds after the Unix epoch.
+func BlockScopedData(number uint64, id string, finalBlockHeight uint64, output proto.Message) *pbsubstreamsrpc.BlockScopedData {
+	block := bstream.NewBlockRef(id, number)
+
+	lib := block
+	if finalBlockHeight != number {
+		lib = bstream.NewBlockRef("", finalBlockHeight)
+	}
+
+	var mapOutput *anypb.Any
+	if output != nil {
+		var err error
+		if mapOutput, err = anypb.New(output); err != nil {
+			panic(err)
+		}
+	}
+
+	return &pbsubstreamsrpc.BlockScopedData{
+		Output: &pbsubstreamsrpc.MapModuleOutput{
+			Name:      OutputModuleName,
+			MapOutput: mapOutput,
+		},
+		Clock: &pbsubstreams.Clock{
+			Id:        id,
+			Number:    number,
+			Timestamp: timestamppb.New(time.Unix(int64(number), 0)),
+		},
+		Cursor:           Cursor(block, lib),
+		FinalBlockHeight: finalBlockHeight,
+	}
+}
+
+// BlockUndoSignal returns an undo signal whose last valid block is `number` with id `id`.
+func BlockUndoSignal(number uint64, id string) *pbsubstreamsrpc.BlockUndoSignal {
+	block := bstream.NewBlockRef(id, number)
+
+	return &pbsubstreamsrpc.BlockUndoSignal{
+		LastValidBlock:  &pbsubstreams.BlockRef{Id: id, Number: number},
+		LastValidCursor: Cursor(block, block),
+	}
+}
+
+// Package returns a package made of a single map module named [OutputModuleName] producing
+// `outputType`, along with the module itself and a fixed module hash.
+func Package(outputType string) (*pbsubstreams.Package, *pbsubstreams.Module, manifest.ModuleHash) {
+	module := &pbsubstreams.Module{
+		Name: OutputModuleName,
+		Kind: &pbsubstreams.Module_KindMap_{KindMap: &pbsubstreams.Module_KindMap{OutputType: outputType}},
+		Output: &pbsubstreams.Module_Output{
+			Type: outputType,
+		},
+	}
+
+	pkg := &pbsubstreams.Package{
+		Network: "sinktest",
+		Modules: &pbsubstreams.Modules{Modules: []*pbsubstreams.Module{module}},
+		PackageMeta: []*pbsubstreams.PackageMetadata{
+			{Name: "sinktest", Version: "v0.0.0"},
+		},
+	}
+
+	return pkg, module, manifest.ModuleHash("sinktest")
+}
+
+// NewSinker returns a [sink.Sinker] streaming from `server` the package returned by
+// [Package] with [DefaultOutputType], logging to the test's output. Options are applied
+// after the default ones, which retry quickly instead of backing off exponentially.
+func NewSinker(t testing.TB, server *Server, opts ...sink.Option) *sink.Sinker {
+	t.Helper()
+
+	pkg, module, hash := Package(DefaultOutputType)
+	logger := zaptest.NewLogger(t, zaptest.Level(zap.InfoLevel))
+
+	sinker, err := sink.New(
+		sink.SubstreamsModeDevelopment,
+		pkg,
+		module,
+		hash,
+		server.ClientConfig(),
+		logger,
+		tracer,
+		append([]sink.Option{sink.WithRetryBackOff(backoff.NewConstantBackOff(10 * time.Millisecond))}, opts...)...,
+	)
+	if err != nil {
+		t.Fatalf("sinktest: new sinker: %s", err)
+	}
+
+	return sinker
+}
@@ -0,0 +1,213 @@
+package sinktest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/streamingfast/substreams-sink/sinktest"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParallelBackfill_Segments(t *testing.T) {
+	server := backfillServer(t, 3, finalResponses(1, 13))
+	sinker := sinktest.NewSinker(t, server, sink.WithBlockRange(bstream.NewRangeExcludingEnd(1, 13)))
+
+	backfill, err := sink.NewParallelBackfill(sinker, 3)
+	require.NoError(t, err)
+
+	handler := &backfillHandler{}
+	require.NoError(t, backfill.Run(context.Background(), handler))
+
+	assert.ElementsMatch(t, blockRange(1, 13), handler.blocks)
+	require.NotNil(t, handler.completed)
+	assert.Equal(t, uint64(12), handler.completed.Block().Num())
+
+	requests := server.Requests()
+	sort.Slice(requests, func(i, j int) bool { return requests[i].StartBlockNum < requests[j].StartBlockNum })
+
+	ranges := make([][2]uint64, len(requests))
+	for i, request := range requests {
+		assert.True(t, request.FinalBlocksOnly, "segment requests must be final blocks only")
+		ranges[i] = [2]uint64{uint64(request.StartBlockNum), request.StopBlockNum}
+	}
+	assert.Equal(t, [][2]uint64{{1, 5}, {5, 9}, {9, 13}}, ranges)
+}
+
+func TestParallelBackfill_OrderedDelivery(t *testing.T) {
+	server := backfillServer(t, 4, finalResponses(1, 13))
+	sinker := sinktest.NewSinker(t, server, sink.WithBlockRange(bstream.NewRangeExcludingEnd(1, 13)))
+
+	backfill, err := sink.NewParallelBackfill(sinker, 4, sink.WithBackfillOrderedDelivery(1))
+	require.NoError(t, err)
+
+	handler := &backfillHandler{}
+	require.NoError(t, backfill.Run(context.Background(), handler))
+
+	assert.Equal(t, blockRange(1, 13), handler.blocks)
+}
+
+func TestParallelBackfill_SegmentCursorResume(t *testing.T) {
+	responses := finalResponses(1, 13)
+	server := backfillServer(t, 3, responses)
+	sinker := sinktest.NewSinker(t, server, sink.WithBlockRange(bstream.NewRangeExcludingEnd(1, 13)))
+
+	stores := map[uint64]*sink.InMemoryCursorStore{1: sink.NewInMemoryCursorStore(), 5: sink.NewInMemoryCursorStore(), 9: sink.NewInMemoryCursorStore()}
+
+	// Segment [5, 9) was interrupted after block #6 during a previous run
+	interruptedAt := responses[5].GetBlockScopedData().Cursor
+	cursor, err := sink.NewCursor(interruptedAt)
+	require.NoError(t, err)
+	require.NoError(t, stores[5].Save(context.Background(), &sink.CursorRecord{Cursor: cursor}))
+
+	backfill, err := sink.NewParallelBackfill(sinker, 3, sink.WithBackfillOrderedDelivery(2), sink.WithBackfillSegmentCursorStores(func(segment *bstream.Range) sink.CursorStore {
+		return stores[segment.StartBlock()]
+	}))
+	require.NoError(t, err)
+
+	handler := &backfillHandler{}
+	require.NoError(t, backfill.Run(context.Background(), handler))
+
+	assert.Equal(t, []uint64{1, 2, 3, 4, 7, 8, 9, 10, 11, 12}, handler.blocks)
+
+	for start, expected := range map[uint64]uint64{1: 4, 5: 8, 9: 12} {
+		record, err := stores[start].Load(context.Background())
+		require.NoError(t, err)
+		require.NotNil(t, record, "segment starting at #%d should have saved its cursor", start)
+		assert.Equal(t, expected, record.Cursor.Block().Num(), "segment starting at #%d", start)
+	}
+
+	for _, request := range server.Requests() {
+		if request.StartBlockNum == 5 {
+			assert.Equal(t, interruptedAt, request.StartCursor)
+		}
+	}
+}
+
+func TestParallelBackfill_LaterSegmentFailure(t *testing.T) {
+	server := backfillServer(t, 3, finalResponses(1, 13))
+	sinker := sinktest.NewSinker(t, server, sink.WithBlockRange(bstream.NewRangeExcludingEnd(1, 13)))
+
+	// The last segment fails once the first block was delivered
+	firstDelivered := make(chan struct{})
+	backfill, err := sink.NewParallelBackfill(sinker, 3, sink.WithBackfillOrderedDelivery(4), sink.WithBackfillSegmentCursorStores(func(segment *bstream.Range) sink.CursorStore {
+		if segment.StartBlock() == 9 {
+			return &failingCursorStore{wait: firstDelivered}
+		}
+
+		return nil
+	}))
+	require.NoError(t, err)
+
+	// The handler ignores cancellation, delivery itself must stop once the last segment failed
+	once := sync.Once{}
+	handler := &backfillHandler{onBlock: func(ctx context.Context) {
+		once.Do(func() { close(firstDelivered) })
+		<-ctx.Done()
+	}}
+
+	err = backfill.Run(context.Background(), handler)
+	require.ErrorContains(t, err, "segment [9, 13): load cursor from store: simulated cursor store failure")
+	assert.Equal(t, []uint64{1}, handler.blocks)
+	assert.Nil(t, handler.completed)
+}
+
+func TestParallelBackfill_LiveHandoff(t *testing.T) {
+	server := backfillServer(t, 3, finalResponses(1, 13))
+	sinker := sinktest.NewSinker(t, server, sink.WithBlockRange(bstream.NewOpenRange(1)))
+
+	backfill, err := sink.NewParallelBackfill(sinker, 2, sink.WithBackfillOrderedDelivery(2), sink.WithBackfillLiveHandoff(9))
+	require.NoError(t, err)
+
+	handler := &backfillHandler{}
+	require.NoError(t, backfill.Run(context.Background(), handler))
+
+	assert.Equal(t, blockRange(1, 13), handler.blocks)
+
+	requests := server.Requests()
+	require.Len(t, requests, 3)
+
+	live := requests[2]
+	assert.False(t, live.FinalBlocksOnly)
+	assert.Equal(t, int64(9), live.StartBlockNum)
+	assert.Equal(t, uint64(0), live.StopBlockNum)
+}
+
+// backfillServer returns a [sinktest.Server] serving `connections` connections, each one
+// streaming the block range requested out of `responses`.
+func backfillServer(t *testing.T, connections int, responses []*pbsubstreamsrpc.Response) *sinktest.Server {
+	stream := sinktest.NewStream().Range(responses...)
+
+	streams := make([]*sinktest.Stream, connections)
+	for i := range streams {
+		streams[i] = stream
+	}
+
+	return sinktest.NewServer(t, streams...)
+}
+
+// finalResponses returns the responses of blocks [start, end(, each block being final.
+func finalResponses(start, end uint64) (out []*pbsubstreamsrpc.Response) {
+	for _, number := range blockRange(start, end) {
+		data := sinktest.BlockScopedData(number, fmt.Sprintf("%da", number), number, nil)
+		out = append(out, &pbsubstreamsrpc.Response{Message: &pbsubstreamsrpc.Response_BlockScopedData{BlockScopedData: data}})
+	}
+
+	return
+}
+
+func blockRange(start, end uint64) (out []uint64) {
+	for number := start; number < end; number++ {
+		out = append(out, number)
+	}
+
+	return
+}
+
+type backfillHandler struct {
+	lock      sync.Mutex
+	blocks    []uint64
+	completed *sink.Cursor
+	onBlock   func(ctx context.Context)
+}
+
+func (h *backfillHandler) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *sink.Cursor) error {
+	h.lock.Lock()
+	h.blocks = append(h.blocks, data.Clock.Number)
+	h.lock.Unlock()
+
+	if h.onBlock != nil {
+		h.onBlock(ctx)
+	}
+
+	return nil
+}
+
+func (h *backfillHandler) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
+	return errors.New("unexpected undo signal during backfill")
+}
+
+func (h *backfillHandler) HandleBlockRangeCompletion(ctx context.Context, cursor *sink.Cursor) error {
+	h.completed = cursor
+	return nil
+}
+
+// failingCursorStore fails to load once `wait` is closed.
+type failingCursorStore struct {
+	wait chan struct{}
+}
+
+func (s *failingCursorStore) Load(ctx context.Context) (*sink.CursorRecord, error) {
+	<-s.wait
+	return nil, errors.New("simulated cursor store failure")
+}
+
+func (s *failingCursorStore) Save(ctx context.Context, record *sink.CursorRecord) error { return nil }
+func (s *failingCursorStore) Delete(ctx context.Context) error                          { return nil }
@@ -0,0 +1,106 @@
+// Package sinktest provides helpers to test [sink.SinkerHandler] implementations against a real
+// [sink.Sinker] without a Substreams endpoint. It starts an in-process gRPC server implementing
+// `sf.substreams.rpc.v2.Stream` that serves scripted responses, see [NewServer] and [Stream].
+package sinktest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/streamingfast/substreams/client"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Server is a fake Substreams server listening on a random local port. Each connection made
+// to it is served by the next scripted [Stream], in order. A connection received once all
+// scripted streams were served fails with a `codes.InvalidArgument` error, which the [sink.Sinker]
+// treats as fatal, so that a test never loops forever on an unexpected reconnection.
+type Server struct {
+	pbsubstreamsrpc.UnimplementedStreamServer
+
+	listener net.Listener
+	server   *grpc.Server
+
+	lock     sync.Mutex
+	streams  []*Stream
+	requests []*pbsubstreamsrpc.Request
+}
+
+// NewServer starts a [Server] serving the received streams, one per connection and in order. The
+// server is stopped when the test completes.
+func NewServer(t testing.TB, streams ...*Stream) *Server {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("sinktest: listen on local port: %s", err)
+	}
+
+	s := &Server{
+		listener: listener,
+		server:   grpc.NewServer(),
+		streams:  streams,
+	}
+
+	pbsubstreamsrpc.RegisterStreamServer(s.server, s)
+	go s.server.Serve(listener)
+
+	t.Cleanup(s.server.Stop)
+	return s
+}
+
+// AddStreams scripts more streams to be served after the ones already scripted.
+func (s *Server) AddStreams(streams ...*Stream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.streams = append(s.streams, streams...)
+}
+
+// Endpoint returns the `host:port` the server listens on.
+func (s *Server) Endpoint() string {
+	return s.listener.Addr().String()
+}
+
+// ClientConfig returns a plaintext, unauthenticated [client.SubstreamsClientConfig] pointing at the server.
+func (s *Server) ClientConfig() *client.SubstreamsClientConfig {
+	return client.NewSubstreamsClientConfig(s.Endpoint(), "", client.None, false, true)
+}
+
+// Requests returns the requests received so far, one per connection, in order.
+func (s *Server) Requests() []*pbsubstreamsrpc.Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	out := make([]*pbsubstreamsrpc.Request, len(s.requests))
+	for i, request := range s.requests {
+		out[i] = proto.Clone(request).(*pbsubstreamsrpc.Request)
+	}
+
+	return out
+}
+
+// Blocks implements [pbsubstreamsrpc.StreamServer].
+func (s *Server) Blocks(request *pbsubstreamsrpc.Request, stream pbsubstreamsrpc.Stream_BlocksServer) error {
+	s.lock.Lock()
+	connection := len(s.requests)
+	s.requests = append(s.requests, proto.Clone(request).(*pbsubstreamsrpc.Request))
+
+	var script *Stream
+	if connection < len(s.streams) {
+		script = s.streams[connection]
+	}
+	s.lock.Unlock()
+
+	if script == nil {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("sinktest: no scripted stream left for connection #%d", connection+1))
+	}
+
+	return script.serve(request, stream)
+}
@@ -0,0 +1,80 @@
+package sinktest_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	sink "github.com/streamingfast/substreams-sink"
+	"github.com/streamingfast/substreams-sink/sinktest"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+type recordingHandler struct {
+	events    []string
+	completed *sink.Cursor
+}
+
+func (h *recordingHandler) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *sink.Cursor) error {
+	h.events = append(h.events, "data "+cursor.Block().String())
+	return nil
+}
+
+func (h *recordingHandler) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
+	h.events = append(h.events, "undo "+cursor.Block().String())
+	return nil
+}
+
+func (h *recordingHandler) HandleBlockRangeCompletion(ctx context.Context, cursor *sink.Cursor) error {
+	h.completed = cursor
+	return nil
+}
+
+func TestServer_ReconnectsFromLastCursor(t *testing.T) {
+	server := sinktest.NewServer(t,
+		sinktest.NewStream().
+			Session(1, 1).
+			BlockScopedData(
+				sinktest.BlockScopedData(1, "1a", 1, nil),
+				sinktest.BlockScopedData(2, "2a", 1, nil),
+			).
+			Error(codes.Unavailable, "provider is down"),
+		sinktest.NewStream().
+			Session(3, 3).
+			BlockScopedData(sinktest.BlockScopedData(3, "3a", 2, nil)).
+			Undo(sinktest.BlockUndoSignal(2, "2a")).
+			BlockScopedData(sinktest.BlockScopedData(3, "3b", 2, nil)),
+	)
+
+	handler := &recordingHandler{}
+	sinker := sinktest.NewSinker(t, server, sink.WithBlockRange(bstream.NewRangeExcludingEnd(1, 4)))
+	sinker.Run(context.Background(), nil, handler)
+	require.NoError(t, sinker.Err())
+
+	assert.Equal(t, []string{
+		"data #1 (1a)",
+		"data #2 (2a)",
+		"data #3 (3a)",
+		"undo #2 (2a)",
+		"data #3 (3b)",
+	}, handler.events)
+	assert.Equal(t, "#3 (3b)", handler.completed.Block().String())
+
+	requests := server.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "", requests[0].StartCursor)
+	assert.Equal(t, sinktest.BlockScopedData(2, "2a", 1, nil).Cursor, requests[1].StartCursor)
+}
+
+func TestServer_NoStreamLeft(t *testing.T) {
+	server := sinktest.NewServer(t, sinktest.NewStream().Error(codes.Unavailable, "provider is down"))
+
+	sinker := sinktest.NewSinker(t, server, sink.WithBlockRange(bstream.NewRangeExcludingEnd(1, 4)))
+	sinker.Run(context.Background(), nil, &recordingHandler{})
+
+	require.ErrorContains(t, sinker.Err(), "no scripted stream left for connection #2")
+	assert.Len(t, server.Requests(), 2)
+}
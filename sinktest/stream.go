@@ -0,0 +1,178 @@
+package sinktest
+
+import (
+	"time"
+
+	"github.com/streamingfast/substreams-sink/internal/rpcutil"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type step func(request *pbsubstreamsrpc.Request, stream pbsubstreamsrpc.Stream_BlocksServer) error
+
+// Stream scripts the responses sent on a single connection to the [Server]. Responses are
+// sent in the order they were added, once all of them are sent the stream ends normally which
+// the [sink.Sinker] sees as `io.EOF`, unless the script ends with [Stream.Error] or [Stream.Hang].
+type Stream struct {
+	steps []step
+}
+
+func NewStream() *Stream {
+	return &Stream{}
+}
+
+// Response sends an arbitrary response.
+func (s *Stream) Response(response *pbsubstreamsrpc.Response) *Stream {
+	s.steps = append(s.steps, func(_ *pbsubstreamsrpc.Request, stream pbsubstreamsrpc.Stream_BlocksServer) error {
+		return stream.Send(response)
+	})
+
+	return s
+}
+
+// ResumeFrom sends the responses following the one carrying the request's cursor, like a real
+// server resuming a stream would, or all of them when the request has no cursor. The stream
+// fails with `codes.InvalidArgument` if the cursor is not found in `responses`.
+func (s *Stream) ResumeFrom(responses ...*pbsubstreamsrpc.Response) *Stream {
+	s.steps = append(s.steps, func(request *pbsubstreamsrpc.Request, stream pbsubstreamsrpc.Stream_BlocksServer) error {
+		start, err := resumeIndex(request, responses)
+		if err != nil {
+			return err
+		}
+
+		for _, response := range responses[start:] {
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return s
+}
+
+// Range is like [Stream.ResumeFrom] but honors the request's block range: without cursor, block
+// data below the request's start block are skipped and the stream ends at the first block data
+// reaching the request's stop block. The same [Stream] can then serve requests for different
+// block ranges, like the segments of a [sink.ParallelBackfill].
+func (s *Stream) Range(responses ...*pbsubstreamsrpc.Response) *Stream {
+	s.steps = append(s.steps, func(request *pbsubstreamsrpc.Request, stream pbsubstreamsrpc.Stream_BlocksServer) error {
+		start, err := resumeIndex(request, responses)
+		if err != nil {
+			return err
+		}
+
+		for _, response := range responses[start:] {
+			if data := response.GetBlockScopedData(); data != nil {
+				if request.StopBlockNum != 0 && data.Clock.Number >= request.StopBlockNum {
+					return nil
+				}
+
+				if request.StartCursor == "" && data.Clock.Number < uint64(request.StartBlockNum) {
+					continue
+				}
+			}
+
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return s
+}
+
+// resumeIndex returns the index of the first response following the one carrying the request's
+// cursor, 0 if the request has no cursor.
+func resumeIndex(request *pbsubstreamsrpc.Request, responses []*pbsubstreamsrpc.Response) (int, error) {
+	if request.StartCursor == "" {
+		return 0, nil
+	}
+
+	for i, response := range responses {
+		if rpcutil.ResponseCursor(response) == request.StartCursor {
+			return i + 1, nil
+		}
+	}
+
+	return 0, status.Errorf(codes.InvalidArgument, "sinktest: cursor %q not found in scripted responses", request.StartCursor)
+}
+
+// Session sends a session message, the trace ID is `sinktest`.
+func (s *Stream) Session(resolvedStartBlock, linearHandoffBlock uint64) *Stream {
+	return s.Response(&pbsubstreamsrpc.Response{Message: &pbsubstreamsrpc.Response_Session{
+		Session: &pbsubstreamsrpc.SessionInit{
+			TraceId:            "sinktest",
+			ResolvedStartBlock: resolvedStartBlock,
+			LinearHandoffBlock: linearHandoffBlock,
+			MaxParallelWorkers: 1,
+		},
+	}})
+}
+
+// Progress sends a progress message.
+func (s *Stream) Progress(progress *pbsubstreamsrpc.ModulesProgress) *Stream {
+	return s.Response(&pbsubstreamsrpc.Response{Message: &pbsubstreamsrpc.Response_Progress{Progress: progress}})
+}
+
+// BlockScopedData sends block data messages, see [BlockScopedData] to create them.
+func (s *Stream) BlockScopedData(data ...*pbsubstreamsrpc.BlockScopedData) *Stream {
+	for _, d := range data {
+		s.Response(&pbsubstreamsrpc.Response{Message: &pbsubstreamsrpc.Response_BlockScopedData{BlockScopedData: d}})
+	}
+
+	return s
+}
+
+// Undo sends an undo signal, see [BlockUndoSignal] to create it.
+func (s *Stream) Undo(undoSignal *pbsubstreamsrpc.BlockUndoSignal) *Stream {
+	return s.Response(&pbsubstreamsrpc.Response{Message: &pbsubstreamsrpc.Response_BlockUndoSignal{BlockUndoSignal: undoSignal}})
+}
+
+// Sleep waits `duration` before sending the next response, or until the client disconnects.
+func (s *Stream) Sleep(duration time.Duration) *Stream {
+	s.steps = append(s.steps, func(_ *pbsubstreamsrpc.Request, stream pbsubstreamsrpc.Stream_BlocksServer) error {
+		select {
+		case <-time.After(duration):
+			return nil
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	})
+
+	return s
+}
+
+// Error terminates the stream with a gRPC error of the given code, `codes.Unavailable` for
+// example is retried by the [sink.Sinker] while `codes.InvalidArgument` is fatal.
+func (s *Stream) Error(code codes.Code, message string) *Stream {
+	s.steps = append(s.steps, func(_ *pbsubstreamsrpc.Request, stream pbsubstreamsrpc.Stream_BlocksServer) error {
+		return status.Error(code, message)
+	})
+
+	return s
+}
+
+// Hang keeps the stream open without sending anything until the client disconnects.
+func (s *Stream) Hang() *Stream {
+	s.steps = append(s.steps, func(_ *pbsubstreamsrpc.Request, stream pbsubstreamsrpc.Stream_BlocksServer) error {
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	})
+
+	return s
+}
+
+func (s *Stream) serve(request *pbsubstreamsrpc.Request, stream pbsubstreamsrpc.Stream_BlocksServer) error {
+	for _, step := range s.steps {
+		if err := step(request, stream); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+)
+
+// Tx is a transaction opened by a [TransactionalHandler], every change made through it must
+// become visible atomically on [Tx.Commit] or be discarded on [Tx.Rollback].
+type Tx interface {
+	// ApplyBlock writes the data of the block.
+	ApplyBlock(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, cursor *Cursor) error
+
+	// ApplyUndo reverts every data written for blocks after `undoSignal.LastValidBlock`.
+	ApplyUndo(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error
+
+	// SaveCursor writes the cursor from which the stream must resume, it's called once per
+	// transaction, after the data was applied.
+	SaveCursor(ctx context.Context, cursor *Cursor) error
+
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+// TransactionalHandler is implemented by sinks whose storage supports transactions, see
+// [NewTransactionalSinkerHandler] to drive it from a [Sinker].
+type TransactionalHandler interface {
+	Begin(ctx context.Context) (Tx, error)
+}
+
+// TransactionalSinkerHandler is a [BatchingHandler] writing each batch, along with the cursor
+// of its last block, through a single transaction of a [TransactionalHandler]. Undo signals
+// reaching already committed blocks are also applied in their own transaction with the cursor
+// of the last valid block.
+//
+// Because data and cursor are committed together, resuming from the cursor last saved by the
+// [Tx] gives exactly-once processing: load it from your storage and pass it to [Sinker.Run] on
+// startup.
+type TransactionalSinkerHandler struct {
+	*BatchingHandler
+
+	handler TransactionalHandler
+}
+
+// NewTransactionalSinkerHandler returns a [TransactionalSinkerHandler] driving `handler`, the
+// options control the batches size (see [NewBatchingHandler]), without option every block is
+// committed in its own transaction. [WithBatchRollback] is ignored, undo signals are always
+// applied through the [TransactionalHandler].
+func NewTransactionalSinkerHandler(handler TransactionalHandler, opts ...BatchingOption) *TransactionalSinkerHandler {
+	h := &TransactionalSinkerHandler{handler: handler}
+	h.BatchingHandler = NewBatchingHandler(h.commitBlocks, append(opts[:len(opts):len(opts)], WithBatchRollback(h.commitUndo))...)
+
+	return h
+}
+
+func (h *TransactionalSinkerHandler) commitBlocks(ctx context.Context, blocks []*pbsubstreamsrpc.BlockScopedData, lastCursor *Cursor) error {
+	return h.inTx(ctx, lastCursor, func(tx Tx) error {
+		for _, block := range blocks {
+			cursor, err := NewCursor(block.Cursor)
+			if err != nil {
+				return fmt.Errorf("invalid cursor of block %s: %w", blockToRef(block), err)
+			}
+
+			if err := tx.ApplyBlock(ctx, block, cursor); err != nil {
+				return fmt.Errorf("apply block %s: %w", blockToRef(block), err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (h *TransactionalSinkerHandler) commitUndo(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	return h.inTx(ctx, cursor, func(tx Tx) error {
+		if err := tx.ApplyUndo(ctx, undoSignal, cursor); err != nil {
+			return fmt.Errorf("apply undo: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// inTx runs `apply` and saves `cursor` in a new transaction, committing it if both succeed and
+// rolling it back otherwise.
+func (h *TransactionalSinkerHandler) inTx(ctx context.Context, cursor *Cursor, apply func(tx Tx) error) error {
+	tx, err := h.handler.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+
+	err = apply(tx)
+	if err == nil {
+		if err = tx.SaveCursor(ctx, cursor); err != nil {
+			err = fmt.Errorf("save cursor at block %s: %w", cursor.Block(), err)
+		}
+	}
+
+	if err != nil {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			return fmt.Errorf("%w (rollback also failed: %s)", err, rollbackErr)
+		}
+
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryTxStore is a transactional storage of blocks and cursor, changes made in a
+// transaction are staged and only become visible on commit
+type memoryTxStore struct {
+	blocks    []bstream.BlockRef
+	cursor    *Cursor
+	failApply uint64
+	rollbacks int
+}
+
+func (s *memoryTxStore) Begin(ctx context.Context) (Tx, error) {
+	return &memoryTx{store: s, blocks: append([]bstream.BlockRef(nil), s.blocks...)}, nil
+}
+
+type memoryTx struct {
+	store  *memoryTxStore
+	blocks []bstream.BlockRef
+	cursor *Cursor
+}
+
+func (tx *memoryTx) ApplyBlock(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, cursor *Cursor) error {
+	if data.Clock.Number == tx.store.failApply {
+		return errors.New("storage failure")
+	}
+
+	tx.blocks = append(tx.blocks, blockToRef(data))
+	return nil
+}
+
+func (tx *memoryTx) ApplyUndo(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	for len(tx.blocks) > 0 && tx.blocks[len(tx.blocks)-1].Num() > undoSignal.LastValidBlock.Number {
+		tx.blocks = tx.blocks[:len(tx.blocks)-1]
+	}
+
+	return nil
+}
+
+func (tx *memoryTx) SaveCursor(ctx context.Context, cursor *Cursor) error {
+	tx.cursor = cursor
+	return nil
+}
+
+func (tx *memoryTx) Commit(ctx context.Context) error {
+	tx.store.blocks = tx.blocks
+	tx.store.cursor = tx.cursor
+	return nil
+}
+
+func (tx *memoryTx) Rollback(ctx context.Context) error {
+	tx.store.rollbacks++
+	return nil
+}
+
+func (s *memoryTxStore) blockStrings() (out []string) {
+	for _, block := range s.blocks {
+		out = append(out, block.String())
+	}
+
+	return
+}
+
+func TestTransactionalSinkerHandler(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryTxStore{}
+	handler := NewTransactionalSinkerHandler(store, WithBatchMaxBlocks(2))
+
+	for _, id := range []string{"1a", "2a", "3a"} {
+		require.NoError(t, handler.HandleBlockScopedData(ctx, cursoredBlockScopedData(id), nil, testCursor(id)))
+	}
+
+	assert.Equal(t, []string{"#1 (a)", "#2 (a)"}, store.blockStrings())
+	assert.Equal(t, testCursor("2a").String(), store.cursor.String())
+
+	require.NoError(t, handler.HandleBlockRangeCompletion(ctx, testCursor("3a")))
+	assert.Equal(t, []string{"#1 (a)", "#2 (a)", "#3 (a)"}, store.blockStrings())
+	assert.Equal(t, testCursor("3a").String(), store.cursor.String())
+	assert.Equal(t, testCursor("3a").String(), handler.CommittedCursor().String())
+
+	require.NoError(t, handler.HandleBlockUndoSignal(ctx, msgBlockUndoSignal("1a").blockUndoSignal, testCursor("1a")))
+	assert.Equal(t, []string{"#1 (a)"}, store.blockStrings())
+	assert.Equal(t, testCursor("1a").String(), store.cursor.String())
+}
+
+func TestTransactionalSinkerHandler_RollbackOnFailure(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryTxStore{failApply: 2}
+	handler := NewTransactionalSinkerHandler(store, WithBatchMaxBlocks(2))
+
+	require.NoError(t, handler.HandleBlockScopedData(ctx, cursoredBlockScopedData("1a"), nil, testCursor("1a")))
+
+	err := handler.HandleBlockScopedData(ctx, cursoredBlockScopedData("2a"), nil, testCursor("2a"))
+	require.ErrorContains(t, err, "apply block #2 (a): storage failure")
+
+	assert.Equal(t, 1, store.rollbacks)
+	assert.Empty(t, store.blocks, "nothing should be committed when the transaction fails")
+	assert.Nil(t, store.cursor)
+	assert.Equal(t, 2, handler.PendingCount(), "blocks should be kept for the next flush")
+}
+
+func cursoredBlockScopedData(id string) *pbsubstreamsrpc.BlockScopedData {
+	data := blockScopedData(id, 0)
+	data.Cursor = testCursor(id).String()
+
+	return data
+}
@@ -0,0 +1,91 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// TypedBlockScopedDataHandler is the equivalent of [SinkerHandler.HandleBlockScopedData] but
+// receives the module's output already decoded into `T` as well as the block's clock instead
+// of the raw [pbsubstreamsrpc.BlockScopedData].
+type TypedBlockScopedDataHandler[T proto.Message] func(ctx context.Context, clock *pbsubstreams.Clock, output T, isLive *bool, cursor *Cursor) error
+
+type typedSinkerHandlers[T proto.Message] struct {
+	expectedType          string
+	handleBlockScopedData TypedBlockScopedDataHandler[T]
+	handleBlockUndoSignal func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error
+}
+
+// NewTypedSinkerHandlers creates a [SinkerHandler] that decodes each [pbsubstreamsrpc.BlockScopedData]
+// module's output into a new instance of `T` before calling `handleBlockScopedData`, for example:
+//
+//	sink.NewTypedSinkerHandlers(sinker, func(ctx context.Context, clock *pbsubstreams.Clock, changes *pbchanges.DatabaseChanges, isLive *bool, cursor *sink.Cursor) error {
+//		...
+//	}, handleBlockUndoSignal)
+//
+// The type URL of the received output is validated against [Sinker.OutputModuleTypeUnprefixed]
+// of the received `sinker`. When the type does not match or the payload cannot be decoded into `T`,
+// the handler returns a [*DecodeError] naming the block and the type URL received.
+//
+// `T` must be a concrete generated message pointer type like `*pbchanges.DatabaseChanges`.
+func NewTypedSinkerHandlers[T proto.Message](
+	sinker *Sinker,
+	handleBlockScopedData TypedBlockScopedDataHandler[T],
+	handleBlockUndoSignal func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error,
+) SinkerHandler {
+	return typedSinkerHandlers[T]{sinker.OutputModuleTypeUnprefixed(), handleBlockScopedData, handleBlockUndoSignal}
+}
+
+func (h typedSinkerHandlers[T]) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+	output, err := h.decode(data)
+	if err != nil {
+		return err
+	}
+
+	return h.handleBlockScopedData(ctx, data.Clock, output, isLive, cursor)
+}
+
+func (h typedSinkerHandlers[T]) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	return h.handleBlockUndoSignal(ctx, undoSignal, cursor)
+}
+
+func (h typedSinkerHandlers[T]) decode(data *pbsubstreamsrpc.BlockScopedData) (out T, err error) {
+	// Works on the nil `T` value, `ProtoReflect` is usable on a nil message pointer to access type information
+	out = out.ProtoReflect().New().Interface().(T)
+
+	mapOutput := data.GetOutput().GetMapOutput()
+	if mapOutput == nil {
+		// Module produced no output for this block, handler receives an empty message
+		return out, nil
+	}
+
+	if typeURLMessageName(mapOutput.TypeUrl) != h.expectedType {
+		return out, &DecodeError{
+			Block:   blockToRef(data),
+			TypeURL: mapOutput.TypeUrl,
+			Err:     fmt.Errorf("expected output module type %q", h.expectedType),
+		}
+	}
+
+	if err := mapOutput.UnmarshalTo(out); err != nil {
+		return out, &DecodeError{Block: blockToRef(data), TypeURL: mapOutput.TypeUrl, Err: err}
+	}
+
+	return out, nil
+}
+
+// typeURLMessageName returns the fully qualified message name of a `google.protobuf.Any`
+// type URL which is everything after the last `/`, a `proto:` prefix is also accepted.
+func typeURLMessageName(typeURL string) string {
+	if i := strings.LastIndex(typeURL, "/"); i >= 0 {
+		typeURL = typeURL[i+1:]
+	}
+
+	unprefixed, _ := sanitizeModuleType(typeURL)
+	return unprefixed
+}
@@ -0,0 +1,61 @@
+package sink
+
+import (
+	"context"
+	"testing"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestTypedSinkerHandlers(t *testing.T) {
+	sinker := &Sinker{outputModule: &pbsubstreams.Module{
+		Name:   "map_values",
+		Output: &pbsubstreams.Module_Output{Type: "proto:google.protobuf.StringValue"},
+	}}
+
+	var received []string
+	handler := NewTypedSinkerHandlers(sinker,
+		func(ctx context.Context, clock *pbsubstreams.Clock, output *wrapperspb.StringValue, isLive *bool, cursor *Cursor) error {
+			received = append(received, clock.Id+":"+output.Value)
+			return nil
+		},
+		func(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+			return nil
+		},
+	)
+
+	handle := func(id string, output proto.Message) error {
+		data := blockScopedData(id, 0)
+		if output != nil {
+			anyOutput, err := anypb.New(output)
+			require.NoError(t, err)
+
+			data.Output = &pbsubstreamsrpc.MapModuleOutput{Name: "map_values", MapOutput: anyOutput}
+		}
+
+		return handler.HandleBlockScopedData(context.Background(), data, nil, nil)
+	}
+
+	require.NoError(t, handle("1a", wrapperspb.String("first")))
+	require.NoError(t, handle("2a", nil))
+	assert.Equal(t, []string{"a:first", "a:"}, received)
+
+	err := handle("3a", wrapperspb.Int64(3))
+
+	var decodeErr *DecodeError
+	require.ErrorAs(t, err, &decodeErr)
+	assert.Equal(t, uint64(3), decodeErr.Block.Num())
+	assert.Equal(t, "type.googleapis.com/google.protobuf.Int64Value", decodeErr.TypeURL)
+}
+
+func TestTypeURLMessageName(t *testing.T) {
+	assert.Equal(t, "acme.v1.Events", typeURLMessageName("type.googleapis.com/acme.v1.Events"))
+	assert.Equal(t, "acme.v1.Events", typeURLMessageName("proto:acme.v1.Events"))
+	assert.Equal(t, "acme.v1.Events", typeURLMessageName("acme.v1.Events"))
+}
@@ -79,6 +79,125 @@ type SinkerCompletionHandler interface {
 	HandleBlockRangeCompletion(ctx context.Context, cursor *Cursor) error
 }
 
+// SinkerCommittedCursorHandler defines an extra interface that can be implemented on top of `SinkerHandler` by
+// handlers that persist their data at a different pace than the messages they receive, for example by batching
+// multiple blocks together (see [BatchingHandler]).
+//
+// When implemented, a [Sinker] configured with a [CursorStore] saves the cursor returned by [CommittedCursor]
+// instead of the cursor of the last message handled, so that a restart resumes right after the last persisted data.
+type SinkerCommittedCursorHandler interface {
+	// CommittedCursor returns the cursor up to which the handler's data has been durably persisted, a blank
+	// cursor means nothing was persisted yet in which case the [Sinker] saves nothing.
+	CommittedCursor() *Cursor
+}
+
+// SinkerSessionHandler defines an extra interface that can be implemented on top of `SinkerHandler` where the
+// callback will be invoked each time a session is established with the Substreams server, once per connection.
+type SinkerSessionHandler interface {
+	// HandleSession is called when the server initializes the session, before any other message of the stream.
+	//
+	// Your handler must return an error value that can be nil or non-nil, the same retry semantics as
+	// [SinkerHandler.HandleBlockScopedData] applies.
+	HandleSession(ctx context.Context, session *Session) error
+}
+
+// SinkerProgressHandler defines an extra interface that can be implemented on top of `SinkerHandler` where the
+// callback will be invoked each time the Substreams server reports its parallel processing progress.
+type SinkerProgressHandler interface {
+	// HandleProgress is called for each progress message received, the handler should be minimal as progress
+	// messages are received frequently while the server processes historical blocks.
+	//
+	// Your handler must return an error value that can be nil or non-nil, the same retry semantics as
+	// [SinkerHandler.HandleBlockScopedData] applies.
+	HandleProgress(ctx context.Context, progress *Progress) error
+}
+
+// SinkerReconnectHandler defines an extra interface that can be implemented on top of `SinkerHandler` where the
+// callback will be invoked each time the [Sinker] is about to reconnect following a retryable error.
+type SinkerReconnectHandler interface {
+	// HandleReconnect is called before the [Sinker] waits and reconnects to the Substreams server. It's not
+	// called when the retry budget is exhausted, the [Sinker] terminates in that case.
+	//
+	// If non-nil, the returned error terminates the [Sinker].
+	HandleReconnect(ctx context.Context, event *ReconnectEvent) error
+}
+
+// SinkerLivenessHandler defines an extra interface that can be implemented on top of `SinkerHandler` where the
+// callback will be invoked when the stream transitions from historical to live blocks or vice versa. It requires
+// a [LivenessChecker] to be configured on the [Sinker], see [WithLivenessChecker].
+type SinkerLivenessHandler interface {
+	// HandleLivenessChange is called, before the block is handled, with the first block for which
+	// liveness changed. The stream is assumed to start non-live, so the first call always reports
+	// `isLive` as true.
+	//
+	// Your handler must return an error value that can be nil or non-nil, the same retry semantics as
+	// [SinkerHandler.HandleBlockScopedData] applies.
+	HandleLivenessChange(ctx context.Context, isLive bool, block bstream.BlockRef) error
+}
+
+// SinkerFinalityHandler defines an extra interface that can be implemented on top of `SinkerHandler` where the
+// callback will be invoked each time the final block height advances. It's mostly useful without an undo buffer,
+// where handled blocks are not final yet, to promote data to final or compact undo journals.
+type SinkerFinalityHandler interface {
+	// HandleFinalBlockHeight is called, after `block` has been handled, when the final block height it carries
+	// is higher than the previous one. Every block at or below `finalBlockHeight` is final and will never be
+	// reverted. While processing historical blocks, `finalBlockHeight` is usually higher than `block`.
+	//
+	// If non-nil, the returned error is handled like a failure to save the cursor, the block is not delivered
+	// again but the notification is retried with the next block.
+	HandleFinalBlockHeight(ctx context.Context, finalBlockHeight uint64, block bstream.BlockRef) error
+}
+
+// SinkerOrphanedBlocksHandler defines an extra interface that can be implemented on top of `SinkerHandler` by
+// handlers that need to know exactly which blocks an undo signal reverts, for example because their data is keyed
+// by block ID. It's only used when the [Sinker] is not configured with an undo buffer.
+//
+// When implemented, the [Sinker] keeps track of the blocks handled that are not yet final and calls
+// [HandleOrphanedBlocks] instead of [SinkerHandler.HandleBlockUndoSignal].
+type SinkerOrphanedBlocksHandler interface {
+	// HandleOrphanedBlocks is called for each undo signal with the blocks, newest first, that were handled
+	// and are now reverted. Configure [WithOrphanedBlockData] to receive the data originally handled for
+	// each block.
+	//
+	// The list is best-effort, `truncated` is true when the undo signal also reverts blocks missing from
+	// `orphaned`. This happens when they were handled before the [Sinker] restarted or when more than 10 000
+	// blocks were handled without the final block height advancing. The handler must then fall back to
+	// reverting everything above `undoSignal.LastValidBlock`, like [SinkerHandler.HandleBlockUndoSignal] does.
+	//
+	// Your handler must return an error value that can be nil or non-nil, the same retry semantics as
+	// [SinkerHandler.HandleBlockUndoSignal] applies.
+	HandleOrphanedBlocks(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, orphaned []*OrphanedBlock, truncated bool, cursor *Cursor) error
+}
+
+// SinkerHandlerWrapper defines an extra interface implemented by handlers wrapping another [SinkerHandler], like
+// [ReversibleStateHandler]. The [Sinker] looks for the extra interfaces a wrapper doesn't implement itself, for
+// example [SinkerCompletionHandler] or [SinkerCommittedCursorHandler], on the handler it wraps so that wrapping a
+// handler doesn't change how the [Sinker] drives it.
+type SinkerHandlerWrapper interface {
+	// Unwrap returns the wrapped handler.
+	Unwrap() SinkerHandler
+}
+
+// extraHandler returns the first handler implementing `T` out of `handler` and the handlers it wraps, see
+// [SinkerHandlerWrapper].
+func extraHandler[T any](handler SinkerHandler) (T, bool) {
+	for handler != nil {
+		if v, ok := handler.(T); ok {
+			return v, true
+		}
+
+		wrapper, ok := handler.(SinkerHandlerWrapper)
+		if !ok {
+			break
+		}
+
+		handler = wrapper.Unwrap()
+	}
+
+	var zero T
+	return zero, false
+}
+
 type Cursor struct {
 	*bstream.Cursor
 }
@@ -169,3 +288,34 @@ func (c *Cursor) String() string {
 //
 // )
 type SubstreamsMode uint
+
+// CursorMismatchPolicy determines what the [Sinker] does when the [CursorRecord] loaded
+// from its [CursorStore] was produced by a different module than the one currently
+// configured (different output module hash, package name or network).
+//
+// ENUM(
+//
+//	Fail
+//	Warn
+//	Restart
+//
+// )
+type CursorMismatchPolicy uint
+
+// UndoOverflowHook is called, with the [UndoOverflowPolicy] set to [UndoOverflowPolicyHook], when
+// `undoSignal` reverts blocks that were already emitted to the handler by the undo buffer. Every
+// emitted data after `overflow.LastValidBlock` must be reverted and `cursor` persisted. Returning
+// an error stops the [Sinker], the undo signal is received again if the [Sinker] is restarted.
+type UndoOverflowHook func(ctx context.Context, overflow *UndoOverflowError, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error
+
+// UndoOverflowPolicy determines what the [Sinker] does when an undo signal reverts blocks
+// that were already emitted to the handler by the undo buffer, see [WithUndoOverflowPolicy].
+//
+// ENUM(
+//
+//	Fail
+//	Forward
+//	Hook
+//
+// )
+type UndoOverflowPolicy uint
@@ -11,6 +11,74 @@ import (
 	"strings"
 )
 
+const (
+	// CursorMismatchPolicyFail is a CursorMismatchPolicy of type Fail.
+	CursorMismatchPolicyFail CursorMismatchPolicy = iota
+	// CursorMismatchPolicyWarn is a CursorMismatchPolicy of type Warn.
+	CursorMismatchPolicyWarn
+	// CursorMismatchPolicyRestart is a CursorMismatchPolicy of type Restart.
+	CursorMismatchPolicyRestart
+)
+
+const _CursorMismatchPolicyName = "FailWarnRestart"
+
+var _CursorMismatchPolicyNames = []string{
+	_CursorMismatchPolicyName[0:4],
+	_CursorMismatchPolicyName[4:8],
+	_CursorMismatchPolicyName[8:15],
+}
+
+// CursorMismatchPolicyNames returns a list of possible string values of CursorMismatchPolicy.
+func CursorMismatchPolicyNames() []string {
+	tmp := make([]string, len(_CursorMismatchPolicyNames))
+	copy(tmp, _CursorMismatchPolicyNames)
+	return tmp
+}
+
+var _CursorMismatchPolicyMap = map[CursorMismatchPolicy]string{
+	CursorMismatchPolicyFail:    _CursorMismatchPolicyName[0:4],
+	CursorMismatchPolicyWarn:    _CursorMismatchPolicyName[4:8],
+	CursorMismatchPolicyRestart: _CursorMismatchPolicyName[8:15],
+}
+
+// String implements the Stringer interface.
+func (x CursorMismatchPolicy) String() string {
+	if str, ok := _CursorMismatchPolicyMap[x]; ok {
+		return str
+	}
+	return fmt.Sprintf("CursorMismatchPolicy(%d)", x)
+}
+
+var _CursorMismatchPolicyValue = map[string]CursorMismatchPolicy{
+	_CursorMismatchPolicyName[0:4]:  CursorMismatchPolicyFail,
+	_CursorMismatchPolicyName[4:8]:  CursorMismatchPolicyWarn,
+	_CursorMismatchPolicyName[8:15]: CursorMismatchPolicyRestart,
+}
+
+// ParseCursorMismatchPolicy attempts to convert a string to a CursorMismatchPolicy
+func ParseCursorMismatchPolicy(name string) (CursorMismatchPolicy, error) {
+	if x, ok := _CursorMismatchPolicyValue[name]; ok {
+		return x, nil
+	}
+	return CursorMismatchPolicy(0), fmt.Errorf("%s is not a valid CursorMismatchPolicy, try [%s]", name, strings.Join(_CursorMismatchPolicyNames, ", "))
+}
+
+// MarshalText implements the text marshaller method
+func (x CursorMismatchPolicy) MarshalText() ([]byte, error) {
+	return []byte(x.String()), nil
+}
+
+// UnmarshalText implements the text unmarshaller method
+func (x *CursorMismatchPolicy) UnmarshalText(text []byte) error {
+	name := string(text)
+	tmp, err := ParseCursorMismatchPolicy(name)
+	if err != nil {
+		return err
+	}
+	*x = tmp
+	return nil
+}
+
 const (
 	// SubstreamsModeDevelopment is a SubstreamsMode of type Development.
 	SubstreamsModeDevelopment SubstreamsMode = iota
@@ -73,3 +141,71 @@ func (x *SubstreamsMode) UnmarshalText(text []byte) error {
 	*x = tmp
 	return nil
 }
+
+const (
+	// UndoOverflowPolicyFail is a UndoOverflowPolicy of type Fail.
+	UndoOverflowPolicyFail UndoOverflowPolicy = iota
+	// UndoOverflowPolicyForward is a UndoOverflowPolicy of type Forward.
+	UndoOverflowPolicyForward
+	// UndoOverflowPolicyHook is a UndoOverflowPolicy of type Hook.
+	UndoOverflowPolicyHook
+)
+
+const _UndoOverflowPolicyName = "FailForwardHook"
+
+var _UndoOverflowPolicyNames = []string{
+	_UndoOverflowPolicyName[0:4],
+	_UndoOverflowPolicyName[4:11],
+	_UndoOverflowPolicyName[11:15],
+}
+
+// UndoOverflowPolicyNames returns a list of possible string values of UndoOverflowPolicy.
+func UndoOverflowPolicyNames() []string {
+	tmp := make([]string, len(_UndoOverflowPolicyNames))
+	copy(tmp, _UndoOverflowPolicyNames)
+	return tmp
+}
+
+var _UndoOverflowPolicyMap = map[UndoOverflowPolicy]string{
+	UndoOverflowPolicyFail:    _UndoOverflowPolicyName[0:4],
+	UndoOverflowPolicyForward: _UndoOverflowPolicyName[4:11],
+	UndoOverflowPolicyHook:    _UndoOverflowPolicyName[11:15],
+}
+
+// String implements the Stringer interface.
+func (x UndoOverflowPolicy) String() string {
+	if str, ok := _UndoOverflowPolicyMap[x]; ok {
+		return str
+	}
+	return fmt.Sprintf("UndoOverflowPolicy(%d)", x)
+}
+
+var _UndoOverflowPolicyValue = map[string]UndoOverflowPolicy{
+	_UndoOverflowPolicyName[0:4]:   UndoOverflowPolicyFail,
+	_UndoOverflowPolicyName[4:11]:  UndoOverflowPolicyForward,
+	_UndoOverflowPolicyName[11:15]: UndoOverflowPolicyHook,
+}
+
+// ParseUndoOverflowPolicy attempts to convert a string to a UndoOverflowPolicy
+func ParseUndoOverflowPolicy(name string) (UndoOverflowPolicy, error) {
+	if x, ok := _UndoOverflowPolicyValue[name]; ok {
+		return x, nil
+	}
+	return UndoOverflowPolicy(0), fmt.Errorf("%s is not a valid UndoOverflowPolicy, try [%s]", name, strings.Join(_UndoOverflowPolicyNames, ", "))
+}
+
+// MarshalText implements the text marshaller method
+func (x UndoOverflowPolicy) MarshalText() ([]byte, error) {
+	return []byte(x.String()), nil
+}
+
+// UnmarshalText implements the text unmarshaller method
+func (x *UndoOverflowPolicy) UnmarshalText(text []byte) error {
+	name := string(text)
+	tmp, err := ParseUndoOverflowPolicy(name)
+	if err != nil {
+		return err
+	}
+	*x = tmp
+	return nil
+}
@@ -0,0 +1,274 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+)
+
+// Window is a time window blocks are grouped into by a [WindowAggregator], it starts at `Start`,
+// included, and ends at `End`, excluded.
+type Window struct {
+	Duration time.Duration
+	Start    time.Time
+	End      time.Time
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%s window [%s, %s(", w.Duration, w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339))
+}
+
+// WindowReducer folds `data` into the `aggregate` of `window`, `aggregate` being the zero value
+// for the window's first block. The reducer must return a new aggregate and not modify the one
+// received since it's kept to revert the block on undo.
+type WindowReducer[A any] func(window Window, aggregate A, data *pbsubstreamsrpc.BlockScopedData) (A, error)
+
+// WindowEmitFunc receives the aggregate of a window once it's complete.
+type WindowEmitFunc[A any] func(ctx context.Context, window Window, aggregate A) error
+
+type WindowAggregatorOption func(c *windowAggregatorConfig)
+
+type windowAggregatorConfig struct {
+	confirmations uint64
+}
+
+// WithWindowConfirmations emits a window once its last block has `count` confirmations, that is
+// once a block `count` blocks higher has been received, instead of waiting for it to be final.
+// An undo signal going deeper than `count` blocks cannot be reflected in windows already emitted.
+func WithWindowConfirmations(count uint64) WindowAggregatorOption {
+	return func(c *windowAggregatorConfig) {
+		c.confirmations = count
+	}
+}
+
+var _ SinkerHandler = (*WindowAggregator[int])(nil)
+var _ SinkerCompletionHandler = (*WindowAggregator[int])(nil)
+
+// WindowAggregator is a [SinkerHandler] grouping blocks into time windows, based on their
+// `Clock.Timestamp`, for each of the configured durations. Each block is folded into its windows
+// with a [WindowReducer] and a window's aggregate is handed to a [WindowEmitFunc] once the window
+// is complete, that is once a block of a later window is final, or has enough confirmations (see
+// [WithWindowConfirmations]), so that no block can be added to the window anymore.
+//
+// When the [Sinker] reaches the end of a bounded block range, the windows still pending are emitted
+// even if they are not complete since no block is added to them anymore.
+//
+// Window boundaries are aligned on the Unix epoch, so daily windows start at midnight UTC and
+// weekly ones on Thursday, the epoch weekday. Undo signals retract the contributions of the
+// reverted blocks from the windows not yet emitted. A block belonging to a window already emitted,
+// which can only happen after an undo deeper than the configured confirmations, is an error.
+//
+// Like the [Sinker], it's expected to be used from a single goroutine.
+type WindowAggregator[A any] struct {
+	durations []time.Duration
+	reduce    WindowReducer[A]
+	emit      WindowEmitFunc[A]
+	config    windowAggregatorConfig
+
+	windows          *ReversibleMap[windowKey, windowState[A]]
+	headBlockNum     uint64
+	finalBlockHeight uint64
+	emittedUpTo      map[time.Duration]time.Time
+
+	// pendingStarts holds, oldest first, the start of the windows of `windows` for each duration
+	pendingStarts map[time.Duration][]int64
+}
+
+type windowKey struct {
+	duration time.Duration
+	start    int64
+}
+
+func (k windowKey) window() Window {
+	start := time.Unix(0, k.start).UTC()
+	return Window{Duration: k.duration, Start: start, End: start.Add(k.duration)}
+}
+
+type windowState[A any] struct {
+	aggregate     A
+	firstBlockNum uint64
+}
+
+func NewWindowAggregator[A any](durations []time.Duration, reduce WindowReducer[A], emit WindowEmitFunc[A], opts ...WindowAggregatorOption) *WindowAggregator[A] {
+	a := &WindowAggregator[A]{
+		durations:   durations,
+		reduce:      reduce,
+		emit:        emit,
+		windows:     NewReversibleMap[windowKey, windowState[A]](),
+		emittedUpTo: make(map[time.Duration]time.Time, len(durations)),
+
+		pendingStarts: make(map[time.Duration][]int64, len(durations)),
+	}
+
+	for _, opt := range opts {
+		opt(&a.config)
+	}
+
+	return a
+}
+
+func (a *WindowAggregator[A]) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *Cursor) error {
+	block := blockToRef(data)
+	if data.Clock.Timestamp == nil {
+		return fmt.Errorf("block %s has no timestamp", block)
+	}
+
+	a.windows.BeginBlock(block)
+	a.headBlockNum = block.Num()
+
+	timestamp := data.Clock.Timestamp.AsTime()
+	for _, duration := range a.durations {
+		key := windowKey{duration: duration, start: windowStart(timestamp, duration)}
+		window := key.window()
+
+		if !window.End.After(a.emittedUpTo[duration]) {
+			return fmt.Errorf("block %s belongs to %s which was already emitted", block, window)
+		}
+
+		state, found := a.windows.Get(key)
+		if !found {
+			state.firstBlockNum = block.Num()
+			a.addPendingStart(key)
+		}
+
+		aggregate, err := a.reduce(window, state.aggregate, data)
+		if err != nil {
+			return fmt.Errorf("reduce block %s into %s: %w", block, window, err)
+		}
+
+		state.aggregate = aggregate
+		a.windows.Set(key, state)
+	}
+
+	if data.FinalBlockHeight > a.finalBlockHeight {
+		a.finalBlockHeight = data.FinalBlockHeight
+		a.windows.Finalize(data.FinalBlockHeight)
+	}
+
+	return a.emitCompleted(ctx)
+}
+
+func (a *WindowAggregator[A]) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *Cursor) error {
+	lastValidBlock := asBlockRef(undoSignal.LastValidBlock)
+	if err := a.windows.Undo(lastValidBlock); err != nil {
+		return err
+	}
+
+	a.headBlockNum = lastValidBlock.Num()
+
+	// Undo is rare enough to rebuild the pending windows from the ones left after the revert
+	clear(a.pendingStarts)
+	a.windows.Range(func(key windowKey, _ windowState[A]) bool {
+		a.addPendingStart(key)
+		return true
+	})
+
+	return nil
+}
+
+// HandleBlockRangeCompletion emits, oldest first, every window still pending once the end of the
+// block range has been reached.
+func (a *WindowAggregator[A]) HandleBlockRangeCompletion(ctx context.Context, cursor *Cursor) error {
+	var pending []windowKey
+	for duration, starts := range a.pendingStarts {
+		for _, start := range starts {
+			pending = append(pending, windowKey{duration: duration, start: start})
+		}
+	}
+
+	return a.emitWindows(ctx, pending)
+}
+
+// PendingCount returns the number of windows not yet emitted.
+func (a *WindowAggregator[A]) PendingCount() int {
+	return a.windows.Len()
+}
+
+// emitCompleted emits, oldest first, every window that is complete. A window cannot receive blocks
+// anymore once the first block of the following window of the same duration is confirmed, only
+// the oldest pending windows of each duration need to be checked.
+func (a *WindowAggregator[A]) emitCompleted(ctx context.Context) error {
+	var completed []windowKey
+	for duration, starts := range a.pendingStarts {
+		for i := 1; i < len(starts); i++ {
+			next, _ := a.windows.Get(windowKey{duration: duration, start: starts[i]})
+			if !a.isConfirmed(next.firstBlockNum) {
+				break
+			}
+
+			completed = append(completed, windowKey{duration: duration, start: starts[i-1]})
+		}
+	}
+
+	return a.emitWindows(ctx, completed)
+}
+
+// emitWindows emits the windows of `keys`, oldest first, and removes them from the pending ones.
+func (a *WindowAggregator[A]) emitWindows(ctx context.Context, keys []windowKey) error {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].start == keys[j].start {
+			return keys[i].duration < keys[j].duration
+		}
+
+		return keys[i].start < keys[j].start
+	})
+
+	for _, key := range keys {
+		window := key.window()
+
+		// A window restored by the undo of the block that emitted it must not be emitted twice
+		if window.End.After(a.emittedUpTo[key.duration]) {
+			state, _ := a.windows.Get(key)
+			if err := a.emit(ctx, window, state.aggregate); err != nil {
+				return fmt.Errorf("emit %s: %w", window, err)
+			}
+
+			a.emittedUpTo[key.duration] = window.End
+		}
+
+		a.windows.Delete(key)
+		a.removePendingStart(key)
+	}
+
+	return nil
+}
+
+// windowStart returns the start, in Unix nanoseconds, of the window of `duration` containing
+// `timestamp`. Unlike [time.Time.Truncate] which aligns on Go's zero time, windows are aligned on
+// the Unix epoch.
+func windowStart(timestamp time.Time, duration time.Duration) int64 {
+	nanos := timestamp.UnixNano()
+	offset := nanos % int64(duration)
+	if offset < 0 {
+		offset += int64(duration)
+	}
+
+	return nanos - offset
+}
+
+// addPendingStart adds the start of `key` to the pending ones of its duration, keeping them sorted.
+func (a *WindowAggregator[A]) addPendingStart(key windowKey) {
+	starts := a.pendingStarts[key.duration]
+	i, _ := slices.BinarySearch(starts, key.start)
+
+	a.pendingStarts[key.duration] = slices.Insert(starts, i, key.start)
+}
+
+func (a *WindowAggregator[A]) removePendingStart(key windowKey) {
+	starts := a.pendingStarts[key.duration]
+	if i, found := slices.BinarySearch(starts, key.start); found {
+		a.pendingStarts[key.duration] = slices.Delete(starts, i, i+1)
+	}
+}
+
+func (a *WindowAggregator[A]) isConfirmed(blockNum uint64) bool {
+	if blockNum <= a.finalBlockHeight {
+		return true
+	}
+
+	return a.config.confirmations > 0 && a.headBlockNum >= blockNum+a.config.confirmations
+}
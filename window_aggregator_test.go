@@ -0,0 +1,165 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type windowRecorder struct {
+	emitted []string
+}
+
+func (r *windowRecorder) reduce(window Window, aggregate string, data *pbsubstreamsrpc.BlockScopedData) (string, error) {
+	if aggregate != "" {
+		aggregate += ","
+	}
+
+	return aggregate + blockToRef(data).String(), nil
+}
+
+func (r *windowRecorder) emit(ctx context.Context, window Window, aggregate string) error {
+	r.emitted = append(r.emitted, fmt.Sprintf("%s %s: %s", window.Duration, window.Start.Format("15:04"), aggregate))
+	return nil
+}
+
+func TestWindowAggregator_Finality(t *testing.T) {
+	ctx := context.Background()
+	recorder := &windowRecorder{}
+	aggregator := NewWindowAggregator([]time.Duration{time.Minute, 2 * time.Minute}, recorder.reduce, recorder.emit)
+
+	handle := func(id string, offset time.Duration, finalBlockHeight uint64) {
+		t.Helper()
+		require.NoError(t, aggregator.HandleBlockScopedData(ctx, timedBlockScopedData(id, offset, finalBlockHeight), nil, testCursor(id)))
+	}
+
+	handle("1a", 0, 0)
+	handle("2a", 30*time.Second, 1)
+	handle("3a", 60*time.Second, 2)
+	assert.Empty(t, recorder.emitted)
+
+	handle("4a", 90*time.Second, 3)
+	assert.Equal(t, []string{"1m0s 00:00: #1 (a),#2 (a)"}, recorder.emitted)
+
+	// Block #4 is reverted and its contribution retracted
+	require.NoError(t, aggregator.HandleBlockUndoSignal(ctx, msgBlockUndoSignal("3a").blockUndoSignal, testCursor("3a")))
+
+	handle("4b", 105*time.Second, 3)
+	handle("5b", 120*time.Second, 4)
+	handle("6b", 150*time.Second, 5)
+
+	assert.Equal(t, []string{
+		"1m0s 00:00: #1 (a),#2 (a)",
+		"2m0s 00:00: #1 (a),#2 (a),#3 (a),#4 (b)",
+		"1m0s 00:01: #3 (a),#4 (b)",
+	}, recorder.emitted)
+	assert.Equal(t, 2, aggregator.PendingCount())
+}
+
+func TestWindowAggregator_Confirmations(t *testing.T) {
+	ctx := context.Background()
+	recorder := &windowRecorder{}
+	aggregator := NewWindowAggregator([]time.Duration{time.Minute}, recorder.reduce, recorder.emit, WithWindowConfirmations(1))
+
+	for _, block := range []struct {
+		id     string
+		offset time.Duration
+	}{
+		{"1a", 0},
+		{"2a", 30 * time.Second},
+		{"3a", 60 * time.Second},
+	} {
+		require.NoError(t, aggregator.HandleBlockScopedData(ctx, timedBlockScopedData(block.id, block.offset, 0), nil, testCursor(block.id)))
+	}
+	assert.Empty(t, recorder.emitted)
+
+	require.NoError(t, aggregator.HandleBlockScopedData(ctx, timedBlockScopedData("4a", 90*time.Second, 0), nil, testCursor("4a")))
+	assert.Equal(t, []string{"1m0s 00:00: #1 (a),#2 (a)"}, recorder.emitted)
+
+	// An undo deeper than the confirmations adding a block to an emitted window is an error
+	require.NoError(t, aggregator.HandleBlockUndoSignal(ctx, msgBlockUndoSignal("2a").blockUndoSignal, testCursor("2a")))
+	err := aggregator.HandleBlockScopedData(ctx, timedBlockScopedData("3b", 45*time.Second, 0), nil, testCursor("3b"))
+	require.ErrorContains(t, err, "block #3 (b) belongs to 1m0s window [1970-01-01T00:00:00Z, 1970-01-01T00:01:00Z( which was already emitted")
+}
+
+func TestWindowAggregator_RangeCompletion(t *testing.T) {
+	ctx := context.Background()
+	recorder := &windowRecorder{}
+	aggregator := NewWindowAggregator([]time.Duration{time.Minute, 2 * time.Minute}, recorder.reduce, recorder.emit)
+
+	for _, block := range []struct {
+		id     string
+		offset time.Duration
+	}{
+		{"1a", 0},
+		{"2a", 60 * time.Second},
+		{"3a", 90 * time.Second},
+	} {
+		require.NoError(t, aggregator.HandleBlockScopedData(ctx, timedBlockScopedData(block.id, block.offset, 3), nil, testCursor(block.id)))
+	}
+	assert.Equal(t, []string{"1m0s 00:00: #1 (a)"}, recorder.emitted)
+
+	// No block is added anymore once the range ended, pending windows are emitted as is
+	require.NoError(t, aggregator.HandleBlockRangeCompletion(ctx, testCursor("3a")))
+	assert.Equal(t, []string{
+		"1m0s 00:00: #1 (a)",
+		"2m0s 00:00: #1 (a),#2 (a),#3 (a)",
+		"1m0s 00:01: #2 (a),#3 (a)",
+	}, recorder.emitted)
+	assert.Equal(t, 0, aggregator.PendingCount())
+}
+
+func TestWindowAggregator_EpochAlignment(t *testing.T) {
+	ctx := context.Background()
+
+	var starts []time.Time
+	emit := func(ctx context.Context, window Window, aggregate string) error {
+		starts = append(starts, window.Start)
+		return nil
+	}
+
+	week := 7 * 24 * time.Hour
+	aggregator := NewWindowAggregator([]time.Duration{week}, (&windowRecorder{}).reduce, emit)
+
+	// Friday 1970-01-09 and Friday 1970-01-16, the Unix epoch being a Thursday
+	require.NoError(t, aggregator.HandleBlockScopedData(ctx, timedBlockScopedData("1a", 8*24*time.Hour, 1), nil, testCursor("1a")))
+	require.NoError(t, aggregator.HandleBlockScopedData(ctx, timedBlockScopedData("2a", 15*24*time.Hour, 2), nil, testCursor("2a")))
+
+	require.Len(t, starts, 1)
+	assert.Equal(t, time.Date(1970, time.January, 8, 0, 0, 0, 0, time.UTC), starts[0])
+	assert.Equal(t, time.Thursday, starts[0].Weekday())
+}
+
+func TestWindowStart(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		duration  time.Duration
+		expected  time.Time
+	}{
+		{"hour", time.Date(2024, time.March, 5, 13, 45, 0, 0, time.UTC), time.Hour, time.Date(2024, time.March, 5, 13, 0, 0, 0, time.UTC)},
+		{"day", time.Date(2024, time.March, 5, 13, 45, 0, 0, time.UTC), 24 * time.Hour, time.Date(2024, time.March, 5, 0, 0, 0, 0, time.UTC)},
+		{"week", time.Date(2024, time.March, 5, 13, 45, 0, 0, time.UTC), 7 * 24 * time.Hour, time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"before epoch", time.Date(1969, time.December, 31, 23, 30, 0, 0, time.UTC), time.Hour, time.Date(1969, time.December, 31, 23, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, time.Unix(0, windowStart(tt.timestamp, tt.duration)).UTC())
+		})
+	}
+}
+
+func timedBlockScopedData(id string, offset time.Duration, finalBlockHeight uint64) *pbsubstreamsrpc.BlockScopedData {
+	number, blockID := extractNumberAndIDFromBlockID(id)
+
+	return &pbsubstreamsrpc.BlockScopedData{
+		Clock:            testClock(blockID, number, time.Unix(0, 0).Add(offset)),
+		FinalBlockHeight: finalBlockHeight,
+	}
+}